@@ -35,7 +35,11 @@ func main() {
 
 	app.Obtain(&a)
 
-	app.Handle(&a, &app.InitTask{})
+	err = app.Handle(&a, &app.InitTask{})
+
+	if err != nil {
+		log.Panicln(err)
+	}
 
 	kk.DispatchMain()
 
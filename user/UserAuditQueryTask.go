@@ -0,0 +1,39 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserAuditQueryTaskResult struct {
+	app.Result
+	Counter *UserQueryCounter `json:"counter,omitempty"`
+	Audits  []UserAudit       `json:"audits,omitempty"`
+}
+
+type UserAuditQueryTask struct {
+	app.Task
+	Tid       int64  `json:"tid"` // 租户
+	Uid       int64  `json:"uid"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"` // 逗号分隔
+	Source    string `json:"source"`
+	StartTime int64  `json:"startTime"` // ctime >= startTime
+	EndTime   int64  `json:"endTime"`   // ctime < endTime
+	OrderBy   string `json:"orderBy"`   // desc, asc
+	PageIndex int    `json:"p"`
+	PageSize  int    `json:"size"`
+	Counter   bool   `json:"counter"`
+	Result    UserAuditQueryTaskResult
+}
+
+func (task *UserAuditQueryTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserAuditQueryTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserAuditQueryTask) GetClientName() string {
+	return "User.Audit.Query"
+}
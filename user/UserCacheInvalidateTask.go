@@ -0,0 +1,31 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserCacheInvalidateTaskResult struct {
+	app.Result
+}
+
+/**
+ * 其他实例的失效广播, 删除本地缓存中的键
+ */
+type UserCacheInvalidateTask struct {
+	app.Task
+	Origin string   `json:"origin"` // 发送的实例
+	Keys   []string `json:"keys"`
+	Result UserCacheInvalidateTaskResult
+}
+
+func (task *UserCacheInvalidateTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserCacheInvalidateTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserCacheInvalidateTask) GetClientName() string {
+	return "User.Cache.Invalidate"
+}
@@ -0,0 +1,30 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserCanTaskResult struct {
+	app.Result
+	Allow bool `json:"allow"`
+}
+
+type UserCanTask struct {
+	app.Task
+	Tid        int64  `json:"tid"` // 租户
+	Uid        int64  `json:"uid"`
+	Permission string `json:"permission"`
+	Result     UserCanTaskResult
+}
+
+func (task *UserCanTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserCanTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserCanTask) GetClientName() string {
+	return "User.Can"
+}
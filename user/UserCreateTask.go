@@ -11,8 +11,11 @@ type UserCreateTaskResult struct {
 
 type UserCreateTask struct {
 	app.Task
+	Tid      int64  `json:"tid"` // 租户
 	Name     string `json:"name"`
 	Password string `json:"password"`
+	Actor    string `json:"actor"`  // 操作者, 记录审计日志
+	Source   string `json:"source"` // 来源
 	Result   UserCreateTaskResult
 }
 
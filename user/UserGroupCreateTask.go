@@ -0,0 +1,31 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserGroupCreateTaskResult struct {
+	app.Result
+	Group *UserGroup `json:"group,omitempty"`
+}
+
+type UserGroupCreateTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Name   string `json:"name"`
+	Title  string `json:"title"`
+	Pid    int64  `json:"pid"` // 上级分组
+	Result UserGroupCreateTaskResult
+}
+
+func (task *UserGroupCreateTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserGroupCreateTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserGroupCreateTask) GetClientName() string {
+	return "User.Group.Create"
+}
@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserGroupGetTaskResult struct {
+	app.Result
+	Group *UserGroup `json:"group,omitempty"`
+}
+
+type UserGroupGetTask struct {
+	app.Task
+	Tid    int64 `json:"tid"` // 租户
+	Id     int64 `json:"id"`
+	Result UserGroupGetTaskResult
+}
+
+func (task *UserGroupGetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserGroupGetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserGroupGetTask) GetClientName() string {
+	return "User.Group.Get"
+}
@@ -0,0 +1,31 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserGroupMemberAddTaskResult struct {
+	app.Result
+	Member *UserGroupMember `json:"member,omitempty"`
+}
+
+type UserGroupMemberAddTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Gid    int64  `json:"gid"`
+	Uid    int64  `json:"uid"`
+	Role   string `json:"role"` // owner, member
+	Result UserGroupMemberAddTaskResult
+}
+
+func (task *UserGroupMemberAddTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserGroupMemberAddTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserGroupMemberAddTask) GetClientName() string {
+	return "User.Group.Member.Add"
+}
@@ -0,0 +1,35 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserGroupMemberQueryTaskResult struct {
+	app.Result
+	Counter *UserQueryCounter `json:"counter,omitempty"`
+	Members []UserGroupMember `json:"members,omitempty"`
+}
+
+type UserGroupMemberQueryTask struct {
+	app.Task
+	Tid       int64  `json:"tid"` // 租户
+	Gid       int64  `json:"gid"`
+	Role      string `json:"role"`
+	OrderBy   string `json:"orderBy"` // desc, asc
+	PageIndex int    `json:"p"`
+	PageSize  int    `json:"size"`
+	Counter   bool   `json:"counter"`
+	Result    UserGroupMemberQueryTaskResult
+}
+
+func (task *UserGroupMemberQueryTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserGroupMemberQueryTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserGroupMemberQueryTask) GetClientName() string {
+	return "User.Group.Member.Query"
+}
@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserGroupMemberRemoveTaskResult struct {
+	app.Result
+}
+
+type UserGroupMemberRemoveTask struct {
+	app.Task
+	Tid    int64 `json:"tid"` // 租户
+	Gid    int64 `json:"gid"`
+	Uid    int64 `json:"uid"`
+	Result UserGroupMemberRemoveTaskResult
+}
+
+func (task *UserGroupMemberRemoveTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserGroupMemberRemoveTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserGroupMemberRemoveTask) GetClientName() string {
+	return "User.Group.Member.Remove"
+}
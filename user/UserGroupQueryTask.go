@@ -0,0 +1,36 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserGroupQueryTaskResult struct {
+	app.Result
+	Counter *UserQueryCounter `json:"counter,omitempty"`
+	Groups  []UserGroup       `json:"groups,omitempty"`
+}
+
+type UserGroupQueryTask struct {
+	app.Task
+	Tid       int64  `json:"tid"` // 租户
+	Pid       int64  `json:"pid"` // -1 仅顶级分组
+	Uid       int64  `json:"uid"` // 用户所在的分组
+	Name      string `json:"name"`
+	OrderBy   string `json:"orderBy"` // desc, asc
+	PageIndex int    `json:"p"`
+	PageSize  int    `json:"size"`
+	Counter   bool   `json:"counter"`
+	Result    UserGroupQueryTaskResult
+}
+
+func (task *UserGroupQueryTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserGroupQueryTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserGroupQueryTask) GetClientName() string {
+	return "User.Group.Query"
+}
@@ -0,0 +1,28 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserGroupRemoveTaskResult struct {
+	app.Result
+}
+
+type UserGroupRemoveTask struct {
+	app.Task
+	Tid    int64 `json:"tid"` // 租户
+	Id     int64 `json:"id"`
+	Result UserGroupRemoveTaskResult
+}
+
+func (task *UserGroupRemoveTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserGroupRemoveTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserGroupRemoveTask) GetClientName() string {
+	return "User.Group.Remove"
+}
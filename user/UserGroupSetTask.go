@@ -0,0 +1,32 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserGroupSetTaskResult struct {
+	app.Result
+	Group *UserGroup `json:"group,omitempty"`
+}
+
+type UserGroupSetTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Id     int64  `json:"id"`
+	Name   string `json:"name"`
+	Title  string `json:"title"`
+	Pid    int64  `json:"pid"` // -1 移到顶级
+	Result UserGroupSetTaskResult
+}
+
+func (task *UserGroupSetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserGroupSetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserGroupSetTask) GetClientName() string {
+	return "User.Group.Set"
+}
@@ -0,0 +1,27 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserKeysTaskResult struct {
+	app.Result
+	Keys []JWK `json:"keys"`
+}
+
+type UserKeysTask struct {
+	app.Task
+	Result UserKeysTaskResult
+}
+
+func (task *UserKeysTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserKeysTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserKeysTask) GetClientName() string {
+	return "User.Keys"
+}
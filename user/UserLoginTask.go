@@ -6,16 +6,54 @@ import (
 
 type UserLoginTaskResult struct {
 	app.Result
-	User *User `json:"user,omitempty"`
+	User        *User        `json:"user,omitempty"`
+	Token       string       `json:"token,omitempty"`
+	Session     *UserSession `json:"session,omitempty"`
+	AccessToken string       `json:"accessToken,omitempty"` // JWT
+	ExpiresIn   int64        `json:"expiresIn,omitempty"`
+	Challenge   string       `json:"challenge,omitempty"`  // ERROR_USER_SECOND_FACTOR 时返回
+	RetryAfter  int64        `json:"retryAfter,omitempty"` // ERROR_USER_LOCKED 时返回 (秒)
 }
 
 type UserLoginTask struct {
 	app.Task
+	Tid      int64  `json:"tid"` // 租户
 	Name     string `json:"name"`
+	Email    string `json:"email"` // 已验证的邮箱或手机号也可用于登录
+	Phone    string `json:"phone"`
 	Password string `json:"password"`
+	Session  bool   `json:"session"` // 创建会话 token
+	Jwt      bool   `json:"jwt"`     // 签发 JWT access token
+	Device   string `json:"device"`
+	Addr     string `json:"addr"`
+	Expires  int64  `json:"expires"`
 	Result   UserLoginTaskResult
 }
 
+type UserLoginOptions struct {
+	Session bool   `json:"session"`
+	Device  string `json:"device,omitempty"`
+	Addr    string `json:"addr,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+	Jwt     bool   `json:"jwt"`
+}
+
+func (task *UserLoginTask) Options() *UserLoginOptions {
+	return &UserLoginOptions{Session: task.Session, Device: task.Device, Addr: task.Addr, Expires: task.Expires, Jwt: task.Jwt}
+}
+
+/**
+ * 登录使用的标识, 依次为 name, email, phone
+ */
+func (task *UserLoginTask) Identifier() string {
+	if task.Name != "" {
+		return task.Name
+	} else if task.Email != "" {
+		return task.Email
+	}
+	return task.Phone
+}
+
 func (task *UserLoginTask) GetResult() interface{} {
 	return &task.Result
 }
@@ -0,0 +1,34 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserOptionsAtTaskResult struct {
+	app.Result
+	Options interface{} `json:"options,omitempty"`
+	Version int64       `json:"version"`
+	Ctime   int64       `json:"ctime"`
+}
+
+type UserOptionsAtTask struct {
+	app.Task
+	Tid     int64  `json:"tid"` // 租户
+	Uid     int64  `json:"uid"`
+	Name    string `json:"name"`
+	Version int64  `json:"version"` // 指定版本
+	Time    int64  `json:"time"`    // 或该时刻的版本
+	Result  UserOptionsAtTaskResult
+}
+
+func (task *UserOptionsAtTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserOptionsAtTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserOptionsAtTask) GetClientName() string {
+	return "User.Options.At"
+}
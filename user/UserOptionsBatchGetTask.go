@@ -0,0 +1,32 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserOptionsBatchGetTaskResult struct {
+	app.Result
+	Options []UserOptionsItem `json:"options,omitempty"`
+}
+
+type UserOptionsBatchGetTask struct {
+	app.Task
+	Tid    int64  `json:"tid"`   // 租户
+	Uid    int64  `json:"uid"`   // 与 Names 一起使用
+	Names  string `json:"names"` // 逗号分隔
+	Uids   string `json:"uids"`  // 逗号分隔, 与 Name 一起使用
+	Name   string `json:"name"`
+	Result UserOptionsBatchGetTaskResult
+}
+
+func (task *UserOptionsBatchGetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserOptionsBatchGetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserOptionsBatchGetTask) GetClientName() string {
+	return "User.Options.BatchGet"
+}
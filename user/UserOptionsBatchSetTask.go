@@ -0,0 +1,36 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserOptionsBatchSetTaskResult struct {
+	app.Result
+	Versions map[string]int64         `json:"versions,omitempty"` // 配置名=写入后的版本
+	Name     string                   `json:"name,omitempty"`     // 失败时出错的配置名
+	Errors   []UserOptionsSchemaError `json:"errors,omitempty"`   // 不符合 Schema 时的字段错误
+}
+
+type UserOptionsBatchSetTask struct {
+	app.Task
+	Tid     int64                  `json:"tid"` // 租户
+	Uid     int64                  `json:"uid"`
+	Type    string                 `json:"type"`    // 所有配置的类型
+	Options map[string]interface{} `json:"options"` // 配置名=配置, 在同一事务中写入, 任一失败全部不写入
+	Mode    string                 `json:"mode"`    // 同 User.SetOptions
+	Actor   string                 `json:"actor"`   // 操作者, 记录审计日志
+	Source  string                 `json:"source"`  // 来源
+	Result  UserOptionsBatchSetTaskResult
+}
+
+func (task *UserOptionsBatchSetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserOptionsBatchSetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserOptionsBatchSetTask) GetClientName() string {
+	return "User.Options.BatchSet"
+}
@@ -0,0 +1,35 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserOptionsDeleteTaskResult struct {
+	app.Result
+}
+
+/**
+ * 删除配置, 同时清除历史版本 (不可 Rollback), 清除的版本数记录在审计日志中
+ */
+type UserOptionsDeleteTask struct {
+	app.Task
+	Tid       int64  `json:"tid"` // 租户
+	Uid       int64  `json:"uid"`
+	Name      string `json:"name"`
+	IfVersion int64  `json:"ifVersion"` // > 0 时仅在当前版本一致时删除
+	Actor     string `json:"actor"`     // 操作者, 记录审计日志
+	Source    string `json:"source"`    // 来源
+	Result    UserOptionsDeleteTaskResult
+}
+
+func (task *UserOptionsDeleteTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserOptionsDeleteTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserOptionsDeleteTask) GetClientName() string {
+	return "User.Options.Delete"
+}
@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserOptionsListTaskResult struct {
+	app.Result
+	Options []UserOptionsInfo `json:"options,omitempty"`
+}
+
+type UserOptionsListTask struct {
+	app.Task
+	Tid    int64 `json:"tid"` // 租户
+	Uid    int64 `json:"uid"`
+	Result UserOptionsListTaskResult
+}
+
+func (task *UserOptionsListTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserOptionsListTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserOptionsListTask) GetClientName() string {
+	return "User.Options.List"
+}
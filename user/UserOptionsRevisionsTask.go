@@ -0,0 +1,35 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserOptionsRevisionsTaskResult struct {
+	app.Result
+	Counter   *UserQueryCounter     `json:"counter,omitempty"`
+	Revisions []UserOptionsRevision `json:"revisions,omitempty"`
+}
+
+type UserOptionsRevisionsTask struct {
+	app.Task
+	Tid       int64  `json:"tid"` // 租户
+	Uid       int64  `json:"uid"`
+	Name      string `json:"name"`
+	Options   bool   `json:"options"` // 是否返回配置内容
+	PageIndex int    `json:"p"`
+	PageSize  int    `json:"size"`
+	Counter   bool   `json:"counter"`
+	Result    UserOptionsRevisionsTaskResult
+}
+
+func (task *UserOptionsRevisionsTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserOptionsRevisionsTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserOptionsRevisionsTask) GetClientName() string {
+	return "User.Options.Revisions"
+}
@@ -0,0 +1,35 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserOptionsRollbackTaskResult struct {
+	app.Result
+	Version int64 `json:"version"` // 回滚后的新版本
+}
+
+type UserOptionsRollbackTask struct {
+	app.Task
+	Tid       int64  `json:"tid"` // 租户
+	Uid       int64  `json:"uid"`
+	Name      string `json:"name"`
+	Version   int64  `json:"version"` // 回滚到的版本
+	Time      int64  `json:"time"`    // 或该时刻的版本
+	IfVersion int64  `json:"ifVersion"`
+	Actor     string `json:"actor"`
+	Source    string `json:"source"`
+	Result    UserOptionsRollbackTaskResult
+}
+
+func (task *UserOptionsRollbackTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserOptionsRollbackTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserOptionsRollbackTask) GetClientName() string {
+	return "User.Options.Rollback"
+}
@@ -0,0 +1,28 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserOptionsSchemaGetTaskResult struct {
+	app.Result
+	Schema interface{} `json:"schema,omitempty"`
+}
+
+type UserOptionsSchemaGetTask struct {
+	app.Task
+	Name   string `json:"name"` // 配置名
+	Result UserOptionsSchemaGetTaskResult
+}
+
+func (task *UserOptionsSchemaGetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserOptionsSchemaGetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserOptionsSchemaGetTask) GetClientName() string {
+	return "User.Options.Schema.Get"
+}
@@ -0,0 +1,27 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserOptionsSchemaRemoveTaskResult struct {
+	app.Result
+}
+
+type UserOptionsSchemaRemoveTask struct {
+	app.Task
+	Name   string `json:"name"` // 配置名, 删除数据库中的 Schema, app.ini 中的仍然生效
+	Result UserOptionsSchemaRemoveTaskResult
+}
+
+func (task *UserOptionsSchemaRemoveTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserOptionsSchemaRemoveTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserOptionsSchemaRemoveTask) GetClientName() string {
+	return "User.Options.Schema.Remove"
+}
@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserOptionsSchemaSetTaskResult struct {
+	app.Result
+	Schema *UserOptionsSchema `json:"schema,omitempty"`
+}
+
+type UserOptionsSchemaSetTask struct {
+	app.Task
+	Name   string `json:"name"`   // 配置名
+	Schema string `json:"schema"` // JSON Schema
+	Result UserOptionsSchemaSetTaskResult
+}
+
+func (task *UserOptionsSchemaSetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserOptionsSchemaSetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserOptionsSchemaSetTask) GetClientName() string {
+	return "User.Options.Schema.Set"
+}
@@ -7,10 +7,12 @@ import (
 type UserOptionsTaskResult struct {
 	app.Result
 	Options interface{} `json:"options,omitempty"`
+	Version int64       `json:"version,omitempty"`
 }
 
 type UserOptionsTask struct {
 	app.Task
+	Tid    int64  `json:"tid"` // 租户
 	Uid    int64  `json:"uid"`
 	Name   string `json:"name"`
 	Result UserOptionsTaskResult
@@ -0,0 +1,30 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserPasswordRequestResetTaskResult struct {
+	app.Result
+}
+
+type UserPasswordRequestResetTask struct {
+	app.Task
+	Tid     int64  `json:"tid"` // 租户
+	Uid     int64  `json:"uid"`
+	Name    string `json:"name"`
+	Expires int64  `json:"expires"`
+	Result  UserPasswordRequestResetTaskResult
+}
+
+func (task *UserPasswordRequestResetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserPasswordRequestResetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserPasswordRequestResetTask) GetClientName() string {
+	return "User.Password.RequestReset"
+}
@@ -0,0 +1,32 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserPasswordResetTaskResult struct {
+	app.Result
+	User *User `json:"user,omitempty"`
+}
+
+type UserPasswordResetTask struct {
+	app.Task
+	Tid          int64  `json:"tid"` // 租户
+	Token        string `json:"token"`
+	Password     string `json:"password"`
+	KeepSessions bool   `json:"keepSessions"` // 默认注销该用户的全部会话
+	Addr         string `json:"addr"`         // 来源, 记录审计日志
+	Result       UserPasswordResetTaskResult
+}
+
+func (task *UserPasswordResetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserPasswordResetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserPasswordResetTask) GetClientName() string {
+	return "User.Password.Reset"
+}
@@ -6,13 +6,16 @@ import (
 
 type UserPasswordTaskResult struct {
 	app.Result
-	User *User `json:"user,omitempty"`
+	User       *User `json:"user,omitempty"`
+	RetryAfter int64 `json:"retryAfter,omitempty"` // ERROR_USER_LOCKED 时返回 (秒)
 }
 
 type UserPasswordTask struct {
 	app.Task
+	Tid      int64  `json:"tid"` // 租户
 	Uid      int64  `json:"uid"`
 	Password string `json:"password"`
+	Addr     string `json:"addr"`
 	Result   UserPasswordTaskResult
 }
 
@@ -13,20 +13,42 @@ type UserQueryCounter struct {
 
 type UserQueryTaskResult struct {
 	app.Result
-	Counter *UserQueryCounter `json:"counter,omitempty"`
-	Users   []User            `json:"users,omitempty"`
+	Counter *UserQueryCounter        `json:"counter,omitempty"`
+	Users   []User                   `json:"users,omitempty"`
+	Items   []map[string]interface{} `json:"items,omitempty"` // 指定 Fields 时只返回这些字段
+	Next    string                   `json:"next,omitempty"`  // 游标模式下一页的游标, 为空时没有下一页
 }
 
 type UserQueryTask struct {
 	app.Task
-	Uid       int64  `json:"uid"`
-	Name      string `json:"name"`
-	Names     string `json:"names"`
-	OrderBy   string `json:"orderBy"` // desc, asc
-	PageIndex int    `json:"p"`
-	PageSize  int    `json:"size"`
-	Counter   bool   `json:"counter"`
-	Result    UserQueryTaskResult
+	Tid           int64  `json:"tid"` // 租户
+	Uid           int64  `json:"uid"`
+	Name          string `json:"name"`
+	Names         string `json:"names"`
+	Prefix        string `json:"prefix"`  // 名称前缀
+	Keyword       string `json:"keyword"` // 名称包含
+	Gid           int64  `json:"gid"`     // 分组成员
+	Email         string `json:"email"`
+	Phone         string `json:"phone"`
+	EmailVerified string `json:"emailVerified"` // "1" 已验证, "0" 未验证
+	PhoneVerified string `json:"phoneVerified"`
+	Status        string `json:"status"`        // 包含的状态, 如 "0,1"
+	ExcludeStatus string `json:"excludeStatus"` // 排除的状态, 都为空时排除已删除
+	StartCtime    int64  `json:"startCtime"`    // 时间范围 [start, end), 0 不限
+	EndCtime      int64  `json:"endCtime"`
+	StartMtime    int64  `json:"startMtime"`
+	EndMtime      int64  `json:"endMtime"`
+	StartAtime    int64  `json:"startAtime"`
+	EndAtime      int64  `json:"endAtime"` // 如 90 天未登录
+	SortBy        string `json:"sortBy"`   // UserQuerySortFields, 默认 id
+	OrderBy       string `json:"orderBy"`  // desc, asc
+	Fields        string `json:"fields"`   // 返回的字段, 逗号分隔, 见 UserQueryFields
+	PageIndex     int    `json:"p"`
+	PageSize      int    `json:"size"`
+	Counter       bool   `json:"counter"`
+	Cursor        bool   `json:"cursor"` // 游标模式, 按 size 取第一页, 忽略 p
+	After         string `json:"after"`  // 上一页返回的 next, 需使用相同的条件和排序
+	Result        UserQueryTaskResult
 }
 
 func (T *UserQueryTask) GetResult() interface{} {
@@ -0,0 +1,31 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserRestoreTaskResult struct {
+	app.Result
+	User *User `json:"user,omitempty"`
+}
+
+type UserRestoreTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Uid    int64  `json:"uid"`
+	Actor  string `json:"actor"`  // 操作者, 记录审计日志
+	Source string `json:"source"` // 来源
+	Result UserRestoreTaskResult
+}
+
+func (task *UserRestoreTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserRestoreTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserRestoreTask) GetClientName() string {
+	return "User.Restore"
+}
@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserRoleAssignTaskResult struct {
+	app.Result
+}
+
+type UserRoleAssignTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Uid    int64  `json:"uid"`
+	Role   string `json:"role"`
+	Result UserRoleAssignTaskResult
+}
+
+func (task *UserRoleAssignTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserRoleAssignTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserRoleAssignTask) GetClientName() string {
+	return "User.Role.Assign"
+}
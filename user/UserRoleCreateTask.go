@@ -0,0 +1,31 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserRoleCreateTaskResult struct {
+	app.Result
+	Role *UserRole `json:"role,omitempty"`
+}
+
+type UserRoleCreateTask struct {
+	app.Task
+	Tid         int64  `json:"tid"` // 租户, 0 为共享角色
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Permissions string `json:"permissions"` // 逗号分隔, 支持通配 order.*
+	Result      UserRoleCreateTaskResult
+}
+
+func (task *UserRoleCreateTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserRoleCreateTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserRoleCreateTask) GetClientName() string {
+	return "User.Role.Create"
+}
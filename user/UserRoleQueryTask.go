@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserRoleQueryTaskResult struct {
+	app.Result
+	Roles []UserRole `json:"roles,omitempty"`
+}
+
+type UserRoleQueryTask struct {
+	app.Task
+	Tid    int64 `json:"tid"` // 租户
+	Uid    int64 `json:"uid"` // 为 0 时返回全部角色
+	Result UserRoleQueryTaskResult
+}
+
+func (task *UserRoleQueryTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserRoleQueryTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserRoleQueryTask) GetClientName() string {
+	return "User.Role.Query"
+}
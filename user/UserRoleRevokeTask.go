@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserRoleRevokeTaskResult struct {
+	app.Result
+}
+
+type UserRoleRevokeTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Uid    int64  `json:"uid"`
+	Role   string `json:"role"`
+	Result UserRoleRevokeTaskResult
+}
+
+func (task *UserRoleRevokeTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserRoleRevokeTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserRoleRevokeTask) GetClientName() string {
+	return "User.Role.Revoke"
+}
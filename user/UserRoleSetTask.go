@@ -0,0 +1,31 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserRoleSetTaskResult struct {
+	app.Result
+	Role *UserRole `json:"role,omitempty"`
+}
+
+type UserRoleSetTask struct {
+	app.Task
+	Tid         int64  `json:"tid"` // 租户, 0 为共享角色
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Permissions string `json:"permissions"` // 替换全部权限
+	Result      UserRoleSetTaskResult
+}
+
+func (task *UserRoleSetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserRoleSetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserRoleSetTask) GetClientName() string {
+	return "User.Role.Set"
+}
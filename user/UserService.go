@@ -4,11 +4,9 @@ import (
 	"bytes"
 	"database/sql"
 	"fmt"
-	"github.com/kkserver/kk-cache/cache"
 	"github.com/kkserver/kk-lib/kk"
 	"github.com/kkserver/kk-lib/kk/app"
 	"github.com/kkserver/kk-lib/kk/dynamic"
-	"github.com/kkserver/kk-lib/kk/json"
 	"log"
 	"strings"
 	"time"
@@ -27,7 +25,73 @@ type UserService struct {
 	SetOptions *UserSetOptionsTask
 	Query      *UserQueryTask
 
-	Users map[string]interface{} //初始化用户
+	SessionValidate *UserSessionValidateTask
+	SessionRefresh  *UserSessionRefreshTask
+	SessionRevoke   *UserSessionRevokeTask
+	SessionList     *UserSessionListTask
+	Keys            *UserKeysTask
+	TOTPEnroll      *UserTOTPEnrollTask
+	TOTPConfirm     *UserTOTPConfirmTask
+	TOTPDisable     *UserTOTPDisableTask
+	TOTPVerify      *UserTOTPVerifyTask
+	Unlock          *UserUnlockTask
+	SetStatus       *UserSetStatusTask
+	Restore         *UserRestoreTask
+
+	PasswordRequestReset *UserPasswordRequestResetTask
+	PasswordReset        *UserPasswordResetTask
+	SetIdentifier        *UserSetIdentifierTask
+	VerifyRequest        *UserVerifyRequestTask
+	VerifyConfirm        *UserVerifyConfirmTask
+
+	RoleCreate *UserRoleCreateTask
+	RoleSet    *UserRoleSetTask
+	RoleAssign *UserRoleAssignTask
+	RoleRevoke *UserRoleRevokeTask
+	RoleQuery  *UserRoleQueryTask
+	Can        *UserCanTask
+
+	GroupCreate       *UserGroupCreateTask
+	GroupSet          *UserGroupSetTask
+	GroupRemove       *UserGroupRemoveTask
+	GroupGet          *UserGroupGetTask
+	GroupQuery        *UserGroupQueryTask
+	GroupMemberAdd    *UserGroupMemberAddTask
+	GroupMemberRemove *UserGroupMemberRemoveTask
+	GroupMemberQuery  *UserGroupMemberQueryTask
+
+	TenantCreate  *UserTenantCreateTask
+	TenantGet     *UserTenantGetTask
+	TenantQuery   *UserTenantQueryTask
+	TenantMigrate *UserTenantMigrateTask
+
+	AuditQuery *UserAuditQueryTask
+
+	WebhookCreate *UserWebhookCreateTask
+	WebhookSet    *UserWebhookSetTask
+	WebhookRemove *UserWebhookRemoveTask
+	WebhookQuery  *UserWebhookQueryTask
+	WebhookFailed *UserWebhookFailedTask
+	WebhookReplay *UserWebhookReplayTask
+
+	OptionsRevisions *UserOptionsRevisionsTask
+	OptionsAt        *UserOptionsAtTask
+	OptionsRollback  *UserOptionsRollbackTask
+
+	OptionsSchemaSet    *UserOptionsSchemaSetTask
+	OptionsSchemaGet    *UserOptionsSchemaGetTask
+	OptionsSchemaRemove *UserOptionsSchemaRemoveTask
+
+	OptionsList     *UserOptionsListTask
+	OptionsBatchGet *UserOptionsBatchGetTask
+	OptionsBatchSet *UserOptionsBatchSetTask
+	OptionsDelete   *UserOptionsDeleteTask
+
+	CacheInvalidate *UserCacheInvalidateTask
+
+	Users     map[string]interface{} //初始化用户
+	Roles     map[string]interface{} //初始化角色 name=permissions
+	UserRoles map[string]interface{} //初始化用户的角色 name=roles
 }
 
 func (S *UserService) Handle(a app.IApp, task app.ITask) error {
@@ -36,6 +100,13 @@ func (S *UserService) Handle(a app.IApp, task app.ITask) error {
 
 func (S *UserService) HandleInitTask(a *UserApp, task *app.InitTask) error {
 
+	err := a.JWT.Check()
+
+	if err != nil {
+		log.Println("[UserService][HandleInitTask]" + err.Error())
+		return err
+	}
+
 	db, err := a.GetDB()
 
 	if err != nil {
@@ -43,30 +114,63 @@ func (S *UserService) HandleInitTask(a *UserApp, task *app.InitTask) error {
 		return nil
 	}
 
+	if S.Roles != nil {
+		S.initRoles(a, db)
+	}
+
 	v := User{}
 
+	err = EnsureUserUniqueIndexs(a, db)
+
+	if err != nil {
+		log.Println("[UserService][HandleInitTask]" + err.Error())
+		return err
+	}
+
+	StartUserEventDispatcher(a, db)
+
+	if a.LocalCache != nil {
+		a.LocalCache.Subscribe(a)
+	}
+
 	if S.Users != nil {
 
 		for name, password := range S.Users {
 
-			rows, err := kk.DBQuery(db, &a.UserTable, a.DB.Prefix, " WHERE name=?", name)
+			rows, err := kk.DBQuery(db, &a.UserTable, a.DB.Prefix, " WHERE tid=0 AND name=?", name)
 
 			if err == nil {
 
 				if !rows.Next() {
 
 					v.Name = name
-					v.Password = EncodePassword(a, dynamic.StringValue(password, ""))
+					v.Password, err = EncodePassword(a, dynamic.StringValue(password, ""))
+
+					if err != nil {
+						log.Println(err)
+						rows.Close()
+						continue
+					}
+
 					v.Atime = time.Now().Unix()
 					v.Mtime = v.Atime
 					v.Ctime = v.Atime
 
-					_, err = kk.DBInsert(db, &a.UserTable, a.DB.Prefix, &v)
+					r, err := kk.DBInsert(db, &a.UserTable, a.DB.Prefix, &v)
+
+					if err == nil {
+						v.Id, err = r.LastInsertId()
+					}
+
+					if err == nil {
+						err = WriteUserEvent(a, db, v.Tid, v.Id, UserEventCreated, &v)
+					}
 
 					if err != nil {
 						log.Println(err)
 					} else {
 						log.Println("Create User " + name)
+						S.initUserRoles(a, db, &v)
 					}
 				}
 
@@ -100,6 +204,40 @@ func (S *UserService) HandleUserCreateTask(a *UserApp, task *UserCreateTask) err
 
 	var prefix = a.DB.Prefix
 
+	if task.Tid != 0 {
+
+		t, err := GetUserTenant(a, db, task.Tid)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if t == nil {
+			task.Result.Errno = ERROR_USER_NOT_FOUND_TENANT
+			task.Result.Errmsg = "Not found tenant"
+			return nil
+		}
+	}
+
+	var v = User{}
+
+	v.Tid = task.Tid
+	v.Name = task.Name
+
+	if task.Password == "" {
+		v.Password, err = NewPassword(a)
+	} else {
+		v.Password, err = EncodePassword(a, task.Password)
+	}
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
 	tx, err := db.Begin()
 
 	if err != nil {
@@ -110,9 +248,7 @@ func (S *UserService) HandleUserCreateTask(a *UserApp, task *UserCreateTask) err
 
 	func() {
 
-		var v = User{}
-
-		rows, err := kk.DBQuery(db, &a.UserTable, prefix, " WHERE name=?", task.Name)
+		count, err := kk.DBQueryCount(tx, &a.UserTable, prefix, " WHERE tid=? AND name=?", task.Tid, task.Name)
 
 		if err != nil {
 			task.Result.Errno = ERROR_USER
@@ -120,27 +256,31 @@ func (S *UserService) HandleUserCreateTask(a *UserApp, task *UserCreateTask) err
 			return
 		}
 
-		defer rows.Close()
-
-		if rows.Next() {
+		if count > 0 {
 			task.Result.Errno = ERROR_USER_NAME
 			task.Result.Errmsg = "The name already exists"
 			return
 		}
 
-		v.Name = task.Name
-
-		if task.Password == "" {
-			v.Password = NewPassword(a)
-		} else {
-			v.Password = EncodePassword(a, task.Password)
-		}
-
 		v.Atime = time.Now().Unix()
 		v.Mtime = v.Atime
 		v.Ctime = v.Atime
 
-		_, err = kk.DBInsert(db, &a.UserTable, prefix, &v)
+		r, err := kk.DBInsert(tx, &a.UserTable, prefix, &v)
+
+		if err == nil {
+			v.Id, err = r.LastInsertId()
+		}
+
+		if err == nil {
+			err = WriteUserEvent(a, tx, v.Tid, v.Id, UserEventCreated, &v)
+		}
+
+		if IsDuplicateKeyError(err) {
+			task.Result.Errno = ERROR_USER_NAME
+			task.Result.Errmsg = "The name already exists"
+			return
+		}
 
 		if err != nil {
 			task.Result.Errno = ERROR_USER
@@ -148,8 +288,6 @@ func (S *UserService) HandleUserCreateTask(a *UserApp, task *UserCreateTask) err
 			return
 		}
 
-		task.Result.User = &v
-
 	}()
 
 	if task.Result.Errno != 0 {
@@ -159,6 +297,13 @@ func (S *UserService) HandleUserCreateTask(a *UserApp, task *UserCreateTask) err
 
 	err = tx.Commit()
 
+	if IsDuplicateKeyError(err) {
+		tx.Rollback()
+		task.Result.Errno = ERROR_USER_NAME
+		task.Result.Errmsg = "The name already exists"
+		return nil
+	}
+
 	if err != nil {
 		tx.Rollback()
 		task.Result.Errno = ERROR_USER
@@ -166,6 +311,12 @@ func (S *UserService) HandleUserCreateTask(a *UserApp, task *UserCreateTask) err
 		return nil
 	}
 
+	WriteUserAudit(a, db, v.Tid, v.Id, task.Actor, UserAuditActionCreate, UserAuditDiff{}.Set("name", nil, v.Name).Redact("password"), task.Source)
+
+	RemoveUserCache(a, v.Tid, v.Id, v.Name)
+
+	task.Result.User = &v
+
 	return nil
 }
 
@@ -188,8 +339,13 @@ func (S *UserService) HandleUserSetTask(a *UserApp, task *UserSetTask) error {
 	var prefix = a.DB.Prefix
 	var v = User{}
 	var scanner = kk.NewDBScaner(&v)
+	var password = ""
 
-	rows, err := kk.DBQuery(db, &a.UserTable, prefix, " WHERE id=?", task.Uid)
+	if task.Password == "" {
+		password, err = NewPassword(a)
+	} else {
+		password, err = EncodePassword(a, task.Password)
+	}
 
 	if err != nil {
 		task.Result.Errno = ERROR_USER
@@ -197,41 +353,78 @@ func (S *UserService) HandleUserSetTask(a *UserApp, task *UserSetTask) error {
 		return nil
 	}
 
-	defer rows.Close()
+	tx, err := db.Begin()
 
-	if rows.Next() {
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
 
-		err = scanner.Scan(rows)
+	func() {
+
+		rows, err := kk.DBQuery(tx, &a.UserTable, prefix, " WHERE id=? AND tid=? FOR UPDATE", task.Uid, task.Tid)
 
 		if err != nil {
 			task.Result.Errno = ERROR_USER
 			task.Result.Errmsg = err.Error()
-			return nil
+			return
 		}
 
-		if task.Password == "" {
-			v.Password = NewPassword(a)
-		} else {
-			v.Password = EncodePassword(a, task.Password)
+		if !rows.Next() {
+			rows.Close()
+			task.Result.Errno = ERROR_USER_NOT_FOUND
+			task.Result.Errmsg = "Not found user"
+			return
+		}
+
+		err = scanner.Scan(rows)
+
+		rows.Close()
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
 		}
 
+		v.Password = password
 		v.Mtime = time.Now().Unix()
 
-		_, err = kk.DBUpdateWithKeys(db, &a.UserTable, prefix, &v, map[string]bool{"password": true, "mtime": true})
+		_, err = kk.DBUpdateWithKeys(tx, &a.UserTable, prefix, &v, map[string]bool{"password": true, "mtime": true})
+
+		if err == nil {
+			err = WriteUserEvent(a, tx, v.Tid, v.Id, UserEventPasswordChanged, &v)
+		}
 
 		if err != nil {
 			task.Result.Errno = ERROR_USER
 			task.Result.Errmsg = err.Error()
-			return nil
+			return
 		}
 
-		task.Result.User = &v
+	}()
 
-	} else {
-		task.Result.Errno = ERROR_USER_NOT_FOUND
-		task.Result.Errmsg = "Not found user"
+	if task.Result.Errno != 0 {
+		tx.Rollback()
+		return nil
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		tx.Rollback()
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
 	}
 
+	WriteUserAudit(a, db, v.Tid, v.Id, task.Actor, UserAuditActionSet, UserAuditDiff{}.Redact("password"), task.Source)
+
+	RemoveUserCache(a, v.Tid, v.Id, "")
+
+	task.Result.User = &v
+
 	return nil
 }
 
@@ -251,16 +444,7 @@ func (S *UserService) HandleUserTask(a *UserApp, task *UserTask) error {
 		return nil
 	}
 
-	var prefix = a.DB.Prefix
-	var v = User{}
-	var scanner = kk.NewDBScaner(&v)
-	var rows *sql.Rows = nil
-
-	if task.Uid != 0 {
-		rows, err = kk.DBQuery(db, &a.UserTable, prefix, " WHERE id=?", task.Uid)
-	} else {
-		rows, err = kk.DBQuery(db, &a.UserTable, prefix, " WHERE name=?", task.Name)
-	}
+	v, err := LoadUser(a, db, task.Tid, task.Uid, task.Name)
 
 	if err != nil {
 		task.Result.Errno = ERROR_USER
@@ -268,24 +452,21 @@ func (S *UserService) HandleUserTask(a *UserApp, task *UserTask) error {
 		return nil
 	}
 
-	defer rows.Close()
-
-	if rows.Next() {
+	if v != nil {
 
-		err = scanner.Scan(rows)
-
-		if err != nil {
-			task.Result.Errno = ERROR_USER
-			task.Result.Errmsg = err.Error()
+		if v.Status == UserStatusDeleted && !task.Deleted {
+			task.Result.Errno = ERROR_USER_NOT_FOUND
+			task.Result.Errmsg = "Not found user"
 			return nil
 		}
 
-		task.Result.User = &v
+		task.Result.User = v
 
 	} else {
 
 		if task.Autocreate && task.Name != "" {
 			var create = UserCreateTask{}
+			create.Tid = task.Tid
 			create.Name = task.Name
 			app.Handle(a, &create)
 			if create.Result.Errno == 0 && create.Result.User != nil {
@@ -309,22 +490,6 @@ func (S *UserService) HandleUserOptionsTask(a *UserApp, task *UserOptionsTask) e
 		return nil
 	}
 
-	var key = fmt.Sprintf("%s.%d.%s", a.CacheKey, task.Uid, task.Name)
-
-	{
-		var cache = cache.CacheTask{}
-		cache.Key = key
-		var err = app.Handle(a, &cache)
-		if err == nil && cache.Result.Errno == 0 && cache.Result.Value != "" {
-			var vv = UserOptions{}
-			err = json.Decode([]byte(cache.Result.Value), &vv)
-			if err == nil {
-				task.Result.Options = vv.GetOptions()
-				return nil
-			}
-		}
-	}
-
 	var db, err = a.GetDB()
 
 	if err != nil {
@@ -333,12 +498,7 @@ func (S *UserService) HandleUserOptionsTask(a *UserApp, task *UserOptionsTask) e
 		return nil
 	}
 
-	var prefix = a.DB.Prefix
-
-	var v = UserOptions{}
-	var scanner = kk.NewDBScaner(&v)
-
-	rows, err := kk.DBQuery(db, &a.UserOptionsTable, prefix, " WHERE uid=? AND name=?", task.Uid, task.Name)
+	v, err := LoadUserOptions(a, db, task.Tid, task.Uid, task.Name)
 
 	if err != nil {
 		task.Result.Errno = ERROR_USER
@@ -346,28 +506,11 @@ func (S *UserService) HandleUserOptionsTask(a *UserApp, task *UserOptionsTask) e
 		return nil
 	}
 
-	defer rows.Close()
-
-	if rows.Next() {
-
-		err = scanner.Scan(rows)
-
-		if err != nil {
-			task.Result.Errno = ERROR_USER
-			task.Result.Errmsg = err.Error()
-			return nil
-		}
-
-		task.Result.Options = v.GetOptions()
-
-		{
-			var cache = cache.CacheSetTask{}
-			cache.Key = key
-			cache.Expires = a.Expires
-			b, _ := json.Encode(&v)
-			cache.Value = string(b)
-			app.Handle(a, &cache)
-		}
+	if v != nil {
+		task.Result.Options = ApplyUserOptionsDefaults(a, db, task.Name, v.GetOptions())
+		task.Result.Version = v.Version
+	} else {
+		task.Result.Options = ApplyUserOptionsDefaults(a, db, task.Name, nil)
 	}
 
 	return nil
@@ -389,12 +532,7 @@ func (S *UserService) HandleUserSetOptionsTask(a *UserApp, task *UserSetOptionsT
 		return nil
 	}
 
-	var prefix = a.DB.Prefix
-
-	var v = UserOptions{}
-	var scanner = kk.NewDBScaner(&v)
-
-	rows, err := kk.DBQuery(db, &a.UserOptionsTable, prefix, " WHERE uid=? AND name=?", task.Uid, task.Name)
+	u, err := LoadUser(a, db, task.Tid, task.Uid, "")
 
 	if err != nil {
 		task.Result.Errno = ERROR_USER
@@ -402,77 +540,61 @@ func (S *UserService) HandleUserSetOptionsTask(a *UserApp, task *UserSetOptionsT
 		return nil
 	}
 
-	defer rows.Close()
+	if u == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
 
-	if rows.Next() {
+	schema, err := GetUserOptionsSchema(a, db, task.Name)
 
-		err = scanner.Scan(rows)
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
 
-		if err != nil {
-			task.Result.Errno = ERROR_USER
-			task.Result.Errmsg = err.Error()
-			return nil
-		}
+	var v = UserOptions{}
+	var before = UserOptions{}
 
-		if task.Type != v.Type {
-			v.Type = task.Type
-			v.Options = ""
-		}
+	/**
+	 * 首次写入时并发插入会触发唯一索引冲突, 重试后按更新处理
+	 * 最后一次仍需重试时保留 ERROR_USER_OPTIONS_CONFLICT 返回给调用方
+	 */
+	for i := 0; i < 3; i++ {
 
-		v.SetOptions(task.Options)
+		v = UserOptions{}
+		before = UserOptions{}
 
-		_, err = db.Exec(fmt.Sprintf("UPDATE %s%s SET mtime=? WHERE id=?", prefix, a.UserTable.Name), time.Now().Unix(), task.Uid)
+		var retry = setUserOptions(a, db, task, schema, &v, &before)
 
-		if err != nil {
-			task.Result.Errno = ERROR_USER
-			task.Result.Errmsg = err.Error()
-			return nil
+		if !retry || i == 2 {
+			break
 		}
 
-		_, err = kk.DBUpdateWithKeys(db, &a.UserOptionsTable, prefix, &v, map[string]bool{"options": true, "type": true})
+		task.Result.Result = app.Result{}
+	}
 
-		if err != nil {
-			task.Result.Errno = ERROR_USER
-			task.Result.Errmsg = err.Error()
-			return nil
-		}
+	if task.Result.Errno != 0 {
+		return nil
+	}
 
-	} else {
+	task.Result.Version = v.Version
 
-		v.Type = task.Type
-		v.Uid = task.Uid
-		v.Name = task.Name
-		v.SetOptions(task.Options)
+	PruneUserOptionsRevisions(a, db, &v)
 
-		_, err = db.Exec(fmt.Sprintf("UPDATE %s%s SET mtime=? WHERE id=?", prefix, a.UserTable.Name), time.Now().Unix(), task.Uid)
+	WriteUserAudit(a, db, v.Tid, v.Uid, task.Actor, UserAuditActionSetOptions, NewUserOptionsAuditDiff(a, &before, &v), task.Source)
 
-		if err != nil {
-			task.Result.Errno = ERROR_USER
-			task.Result.Errmsg = err.Error()
-			return nil
-		}
+	RemoveUserCache(a, v.Tid, v.Uid, "")
 
-		_, err = kk.DBInsert(db, &a.UserOptionsTable, prefix, &v)
-
-		if err != nil {
-			task.Result.Errno = ERROR_USER
-			task.Result.Errmsg = err.Error()
-			return nil
-		}
-	}
-
-	{
-		var cache = cache.CacheRemoveTask{}
-		cache.Key = fmt.Sprintf("%s.%d.%s", a.CacheKey, v.Uid, v.Name)
-		app.Handle(a, &cache)
-	}
+	RemoveCacheValues(a, OptionsCacheKey(a, v.Tid, v.Uid, v.Name))
 
 	return nil
 }
 
 func (S *UserService) HandleUserLoginTask(a *UserApp, task *UserLoginTask) error {
 
-	if task.Name == "" {
+	if task.Name == "" && task.Email == "" && task.Phone == "" {
 		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
 		task.Result.Errmsg = "Not found name"
 		return nil
@@ -492,11 +614,51 @@ func (S *UserService) HandleUserLoginTask(a *UserApp, task *UserLoginTask) error
 		return nil
 	}
 
+	if task.Addr != "" {
+
+		retryAfter, err := a.Lockout.RetryAfter(a, db, LockoutAddrKey(task.Addr))
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if retryAfter > 0 {
+			task.Result.Errno = ERROR_USER_LOCKED
+			task.Result.Errmsg = fmt.Sprintf("Too many failures, retry after %d seconds", retryAfter)
+			task.Result.RetryAfter = retryAfter
+			return nil
+		}
+	}
+
 	var prefix = a.DB.Prefix
 	var v = User{}
 	var scanner = kk.NewDBScaner(&v)
 
-	rows, err := kk.DBQuery(db, &a.UserTable, prefix, " WHERE name=?", task.Name)
+	var rows *sql.Rows = nil
+
+	if task.Name != "" {
+		rows, err = kk.DBQuery(db, &a.UserTable, prefix, " WHERE tid=? AND name=?", task.Tid, task.Name)
+	} else if task.Email != "" {
+		var email string
+		email, err = NormalizeUserIdentifier(UserIdentifierEmail, task.Email)
+		if err != nil {
+			task.Result.Errno = ERROR_USER_IDENTIFIER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+		rows, err = kk.DBQuery(db, &a.UserTable, prefix, " WHERE tid=? AND email=? AND emailverified=1", task.Tid, email)
+	} else {
+		var phone string
+		phone, err = NormalizeUserIdentifier(UserIdentifierPhone, task.Phone)
+		if err != nil {
+			task.Result.Errno = ERROR_USER_IDENTIFIER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+		rows, err = kk.DBQuery(db, &a.UserTable, prefix, " WHERE tid=? AND phone=? AND phoneverified=1", task.Tid, phone)
+	}
 
 	if err != nil {
 		task.Result.Errno = ERROR_USER
@@ -516,15 +678,60 @@ func (S *UserService) HandleUserLoginTask(a *UserApp, task *UserLoginTask) error
 			return nil
 		}
 
-		if EncodePassword(a, task.Password) != v.Password {
+		retryAfter, err := a.Lockout.RetryAfter(a, db, LockoutUidKey(v.Id))
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if retryAfter > 0 {
+			task.Result.Errno = ERROR_USER_LOCKED
+			task.Result.Errmsg = fmt.Sprintf("The account is locked, retry after %d seconds", retryAfter)
+			task.Result.RetryAfter = retryAfter
+			return nil
+		}
+
+		ok, rehash := VerifyPassword(a, task.Password, v.Password)
+
+		if !ok {
+
+			retryAfter, err = a.Lockout.FailPassword(a, db, v.Id, task.Addr)
+
+			if err != nil {
+				log.Println("[UserService][HandleUserLoginTask]" + err.Error())
+			}
+
+			WriteUserAudit(a, db, v.Tid, v.Id, v.Name, UserAuditActionLoginFailure, nil, task.Addr)
+
+			if retryAfter > 0 {
+				task.Result.Errno = ERROR_USER_LOCKED
+				task.Result.Errmsg = fmt.Sprintf("The account is locked, retry after %d seconds", retryAfter)
+				task.Result.RetryAfter = retryAfter
+				return nil
+			}
+
 			task.Result.Errno = ERROR_USER_PASSWORD
 			task.Result.Errmsg = "user password fail"
 			return nil
 		}
 
-		v.Atime = time.Now().Unix()
+		err = a.Lockout.ClearPassword(a, db, v.Id, task.Addr)
+
+		if err != nil {
+			log.Println("[UserService][HandleUserLoginTask]" + err.Error())
+		}
+
+		if !CheckUserStatus(&v, &task.Result.Result) {
+			return nil
+		}
+
+		if rehash {
+			RehashPassword(a, db, &v, task.Password)
+		}
 
-		_, err = kk.DBUpdateWithKeys(db, &a.UserTable, prefix, &v, map[string]bool{"atime": true})
+		enabled, err := IsUserTOTPEnabled(a, db, v.Id)
 
 		if err != nil {
 			task.Result.Errno = ERROR_USER
@@ -532,9 +739,41 @@ func (S *UserService) HandleUserLoginTask(a *UserApp, task *UserLoginTask) error
 			return nil
 		}
 
-		task.Result.User = &v
+		if enabled {
+
+			challenge, err := NewUserChallenge(a, db, v.Id, UserChallengeTypeLogin, task.Options(), 0)
+
+			if err != nil {
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+				return nil
+			}
+
+			task.Result.Errno = ERROR_USER_SECOND_FACTOR
+			task.Result.Errmsg = "The second factor is required"
+			task.Result.Challenge = challenge
+			return nil
+		}
+
+		CompleteUserLogin(a, db, &v, task.Options(), &task.Result)
+
+		if task.Result.Errno == 0 {
+			WriteUserAudit(a, db, v.Tid, v.Id, v.Name, UserAuditActionLogin, nil, task.Addr)
+		}
+
+		return nil
 
 	} else {
+
+		if task.Addr != "" {
+			_, err = a.Lockout.FailAddr(a, db, task.Addr)
+			if err != nil {
+				log.Println("[UserService][HandleUserLoginTask]" + err.Error())
+			}
+		}
+
+		WriteUserAudit(a, db, task.Tid, 0, task.Identifier(), UserAuditActionLoginFailure, nil, task.Addr)
+
 		task.Result.Errno = ERROR_USER_NOT_FOUND
 		task.Result.Errmsg = "Not found user"
 	}
@@ -542,6 +781,54 @@ func (S *UserService) HandleUserLoginTask(a *UserApp, task *UserLoginTask) error
 	return nil
 }
 
+/**
+ * 登录成功 (含二次验证) 后更新 atime, 按需创建会话和 JWT
+ */
+func CompleteUserLogin(a *UserApp, db *sql.DB, v *User, options *UserLoginOptions, result *UserLoginTaskResult) {
+
+	v.Atime = time.Now().Unix()
+
+	_, err := kk.DBUpdateWithKeys(db, &a.UserTable, a.DB.Prefix, v, map[string]bool{"atime": true})
+
+	if err != nil {
+		result.Errno = ERROR_USER
+		result.Errmsg = err.Error()
+		return
+	}
+
+	RemoveUserCache(a, v.Tid, v.Id, "")
+
+	if options.Session {
+
+		session, token, err := NewUserSession(a, db, v.Tid, v.Id, options.Device, options.Addr, options.Expires)
+
+		if err != nil {
+			result.Errno = ERROR_USER
+			result.Errmsg = err.Error()
+			return
+		}
+
+		result.Session = session
+		result.Token = token
+	}
+
+	if options.Jwt {
+
+		token, expires, err := a.JWT.Sign(v)
+
+		if err != nil {
+			result.Errno = ERROR_USER
+			result.Errmsg = err.Error()
+			return
+		}
+
+		result.AccessToken = token
+		result.ExpiresIn = expires
+	}
+
+	result.User = v
+}
+
 func (S *UserService) HandleUserPasswordTask(a *UserApp, task *UserPasswordTask) error {
 
 	if task.Uid == 0 {
@@ -562,7 +849,7 @@ func (S *UserService) HandleUserPasswordTask(a *UserApp, task *UserPasswordTask)
 	var v = User{}
 	var scanner = kk.NewDBScaner(&v)
 
-	rows, err := kk.DBQuery(db, &a.UserTable, prefix, " WHERE id=?", task.Uid)
+	rows, err := kk.DBQuery(db, &a.UserTable, prefix, " WHERE id=? AND tid=?", task.Uid, task.Tid)
 
 	if err != nil {
 		task.Result.Errno = ERROR_USER
@@ -582,12 +869,59 @@ func (S *UserService) HandleUserPasswordTask(a *UserApp, task *UserPasswordTask)
 			return nil
 		}
 
-		if EncodePassword(a, task.Password) != v.Password {
+		var keys = []string{LockoutUidKey(v.Id)}
+
+		if task.Addr != "" {
+			keys = append(keys, LockoutAddrKey(task.Addr))
+		}
+
+		retryAfter, err := a.Lockout.RetryAfter(a, db, keys...)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if retryAfter > 0 {
+			task.Result.Errno = ERROR_USER_LOCKED
+			task.Result.Errmsg = fmt.Sprintf("The account is locked, retry after %d seconds", retryAfter)
+			task.Result.RetryAfter = retryAfter
+			return nil
+		}
+
+		ok, rehash := VerifyPassword(a, task.Password, v.Password)
+
+		if !ok {
+
+			retryAfter, err = a.Lockout.FailPassword(a, db, v.Id, task.Addr)
+
+			if err != nil {
+				log.Println("[UserService][HandleUserPasswordTask]" + err.Error())
+			}
+
+			if retryAfter > 0 {
+				task.Result.Errno = ERROR_USER_LOCKED
+				task.Result.Errmsg = fmt.Sprintf("The account is locked, retry after %d seconds", retryAfter)
+				task.Result.RetryAfter = retryAfter
+				return nil
+			}
+
 			task.Result.Errno = ERROR_USER_PASSWORD
 			task.Result.Errmsg = "user password fail"
 			return nil
 		}
 
+		err = a.Lockout.ClearPassword(a, db, v.Id, task.Addr)
+
+		if err != nil {
+			log.Println("[UserService][HandleUserPasswordTask]" + err.Error())
+		}
+
+		if rehash {
+			RehashPassword(a, db, &v, task.Password)
+		}
+
 		task.Result.User = &v
 
 	} else {
@@ -615,7 +949,9 @@ func (S *UserService) HandleUserQueryTask(a *UserApp, task *UserQueryTask) error
 
 	args := []interface{}{}
 
-	sql.WriteString(" WHERE 1")
+	sql.WriteString(" WHERE tid=?")
+
+	args = append(args, task.Tid)
 
 	if task.Uid != 0 {
 		sql.WriteString(" AND id=?")
@@ -627,6 +963,16 @@ func (S *UserService) HandleUserQueryTask(a *UserApp, task *UserQueryTask) error
 		args = append(args, task.Name)
 	}
 
+	if task.Prefix != "" {
+		sql.WriteString(" AND name LIKE ?")
+		args = append(args, EscapeLike(task.Prefix)+"%")
+	}
+
+	if task.Keyword != "" {
+		sql.WriteString(" AND name LIKE ?")
+		args = append(args, "%"+EscapeLike(task.Keyword)+"%")
+	}
+
 	if task.Names != "" {
 
 		sql.WriteString(" AND name IN (")
@@ -641,16 +987,106 @@ func (S *UserService) HandleUserQueryTask(a *UserApp, task *UserQueryTask) error
 
 	}
 
-	if task.OrderBy == "asc" {
-		sql.WriteString(" ORDER BY id ASC")
-	} else {
-		sql.WriteString(" ORDER BY id DESC")
+	if task.Gid != 0 {
+		sql.WriteString(fmt.Sprintf(" AND id IN (SELECT uid FROM %s%s WHERE gid=?)", prefix, a.UserGroupMemberTable.Name))
+		args = append(args, task.Gid)
+	}
+
+	if task.Email != "" {
+
+		email, err := NormalizeUserIdentifier(UserIdentifierEmail, task.Email)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER_IDENTIFIER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		sql.WriteString(" AND email=?")
+		args = append(args, email)
+	}
+
+	if task.Phone != "" {
+
+		phone, err := NormalizeUserIdentifier(UserIdentifierPhone, task.Phone)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER_IDENTIFIER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		sql.WriteString(" AND phone=?")
+		args = append(args, phone)
+	}
+
+	if task.EmailVerified == "1" {
+		sql.WriteString(" AND email IS NOT NULL AND emailverified=1")
+	} else if task.EmailVerified == "0" {
+		sql.WriteString(" AND email IS NOT NULL AND emailverified=0")
+	}
+
+	if task.PhoneVerified == "1" {
+		sql.WriteString(" AND phone IS NOT NULL AND phoneverified=1")
+	} else if task.PhoneVerified == "0" {
+		sql.WriteString(" AND phone IS NOT NULL AND phoneverified=0")
+	}
+
+	args = writeUserQueryRange(sql, args, "ctime", task.StartCtime, task.EndCtime)
+	args = writeUserQueryRange(sql, args, "mtime", task.StartMtime, task.EndMtime)
+	args = writeUserQueryRange(sql, args, "atime", task.StartAtime, task.EndAtime)
+
+	args, err = WriteUserStatusFilter(sql, args, "status", task.Status, task.ExcludeStatus)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER_STATUS
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	column, asc, err := ParseUserQuerySort(task.SortBy, task.OrderBy)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER_QUERY_INVALID
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	fields, err := ParseUserQueryFields(task.Fields)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER_QUERY_INVALID
+		task.Result.Errmsg = err.Error()
+		return nil
 	}
 
+	var cursor = task.Cursor || task.After != ""
+	var where = sql.String()
+	var whereArgs = args
+
+	if task.After != "" {
+
+		after, err := DecodeUserQueryCursor(task.After)
+
+		if err == nil && (after.SortBy != column || after.Asc != asc) {
+			err = fmt.Errorf("The cursor does not match sortBy and orderBy")
+		}
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER_QUERY_INVALID
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		args = writeUserQueryCursor(sql, args, after)
+	}
+
+	writeUserQueryOrder(sql, column, asc)
+
 	var pageIndex = task.PageIndex
 	var pageSize = task.PageSize
 
-	if pageIndex < 1 {
+	if pageIndex < 1 || cursor {
 		pageIndex = 1
 	}
 
@@ -659,29 +1095,24 @@ func (S *UserService) HandleUserQueryTask(a *UserApp, task *UserQueryTask) error
 	}
 
 	if task.Counter {
-		var counter = UserQueryCounter{}
-		counter.PageIndex = pageIndex
-		counter.PageSize = pageSize
-		counter.RowCount, err = kk.DBQueryCount(db, &a.UserTable, prefix, sql.String(), args...)
+		task.Result.Counter, err = NewUserQueryCounter(db, &a.UserTable, prefix, pageIndex, pageSize, where, whereArgs...)
 		if err != nil {
 			task.Result.Errno = ERROR_USER
 			task.Result.Errmsg = err.Error()
 			return nil
 		}
-		if counter.RowCount%pageSize == 0 {
-			counter.PageCount = counter.RowCount / pageSize
-		} else {
-			counter.PageCount = counter.RowCount/pageSize + 1
-		}
-		task.Result.Counter = &counter
 	}
 
-	sql.WriteString(fmt.Sprintf(" LIMIT %d,%d", (pageIndex-1)*pageSize, pageSize))
+	if cursor {
+		sql.WriteString(fmt.Sprintf(" LIMIT %d", pageSize+1))
+	} else {
+		sql.WriteString(fmt.Sprintf(" LIMIT %d,%d", (pageIndex-1)*pageSize, pageSize))
+	}
 
 	var v = User{}
 	var scanner = kk.NewDBScaner(&v)
 
-	rows, err := kk.DBQuery(db, &a.UserTable, prefix, sql.String(), args...)
+	rows, err := QueryUserRows(a, db, fields, column, sql.String(), args...)
 
 	if err != nil {
 		task.Result.Errno = ERROR_USER
@@ -691,8 +1122,15 @@ func (S *UserService) HandleUserQueryTask(a *UserApp, task *UserQueryTask) error
 
 	defer rows.Close()
 
+	var n = 0
+
 	for rows.Next() {
 
+		if cursor && n == pageSize {
+			task.Result.Next = EncodeUserQueryCursor(NewUserQueryCursor(&v, column, asc))
+			break
+		}
+
 		err = scanner.Scan(rows)
 
 		if err != nil {
@@ -701,10 +1139,22 @@ func (S *UserService) HandleUserQueryTask(a *UserApp, task *UserQueryTask) error
 			return nil
 		}
 
-		users = append(users, v)
+		n = n + 1
+
+		if len(fields) > 0 {
+			task.Result.Items = append(task.Result.Items, ProjectUser(&v, fields))
+		} else {
+			users = append(users, v)
+		}
 	}
 
-	task.Result.Users = users
+	if len(fields) > 0 {
+		if task.Result.Items == nil {
+			task.Result.Items = []map[string]interface{}{}
+		}
+	} else {
+		task.Result.Users = users
+	}
 
 	return nil
 }
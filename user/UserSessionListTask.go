@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserSessionListTaskResult struct {
+	app.Result
+	Sessions []UserSession `json:"sessions,omitempty"`
+}
+
+type UserSessionListTask struct {
+	app.Task
+	Tid    int64 `json:"tid"` // 租户
+	Uid    int64 `json:"uid"`
+	Result UserSessionListTaskResult
+}
+
+func (task *UserSessionListTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserSessionListTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserSessionListTask) GetClientName() string {
+	return "User.Session.List"
+}
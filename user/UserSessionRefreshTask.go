@@ -0,0 +1,30 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserSessionRefreshTaskResult struct {
+	app.Result
+	Session *UserSession `json:"session,omitempty"`
+}
+
+type UserSessionRefreshTask struct {
+	app.Task
+	Tid     int64  `json:"tid"` // 租户
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"`
+	Result  UserSessionRefreshTaskResult
+}
+
+func (task *UserSessionRefreshTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserSessionRefreshTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserSessionRefreshTask) GetClientName() string {
+	return "User.Session.Refresh"
+}
@@ -0,0 +1,31 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserSessionRevokeTaskResult struct {
+	app.Result
+	Count int64 `json:"count"`
+}
+
+type UserSessionRevokeTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Token  string `json:"token"`
+	Uid    int64  `json:"uid"`
+	Id     int64  `json:"id"` // 与 uid 一起使用, 为 0 时注销 uid 的全部会话
+	Result UserSessionRevokeTaskResult
+}
+
+func (task *UserSessionRevokeTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserSessionRevokeTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserSessionRevokeTask) GetClientName() string {
+	return "User.Session.Revoke"
+}
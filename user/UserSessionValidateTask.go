@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserSessionValidateTaskResult struct {
+	app.Result
+	Session *UserSession `json:"session,omitempty"`
+}
+
+type UserSessionValidateTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Token  string `json:"token"`
+	Result UserSessionValidateTaskResult
+}
+
+func (task *UserSessionValidateTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserSessionValidateTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserSessionValidateTask) GetClientName() string {
+	return "User.Session.Validate"
+}
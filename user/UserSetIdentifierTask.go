@@ -0,0 +1,31 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserSetIdentifierTaskResult struct {
+	app.Result
+	User *User `json:"user,omitempty"`
+}
+
+type UserSetIdentifierTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Uid    int64  `json:"uid"`
+	Type   string `json:"type"`  // email, phone
+	Value  string `json:"value"` // 为空时清除
+	Result UserSetIdentifierTaskResult
+}
+
+func (task *UserSetIdentifierTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserSetIdentifierTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserSetIdentifierTask) GetClientName() string {
+	return "User.SetIdentifier"
+}
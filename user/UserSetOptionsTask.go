@@ -6,15 +6,22 @@ import (
 
 type UserSetOptionsTaskResult struct {
 	app.Result
+	Version int64                    `json:"version"`          // 写入后的版本, 冲突时为当前版本
+	Errors  []UserOptionsSchemaError `json:"errors,omitempty"` // 不符合 Schema 时的字段错误
 }
 
 type UserSetOptionsTask struct {
 	app.Task
-	Uid     int64       `json:"uid"`
-	Name    string      `json:"name"`
-	Type    string      `json:"type"`
-	Options interface{} `json:"options"`
-	Result  UserSetOptionsTaskResult
+	Tid       int64       `json:"tid"` // 租户
+	Uid       int64       `json:"uid"`
+	Name      string      `json:"name"`
+	Type      string      `json:"type"`
+	Options   interface{} `json:"options"`
+	Mode      string      `json:"mode"`      // merge (默认), merge-patch (RFC 7386), json-patch (RFC 6902), replace
+	IfVersion int64       `json:"ifVersion"` // > 0 时仅在当前版本一致时写入, 否则返回 ERROR_USER_OPTIONS_CONFLICT
+	Actor     string      `json:"actor"`     // 操作者, 记录审计日志
+	Source    string      `json:"source"`    // 来源
+	Result    UserSetOptionsTaskResult
 }
 
 func (task *UserSetOptionsTask) GetResult() interface{} {
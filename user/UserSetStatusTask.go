@@ -0,0 +1,33 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserSetStatusTaskResult struct {
+	app.Result
+	User *User `json:"user,omitempty"`
+}
+
+type UserSetStatusTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Uid    int64  `json:"uid"`
+	Status int    `json:"status"` // UserStatusActive, UserStatusDisabled, UserStatusLocked, UserStatusDeleted
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`  // 操作者, 记录审计日志
+	Source string `json:"source"` // 来源
+	Result UserSetStatusTaskResult
+}
+
+func (task *UserSetStatusTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserSetStatusTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserSetStatusTask) GetClientName() string {
+	return "User.SetStatus"
+}
@@ -11,8 +11,11 @@ type UserSetTaskResult struct {
 
 type UserSetTask struct {
 	app.Task
+	Tid      int64  `json:"tid"` // 租户
 	Uid      int64  `json:"uid"`
 	Password string `json:"password"`
+	Actor    string `json:"actor"`  // 操作者, 记录审计日志
+	Source   string `json:"source"` // 来源
 	Result   UserSetTaskResult
 }
 
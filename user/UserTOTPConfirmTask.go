@@ -0,0 +1,30 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserTOTPConfirmTaskResult struct {
+	app.Result
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+type UserTOTPConfirmTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Uid    int64  `json:"uid"`
+	Code   string `json:"code"`
+	Result UserTOTPConfirmTaskResult
+}
+
+func (task *UserTOTPConfirmTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserTOTPConfirmTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserTOTPConfirmTask) GetClientName() string {
+	return "User.TOTP.Confirm"
+}
@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserTOTPDisableTaskResult struct {
+	app.Result
+}
+
+type UserTOTPDisableTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Uid    int64  `json:"uid"`
+	Code   string `json:"code"` // TOTP 或恢复码
+	Result UserTOTPDisableTaskResult
+}
+
+func (task *UserTOTPDisableTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserTOTPDisableTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserTOTPDisableTask) GetClientName() string {
+	return "User.TOTP.Disable"
+}
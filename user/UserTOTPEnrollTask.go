@@ -0,0 +1,30 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserTOTPEnrollTaskResult struct {
+	app.Result
+	Secret string `json:"secret,omitempty"`
+	Uri    string `json:"uri,omitempty"` // otpauth://
+}
+
+type UserTOTPEnrollTask struct {
+	app.Task
+	Tid    int64 `json:"tid"` // 租户
+	Uid    int64 `json:"uid"`
+	Result UserTOTPEnrollTaskResult
+}
+
+func (task *UserTOTPEnrollTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserTOTPEnrollTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserTOTPEnrollTask) GetClientName() string {
+	return "User.TOTP.Enroll"
+}
@@ -0,0 +1,28 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+/**
+ * 完成二次验证登录, 结果与 User.Login 相同
+ */
+type UserTOTPVerifyTask struct {
+	app.Task
+	Tid       int64  `json:"tid"` // 租户
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"` // TOTP 或恢复码
+	Result    UserLoginTaskResult
+}
+
+func (task *UserTOTPVerifyTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserTOTPVerifyTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserTOTPVerifyTask) GetClientName() string {
+	return "User.TOTP.Verify"
+}
@@ -11,9 +11,11 @@ type UserTaskResult struct {
 
 type UserTask struct {
 	app.Task
+	Tid        int64  `json:"tid"` // 租户
 	Uid        int64  `json:"uid"`
 	Name       string `json:"name"`
 	Autocreate bool   `json:"autocreate"`
+	Deleted    bool   `json:"deleted"` // 包含已删除的用户
 	Result     UserTaskResult
 }
 
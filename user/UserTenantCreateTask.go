@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserTenantCreateTaskResult struct {
+	app.Result
+	Tenant *UserTenant `json:"tenant,omitempty"`
+}
+
+type UserTenantCreateTask struct {
+	app.Task
+	Name   string `json:"name"`
+	Title  string `json:"title"`
+	Result UserTenantCreateTaskResult
+}
+
+func (task *UserTenantCreateTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserTenantCreateTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserTenantCreateTask) GetClientName() string {
+	return "User.Tenant.Create"
+}
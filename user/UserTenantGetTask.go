@@ -0,0 +1,28 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserTenantGetTaskResult struct {
+	app.Result
+	Tenant *UserTenant `json:"tenant,omitempty"`
+}
+
+type UserTenantGetTask struct {
+	app.Task
+	Id     int64 `json:"id"`
+	Result UserTenantGetTaskResult
+}
+
+func (task *UserTenantGetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserTenantGetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserTenantGetTask) GetClientName() string {
+	return "User.Tenant.Get"
+}
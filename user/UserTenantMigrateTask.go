@@ -0,0 +1,30 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserTenantMigrateTaskResult struct {
+	app.Result
+	Users   int64 `json:"users"`   // 迁移的用户数
+	Options int64 `json:"options"` // 迁移的配置数
+}
+
+type UserTenantMigrateTask struct {
+	app.Task
+	From   int64 `json:"from"` // 源租户, 默认 0
+	To     int64 `json:"to"`   // 目标租户
+	Result UserTenantMigrateTaskResult
+}
+
+func (task *UserTenantMigrateTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserTenantMigrateTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserTenantMigrateTask) GetClientName() string {
+	return "User.Tenant.Migrate"
+}
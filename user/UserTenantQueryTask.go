@@ -0,0 +1,33 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserTenantQueryTaskResult struct {
+	app.Result
+	Counter *UserQueryCounter `json:"counter,omitempty"`
+	Tenants []UserTenant      `json:"tenants,omitempty"`
+}
+
+type UserTenantQueryTask struct {
+	app.Task
+	Name      string `json:"name"`
+	OrderBy   string `json:"orderBy"` // desc, asc
+	PageIndex int    `json:"p"`
+	PageSize  int    `json:"size"`
+	Counter   bool   `json:"counter"`
+	Result    UserTenantQueryTaskResult
+}
+
+func (task *UserTenantQueryTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserTenantQueryTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserTenantQueryTask) GetClientName() string {
+	return "User.Tenant.Query"
+}
@@ -0,0 +1,29 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserUnlockTaskResult struct {
+	app.Result
+}
+
+type UserUnlockTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Uid    int64  `json:"uid"`
+	Addr   string `json:"addr"`
+	Result UserUnlockTaskResult
+}
+
+func (task *UserUnlockTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserUnlockTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserUnlockTask) GetClientName() string {
+	return "User.Unlock"
+}
@@ -0,0 +1,32 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserVerifyConfirmTaskResult struct {
+	app.Result
+	User *User `json:"user,omitempty"`
+}
+
+type UserVerifyConfirmTask struct {
+	app.Task
+	Tid    int64  `json:"tid"`   // 租户
+	Token  string `json:"token"` // 链接中的 token
+	Uid    int64  `json:"uid"`   // 或 uid + type + code
+	Type   string `json:"type"`
+	Code   string `json:"code"`
+	Result UserVerifyConfirmTaskResult
+}
+
+func (task *UserVerifyConfirmTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserVerifyConfirmTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserVerifyConfirmTask) GetClientName() string {
+	return "User.Verify.Confirm"
+}
@@ -0,0 +1,30 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserVerifyRequestTaskResult struct {
+	app.Result
+}
+
+type UserVerifyRequestTask struct {
+	app.Task
+	Tid     int64  `json:"tid"` // 租户
+	Uid     int64  `json:"uid"`
+	Type    string `json:"type"` // email, phone
+	Expires int64  `json:"expires"`
+	Result  UserVerifyRequestTaskResult
+}
+
+func (task *UserVerifyRequestTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserVerifyRequestTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserVerifyRequestTask) GetClientName() string {
+	return "User.Verify.Request"
+}
@@ -0,0 +1,32 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserWebhookCreateTaskResult struct {
+	app.Result
+	Webhook *UserWebhook `json:"webhook,omitempty"`
+	Secret  string       `json:"secret,omitempty"` // 仅创建时返回
+}
+
+type UserWebhookCreateTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Url    string `json:"url"`
+	Secret string `json:"secret"` // 为空时自动生成
+	Events string `json:"events"` // 逗号分隔, * 为全部
+	Result UserWebhookCreateTaskResult
+}
+
+func (task *UserWebhookCreateTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserWebhookCreateTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserWebhookCreateTask) GetClientName() string {
+	return "User.Webhook.Create"
+}
@@ -0,0 +1,34 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserWebhookFailedTaskResult struct {
+	app.Result
+	Counter    *UserQueryCounter       `json:"counter,omitempty"`
+	Deliveries []UserWebhookDeadLetter `json:"deliveries,omitempty"`
+}
+
+type UserWebhookFailedTask struct {
+	app.Task
+	Tid       int64  `json:"tid"` // 租户
+	Wid       int64  `json:"wid"`
+	Name      string `json:"name"` // 事件名
+	PageIndex int    `json:"p"`
+	PageSize  int    `json:"size"`
+	Counter   bool   `json:"counter"`
+	Result    UserWebhookFailedTaskResult
+}
+
+func (task *UserWebhookFailedTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserWebhookFailedTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserWebhookFailedTask) GetClientName() string {
+	return "User.Webhook.Failed"
+}
@@ -0,0 +1,28 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserWebhookQueryTaskResult struct {
+	app.Result
+	Webhooks []UserWebhook `json:"webhooks,omitempty"`
+}
+
+type UserWebhookQueryTask struct {
+	app.Task
+	Tid    int64 `json:"tid"` // 租户
+	Result UserWebhookQueryTaskResult
+}
+
+func (task *UserWebhookQueryTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserWebhookQueryTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserWebhookQueryTask) GetClientName() string {
+	return "User.Webhook.Query"
+}
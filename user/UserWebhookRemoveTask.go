@@ -0,0 +1,28 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserWebhookRemoveTaskResult struct {
+	app.Result
+}
+
+type UserWebhookRemoveTask struct {
+	app.Task
+	Tid    int64 `json:"tid"` // 租户
+	Id     int64 `json:"id"`
+	Result UserWebhookRemoveTaskResult
+}
+
+func (task *UserWebhookRemoveTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserWebhookRemoveTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserWebhookRemoveTask) GetClientName() string {
+	return "User.Webhook.Remove"
+}
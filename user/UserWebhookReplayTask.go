@@ -0,0 +1,30 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserWebhookReplayTaskResult struct {
+	app.Result
+	Count int `json:"count"` // 重新投递数
+}
+
+type UserWebhookReplayTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Wid    int64  `json:"wid"`
+	Ids    string `json:"ids"` // 逗号分隔的死信 id
+	Result UserWebhookReplayTaskResult
+}
+
+func (task *UserWebhookReplayTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserWebhookReplayTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserWebhookReplayTask) GetClientName() string {
+	return "User.Webhook.Replay"
+}
@@ -0,0 +1,33 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/app"
+)
+
+type UserWebhookSetTaskResult struct {
+	app.Result
+	Webhook *UserWebhook `json:"webhook,omitempty"`
+}
+
+type UserWebhookSetTask struct {
+	app.Task
+	Tid    int64  `json:"tid"` // 租户
+	Id     int64  `json:"id"`
+	Url    string `json:"url"`
+	Secret string `json:"secret"`
+	Events string `json:"events"`
+	Status string `json:"status"` // 0 启用, 1 停用
+	Result UserWebhookSetTaskResult
+}
+
+func (task *UserWebhookSetTask) GetResult() interface{} {
+	return &task.Result
+}
+
+func (task *UserWebhookSetTask) GetInhertType() string {
+	return "user"
+}
+
+func (task *UserWebhookSetTask) GetClientName() string {
+	return "User.Webhook.Set"
+}
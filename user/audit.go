@@ -0,0 +1,316 @@
+package user
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/json"
+	"log"
+	"strings"
+	"time"
+)
+
+const UserAuditActionCreate = "user.create"
+const UserAuditActionSet = "user.set"
+const UserAuditActionSetOptions = "options.set"
+const UserAuditActionDeleteOptions = "options.delete"
+const UserAuditActionSetStatus = "status.set"
+const UserAuditActionPasswordReset = "password.reset"
+const UserAuditActionLogin = "login.success"
+const UserAuditActionLoginFailure = "login.failure"
+
+const UserAuditRedacted = "[REDACTED]"
+
+/**
+ * 审计日志, 只追加不修改
+ * Diff 为 JSON {"字段": {"before": .., "after": ..}}
+ */
+type UserAudit struct {
+	Id     int64  `json:"id"`
+	Tid    int64  `json:"tid"`
+	Uid    int64  `json:"uid"`    // 目标用户
+	Actor  string `json:"actor"`  // 操作者
+	Action string `json:"action"` // UserAuditAction*
+	Diff   string `json:"diff,omitempty"`
+	Source string `json:"source,omitempty"` // 来源, 如客户端地址
+	Ctime  int64  `json:"ctime"`
+}
+
+type UserAuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type UserAuditDiff map[string]UserAuditChange
+
+func (D UserAuditDiff) Set(name string, before interface{}, after interface{}) UserAuditDiff {
+	D[name] = UserAuditChange{Before: before, After: after}
+	return D
+}
+
+/**
+ * 只记录发生变化, 不记录内容
+ */
+func (D UserAuditDiff) Redact(name string) UserAuditDiff {
+	D[name] = UserAuditChange{Before: UserAuditRedacted, After: UserAuditRedacted}
+	return D
+}
+
+/**
+ * 需要脱敏的配置键, 默认 password,secret,token
+ */
+func IsUserAuditRedactKey(a *UserApp, key string) bool {
+
+	var keys = a.AuditRedact
+
+	if keys == "" {
+		keys = "password,secret,token"
+	}
+
+	key = strings.ToLower(key)
+
+	for _, k := range strings.Split(keys, ",") {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k != "" && strings.Contains(key, k) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * 脱敏嵌套的对象和数组, path 为 配置名.键.子键, 命中 IsUserAuditRedactKey 的值以 UserAuditRedacted 代替
+ */
+func redactUserAuditValue(a *UserApp, path string, value interface{}) interface{} {
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		var object = map[string]interface{}{}
+		for key, item := range v {
+			if IsUserAuditRedactKey(a, path+"."+key) {
+				object[key] = UserAuditRedacted
+			} else {
+				object[key] = redactUserAuditValue(a, path+"."+key, item)
+			}
+		}
+		return object
+	case []interface{}:
+		var items = []interface{}{}
+		for _, item := range v {
+			items = append(items, redactUserAuditValue(a, path, item))
+		}
+		return items
+	}
+
+	return value
+}
+
+/**
+ * 配置变更前后的差异, json 配置按顶层键比较, 字段名为 配置名.键, 嵌套的值同样脱敏
+ */
+func NewUserOptionsAuditDiff(a *UserApp, before *UserOptions, after *UserOptions) UserAuditDiff {
+
+	var diff = UserAuditDiff{}
+
+	if before.Type != after.Type {
+		diff.Set("type", before.Type, after.Type)
+	}
+
+	b, bok := before.GetOptions().(map[string]interface{})
+	v, vok := after.GetOptions().(map[string]interface{})
+
+	if before.Options == "" {
+		b, bok = map[string]interface{}{}, true
+	}
+
+	if bok && vok {
+
+		var equal = func(x interface{}, y interface{}) bool {
+			xb, _ := json.Encode(x)
+			yb, _ := json.Encode(y)
+			return bytes.Equal(xb, yb)
+		}
+
+		for key, value := range v {
+			if old, ok := b[key]; !ok || !equal(old, value) {
+				if IsUserAuditRedactKey(a, after.Name+"."+key) {
+					diff.Redact(after.Name + "." + key)
+				} else {
+					diff.Set(after.Name+"."+key, redactUserAuditValue(a, after.Name+"."+key, b[key]), redactUserAuditValue(a, after.Name+"."+key, value))
+				}
+			}
+		}
+
+		for key, value := range b {
+			if _, ok := v[key]; !ok {
+				if IsUserAuditRedactKey(a, after.Name+"."+key) {
+					diff.Redact(after.Name + "." + key)
+				} else {
+					diff.Set(after.Name+"."+key, redactUserAuditValue(a, after.Name+"."+key, value), nil)
+				}
+			}
+		}
+
+	} else if before.Options != after.Options {
+		if IsUserAuditRedactKey(a, after.Name) {
+			diff.Redact(after.Name)
+		} else if before.Type == UserOptionsTypeJson || after.Type == UserOptionsTypeJson {
+			diff.Set(after.Name, redactUserAuditValue(a, after.Name, before.GetOptions()), redactUserAuditValue(a, after.Name, after.GetOptions()))
+		} else {
+			diff.Set(after.Name, before.Options, after.Options)
+		}
+	}
+
+	return diff
+}
+
+/**
+ * 写入审计日志, 失败只记录日志, 不影响业务
+ */
+func WriteUserAudit(a *UserApp, db kk.Database, tid int64, uid int64, actor string, action string, diff UserAuditDiff, source string) {
+
+	var v = UserAudit{}
+
+	v.Tid = tid
+	v.Uid = uid
+	v.Actor = actor
+	v.Action = action
+	v.Source = source
+	v.Ctime = time.Now().Unix()
+
+	if len(diff) > 0 {
+		b, err := json.Encode(diff)
+		if err != nil {
+			log.Println("[WriteUserAudit]" + err.Error())
+		} else {
+			v.Diff = string(b)
+		}
+	}
+
+	_, err := kk.DBInsert(db, &a.UserAuditTable, a.DB.Prefix, &v)
+
+	if err != nil {
+		log.Println("[WriteUserAudit]" + err.Error())
+	}
+}
+
+func (S *UserService) HandleUserAuditQueryTask(a *UserApp, task *UserAuditQueryTask) error {
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var audits = []UserAudit{}
+	var prefix = a.DB.Prefix
+
+	sql := bytes.NewBuffer(nil)
+
+	args := []interface{}{}
+
+	sql.WriteString(" WHERE tid=?")
+
+	args = append(args, task.Tid)
+
+	if task.Uid != 0 {
+		sql.WriteString(" AND uid=?")
+		args = append(args, task.Uid)
+	}
+
+	if task.Actor != "" {
+		sql.WriteString(" AND actor=?")
+		args = append(args, task.Actor)
+	}
+
+	if task.Action != "" {
+
+		sql.WriteString(" AND action IN (")
+
+		for i, action := range strings.Split(task.Action, ",") {
+			if i != 0 {
+				sql.WriteString(",")
+			}
+			sql.WriteString("?")
+			args = append(args, strings.TrimSpace(action))
+		}
+
+		sql.WriteString(")")
+	}
+
+	if task.Source != "" {
+		sql.WriteString(" AND source=?")
+		args = append(args, task.Source)
+	}
+
+	if task.StartTime != 0 {
+		sql.WriteString(" AND ctime>=?")
+		args = append(args, task.StartTime)
+	}
+
+	if task.EndTime != 0 {
+		sql.WriteString(" AND ctime<?")
+		args = append(args, task.EndTime)
+	}
+
+	if task.OrderBy == "asc" {
+		sql.WriteString(" ORDER BY id ASC")
+	} else {
+		sql.WriteString(" ORDER BY id DESC")
+	}
+
+	var pageIndex = task.PageIndex
+	var pageSize = task.PageSize
+
+	if pageIndex < 1 {
+		pageIndex = 1
+	}
+
+	if pageSize < 1 {
+		pageSize = 10
+	}
+
+	if task.Counter {
+		task.Result.Counter, err = NewUserQueryCounter(db, &a.UserAuditTable, prefix, pageIndex, pageSize, sql.String(), args...)
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+	}
+
+	sql.WriteString(fmt.Sprintf(" LIMIT %d,%d", (pageIndex-1)*pageSize, pageSize))
+
+	var v = UserAudit{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserAuditTable, prefix, sql.String(), args...)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		audits = append(audits, v)
+	}
+
+	task.Result.Audits = audits
+
+	return nil
+}
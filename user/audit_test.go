@@ -0,0 +1,87 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/json"
+	"strings"
+	"testing"
+)
+
+func TestNewUserOptionsAuditDiffRedactsNested(t *testing.T) {
+
+	var a = UserApp{}
+
+	var before = UserOptions{Name: "smtp", Type: UserOptionsTypeJson, Options: `{"host":"a","auth":{"user":"u","password":"old"}}`}
+	var after = UserOptions{Name: "smtp", Type: UserOptionsTypeJson, Options: `{"host":"b","auth":{"user":"u","password":"new"},"tokens":[{"token":"t1"}],"apiSecret":"s"}`}
+
+	diff := NewUserOptionsAuditDiff(&a, &before, &after)
+
+	b, err := json.Encode(diff)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"old", "new", "t1", `"s"`} {
+		if strings.Contains(string(b), secret) {
+			t.Fatalf("diff contains %s: %s", secret, b)
+		}
+	}
+
+	if diff["smtp.host"].Before != "a" || diff["smtp.host"].After != "b" {
+		t.Fatalf("smtp.host %v", diff["smtp.host"])
+	}
+
+	if diff["smtp.apiSecret"].After != UserAuditRedacted {
+		t.Fatalf("smtp.apiSecret %v", diff["smtp.apiSecret"])
+	}
+
+	auth, ok := diff["smtp.auth"].After.(map[string]interface{})
+
+	if !ok || auth["password"] != UserAuditRedacted || auth["user"] != "u" {
+		t.Fatalf("smtp.auth %v", diff["smtp.auth"])
+	}
+}
+
+func TestNewUserOptionsAuditDiffRedactsArray(t *testing.T) {
+
+	var a = UserApp{}
+
+	var before = UserOptions{Name: "keys", Type: UserOptionsTypeJson, Options: `[{"secret":"x"}]`}
+	var after = UserOptions{Name: "keys", Type: UserOptionsTypeJson, Options: `[{"secret":"y"}]`}
+
+	b, _ := json.Encode(NewUserOptionsAuditDiff(&a, &before, &after))
+
+	if strings.Contains(string(b), `"x"`) || strings.Contains(string(b), `"y"`) {
+		t.Fatalf("diff contains secrets: %s", b)
+	}
+}
+
+func TestIsUserAuditRedactKey(t *testing.T) {
+
+	var a = UserApp{}
+
+	if !IsUserAuditRedactKey(&a, "smtp.Password") || IsUserAuditRedactKey(&a, "smtp.host") {
+		t.Fatal("default redact keys")
+	}
+
+	a.AuditRedact = "pin"
+
+	if !IsUserAuditRedactKey(&a, "card.pin") || IsUserAuditRedactKey(&a, "smtp.password") {
+		t.Fatal("AuditRedact")
+	}
+}
+
+func TestUserLoginTaskIdentifier(t *testing.T) {
+
+	var task = UserLoginTask{Email: "a@b.c", Phone: "123456"}
+
+	if task.Identifier() != "a@b.c" {
+		t.Fatalf("Identifier %s", task.Identifier())
+	}
+
+	task.Email = ""
+
+	if task.Identifier() != "123456" {
+		t.Fatalf("Identifier %s", task.Identifier())
+	}
+}
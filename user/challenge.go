@@ -0,0 +1,143 @@
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/json"
+	"time"
+)
+
+const UserChallengeTypeLogin = "login"
+const UserChallengeTypeReset = "reset"
+
+const UserChallengeMaxCount = 5
+
+/**
+ * 一次性凭证 (二次验证, 重置密码等), 只保存 token 的哈希
+ */
+type UserChallenge struct {
+	Id    int64  `json:"id"`
+	Uid   int64  `json:"uid"`
+	Type  string `json:"type"`
+	Token string `json:"-"`
+	Data  string `json:"data,omitempty"`
+	Count int64  `json:"count"` // 失败次数
+	Ctime int64  `json:"ctime"`
+	Etime int64  `json:"etime"`
+}
+
+func NewUserChallenge(a *UserApp, db *sql.DB, uid int64, stype string, data interface{}, expires int64) (string, error) {
+
+	token, err := NewSessionToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	if expires <= 0 {
+		expires = a.ChallengeExpires
+	}
+
+	if expires <= 0 {
+		expires = 300
+	}
+
+	var v = UserChallenge{}
+
+	v.Uid = uid
+	v.Type = stype
+	v.Token = EncodeSessionToken(token)
+	v.Ctime = time.Now().Unix()
+	v.Etime = v.Ctime + expires
+
+	if data != nil {
+		b, err := json.Encode(data)
+		if err != nil {
+			return "", err
+		}
+		v.Data = string(b)
+	}
+
+	_, err = kk.DBInsert(db, &a.UserChallengeTable, a.DB.Prefix, &v)
+
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+/**
+ * 取出凭证, 不存在或已过期返回 nil
+ */
+func GetUserChallenge(a *UserApp, db *sql.DB, stype string, token string) (*UserChallenge, error) {
+
+	var v = UserChallenge{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserChallengeTable, a.DB.Prefix, " WHERE token=? AND type=?", EncodeSessionToken(token), stype)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if v.Etime > time.Now().Unix() {
+			return &v, nil
+		}
+	}
+
+	return nil, nil
+}
+
+/**
+ * 删除凭证, 返回 false 表示已被其他请求使用
+ */
+func UseUserChallenge(a *UserApp, db *sql.DB, v *UserChallenge) (bool, error) {
+
+	r, err := db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE id=?", a.DB.Prefix, a.UserChallengeTable.Name), v.Id)
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := r.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+/**
+ * 记录一次失败, 达到 UserChallengeMaxCount 后作废
+ */
+func FailUserChallenge(a *UserApp, db *sql.DB, v *UserChallenge) error {
+
+	v.Count = v.Count + 1
+
+	if v.Count >= UserChallengeMaxCount {
+		_, err := UseUserChallenge(a, db, v)
+		return err
+	}
+
+	_, err := db.Exec(fmt.Sprintf("UPDATE %s%s SET count=count+1 WHERE id=?", a.DB.Prefix, a.UserChallengeTable.Name), v.Id)
+
+	return err
+}
+
+func RemoveUserChallenges(a *UserApp, db *sql.DB, uid int64, stype string) error {
+	_, err := db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE uid=? AND type=?", a.DB.Prefix, a.UserChallengeTable.Name), uid, stype)
+	return err
+}
@@ -0,0 +1,165 @@
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk/app"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+ * 并发测试需要 MySQL 8.0.13+, KK_USER_TEST_DB 为连接地址, 未设置时跳过
+ * 例: KK_USER_TEST_DB="root:123456@tcp(127.0.0.1:3306)/kk_test" go test ./user
+ */
+func newTestUserApp(t *testing.T) (*UserApp, *sql.DB) {
+
+	var url = os.Getenv("KK_USER_TEST_DB")
+
+	if url == "" {
+		t.Skip("KK_USER_TEST_DB not set")
+	}
+
+	var a = UserApp{}
+
+	err := app.Load(&a, "../app.ini")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.DB = &app.DBConfig{Name: "mysql", Url: url, Prefix: fmt.Sprintf("test_%d_", time.Now().UnixNano())}
+	a.UserCache = false
+	a.LocalCache = nil
+	a.Outbox = nil
+	a.Webhook = nil
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+
+		rows, err := db.Query("SELECT table_name FROM information_schema.tables WHERE table_schema=DATABASE() AND table_name LIKE ?", a.DB.Prefix+"%")
+
+		if err != nil {
+			t.Log(err)
+			return
+		}
+
+		var names = []string{}
+
+		for rows.Next() {
+			var name = ""
+			if rows.Scan(&name) == nil {
+				names = append(names, name)
+			}
+		}
+
+		rows.Close()
+
+		for _, name := range names {
+			db.Exec("DROP TABLE `" + name + "`")
+		}
+	})
+
+	err = EnsureUserUniqueIndexs(&a, db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &a, db
+}
+
+func TestConcurrentUserCreate(t *testing.T) {
+
+	a, _ := newTestUserApp(t)
+
+	var S = UserService{}
+	var n = 8
+	var tasks = make([]UserCreateTask, n)
+	var wg = sync.WaitGroup{}
+
+	for i := 0; i < n; i++ {
+		tasks[i] = UserCreateTask{Tid: 0, Name: "concurrent", Password: "123456"}
+		wg.Add(1)
+		go func(task *UserCreateTask) {
+			defer wg.Done()
+			S.HandleUserCreateTask(a, task)
+		}(&tasks[i])
+	}
+
+	wg.Wait()
+
+	var created = 0
+
+	for _, task := range tasks {
+		if task.Result.Errno == 0 {
+			created = created + 1
+		} else if task.Result.Errno != ERROR_USER_NAME {
+			t.Errorf("errno %d %s", task.Result.Errno, task.Result.Errmsg)
+		}
+	}
+
+	if created != 1 {
+		t.Fatalf("created %d, want 1", created)
+	}
+}
+
+func TestConcurrentUserSetOptionsFirstWrite(t *testing.T) {
+
+	a, db := newTestUserApp(t)
+
+	var S = UserService{}
+	var create = UserCreateTask{Name: "options", Password: "123456"}
+
+	S.HandleUserCreateTask(a, &create)
+
+	if create.Result.Errno != 0 {
+		t.Fatal(create.Result.Errmsg)
+	}
+
+	var n = 8
+	var tasks = make([]UserSetOptionsTask, n)
+	var wg = sync.WaitGroup{}
+
+	for i := 0; i < n; i++ {
+		tasks[i] = UserSetOptionsTask{Uid: create.Result.User.Id, Name: "app", Options: map[string]interface{}{fmt.Sprintf("k%d", i): i}}
+		wg.Add(1)
+		go func(task *UserSetOptionsTask) {
+			defer wg.Done()
+			S.HandleUserSetOptionsTask(a, task)
+		}(&tasks[i])
+	}
+
+	wg.Wait()
+
+	for _, task := range tasks {
+		if task.Result.Errno != 0 {
+			t.Errorf("errno %d %s", task.Result.Errno, task.Result.Errmsg)
+		}
+	}
+
+	v, err := LoadUserOptions(a, db, 0, create.Result.User.Id, "app")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v == nil || v.Version != int64(n) {
+		t.Fatalf("options %v, want version %d", v, n)
+	}
+
+	var options = v.GetOptions()
+
+	for i := 0; i < n; i++ {
+		if _, ok := options.(map[string]interface{})[fmt.Sprintf("k%d", i)]; !ok {
+			t.Errorf("lost k%d in %v", i, options)
+		}
+	}
+}
@@ -13,3 +13,53 @@ const ERROR_USER_NOT_FOUND = ERROR_USER + 4
 const ERROR_USER_NOT_FOUND_PASSWORD = ERROR_USER + 5
 
 const ERROR_USER_PASSWORD = ERROR_USER + 6
+
+const ERROR_USER_NOT_FOUND_TOKEN = ERROR_USER + 7
+
+const ERROR_USER_SESSION = ERROR_USER + 8
+
+const ERROR_USER_SECOND_FACTOR = ERROR_USER + 9
+
+const ERROR_USER_NOT_FOUND_CODE = ERROR_USER + 10
+
+const ERROR_USER_CODE = ERROR_USER + 11
+
+const ERROR_USER_TOTP = ERROR_USER + 12
+
+const ERROR_USER_CHALLENGE = ERROR_USER + 13
+
+const ERROR_USER_LOCKED = ERROR_USER + 14
+
+const ERROR_USER_STATUS = ERROR_USER + 15
+
+const ERROR_USER_IDENTIFIER = ERROR_USER + 16
+
+const ERROR_USER_IDENTIFIER_EXISTS = ERROR_USER + 17
+
+const ERROR_USER_ROLE = ERROR_USER + 18
+
+const ERROR_USER_ROLE_EXISTS = ERROR_USER + 19
+
+const ERROR_USER_NOT_FOUND_PERMISSION = ERROR_USER + 20
+
+const ERROR_USER_NOT_FOUND_GROUP = ERROR_USER + 21
+
+const ERROR_USER_GROUP = ERROR_USER + 22
+
+const ERROR_USER_NOT_FOUND_TENANT = ERROR_USER + 23
+
+const ERROR_USER_TENANT = ERROR_USER + 24
+
+const ERROR_USER_NOT_FOUND_WEBHOOK = ERROR_USER + 25
+
+const ERROR_USER_WEBHOOK = ERROR_USER + 26
+
+const ERROR_USER_OPTIONS_CONFLICT = ERROR_USER + 27
+
+const ERROR_USER_OPTIONS_PATCH = ERROR_USER + 28
+
+const ERROR_USER_NOT_FOUND_REVISION = ERROR_USER + 29
+
+const ERROR_USER_OPTIONS_INVALID = ERROR_USER + 30
+
+const ERROR_USER_QUERY_INVALID = ERROR_USER + 31
@@ -0,0 +1,719 @@
+package user
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"time"
+)
+
+const UserGroupRoleOwner = "owner"
+const UserGroupRoleMember = "member"
+
+type UserGroup struct {
+	Id    int64  `json:"id"`
+	Tid   int64  `json:"tid"` // 租户
+	Pid   int64  `json:"pid"`
+	Name  string `json:"name"`
+	Title string `json:"title,omitempty"`
+	Ctime int64  `json:"ctime"`
+	Mtime int64  `json:"mtime"`
+}
+
+type UserGroupMember struct {
+	Id    int64  `json:"id"`
+	Gid   int64  `json:"gid"`
+	Uid   int64  `json:"uid"`
+	Role  string `json:"role"`
+	Ctime int64  `json:"ctime"`
+}
+
+/**
+ * 租户下的分组, 不存在或属于其他租户时返回 nil
+ */
+func GetUserGroup(a *UserApp, db *sql.DB, tid int64, id int64) (*UserGroup, error) {
+
+	var v = UserGroup{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserGroupTable, a.DB.Prefix, " WHERE id=? AND tid=?", id, tid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &v, nil
+	}
+
+	return nil, nil
+}
+
+/**
+ * pid 是否为 id 自身或其下级
+ */
+func isUserGroupDescendant(a *UserApp, db *sql.DB, tid int64, id int64, pid int64) (bool, error) {
+
+	for pid != 0 {
+
+		if pid == id {
+			return true, nil
+		}
+
+		v, err := GetUserGroup(a, db, tid, pid)
+
+		if err != nil {
+			return false, err
+		}
+
+		if v == nil {
+			return false, nil
+		}
+
+		pid = v.Pid
+	}
+
+	return false, nil
+}
+
+func (S *UserService) HandleUserGroupCreateTask(a *UserApp, task *UserGroupCreateTask) error {
+
+	if task.Name == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+		task.Result.Errmsg = "Not found name"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if task.Pid != 0 {
+
+		p, err := GetUserGroup(a, db, task.Tid, task.Pid)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if p == nil {
+			task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+			task.Result.Errmsg = "Not found parent group"
+			return nil
+		}
+	}
+
+	var v = UserGroup{}
+
+	v.Tid = task.Tid
+	v.Pid = task.Pid
+	v.Name = task.Name
+	v.Title = task.Title
+	v.Ctime = time.Now().Unix()
+	v.Mtime = v.Ctime
+
+	r, err := kk.DBInsert(db, &a.UserGroupTable, a.DB.Prefix, &v)
+
+	if err == nil {
+		v.Id, err = r.LastInsertId()
+	}
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Group = &v
+
+	return nil
+}
+
+func (S *UserService) HandleUserGroupSetTask(a *UserApp, task *UserGroupSetTask) error {
+
+	if task.Id == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group id"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	v, err := GetUserGroup(a, db, task.Tid, task.Id)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group"
+		return nil
+	}
+
+	var keys = map[string]bool{"mtime": true}
+
+	if task.Name != "" {
+		v.Name = task.Name
+		keys["name"] = true
+	}
+
+	if task.Title != "" {
+		v.Title = task.Title
+		keys["title"] = true
+	}
+
+	if task.Pid == -1 {
+		v.Pid = 0
+		keys["pid"] = true
+	} else if task.Pid != 0 && task.Pid != v.Pid {
+
+		p, err := GetUserGroup(a, db, task.Tid, task.Pid)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if p == nil {
+			task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+			task.Result.Errmsg = "Not found parent group"
+			return nil
+		}
+
+		cycle, err := isUserGroupDescendant(a, db, v.Tid, v.Id, task.Pid)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if cycle {
+			task.Result.Errno = ERROR_USER_GROUP
+			task.Result.Errmsg = "The parent group cannot be the group itself or its descendant"
+			return nil
+		}
+
+		v.Pid = task.Pid
+		keys["pid"] = true
+	}
+
+	v.Mtime = time.Now().Unix()
+
+	_, err = kk.DBUpdateWithKeys(db, &a.UserGroupTable, a.DB.Prefix, v, keys)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Group = v
+
+	return nil
+}
+
+func (S *UserService) HandleUserGroupRemoveTask(a *UserApp, task *UserGroupRemoveTask) error {
+
+	if task.Id == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group id"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+
+	g, err := GetUserGroup(a, db, task.Tid, task.Id)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if g == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group"
+		return nil
+	}
+
+	count, err := kk.DBQueryCount(db, &a.UserGroupTable, prefix, " WHERE pid=?", task.Id)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if count > 0 {
+		task.Result.Errno = ERROR_USER_GROUP
+		task.Result.Errmsg = "The group has child groups"
+		return nil
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE gid=?", prefix, a.UserGroupMemberTable.Name), task.Id)
+
+	if err == nil {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE id=?", prefix, a.UserGroupTable.Name), task.Id)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		tx.Rollback()
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	return nil
+}
+
+func (S *UserService) HandleUserGroupGetTask(a *UserApp, task *UserGroupGetTask) error {
+
+	if task.Id == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group id"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	v, err := GetUserGroup(a, db, task.Tid, task.Id)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group"
+		return nil
+	}
+
+	task.Result.Group = v
+
+	return nil
+}
+
+func (S *UserService) HandleUserGroupQueryTask(a *UserApp, task *UserGroupQueryTask) error {
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var groups = []UserGroup{}
+	var prefix = a.DB.Prefix
+
+	sql := bytes.NewBuffer(nil)
+
+	args := []interface{}{task.Tid}
+
+	sql.WriteString(" WHERE tid=?")
+
+	if task.Pid == -1 {
+		sql.WriteString(" AND pid=0")
+	} else if task.Pid != 0 {
+		sql.WriteString(" AND pid=?")
+		args = append(args, task.Pid)
+	}
+
+	if task.Uid != 0 {
+		sql.WriteString(fmt.Sprintf(" AND id IN (SELECT gid FROM %s%s WHERE uid=?)", prefix, a.UserGroupMemberTable.Name))
+		args = append(args, task.Uid)
+	}
+
+	if task.Name != "" {
+		sql.WriteString(" AND name=?")
+		args = append(args, task.Name)
+	}
+
+	if task.OrderBy == "asc" {
+		sql.WriteString(" ORDER BY id ASC")
+	} else {
+		sql.WriteString(" ORDER BY id DESC")
+	}
+
+	var pageIndex = task.PageIndex
+	var pageSize = task.PageSize
+
+	if pageIndex < 1 {
+		pageIndex = 1
+	}
+
+	if pageSize < 1 {
+		pageSize = 10
+	}
+
+	if task.Counter {
+		task.Result.Counter, err = NewUserQueryCounter(db, &a.UserGroupTable, prefix, pageIndex, pageSize, sql.String(), args...)
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+	}
+
+	sql.WriteString(fmt.Sprintf(" LIMIT %d,%d", (pageIndex-1)*pageSize, pageSize))
+
+	var v = UserGroup{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserGroupTable, prefix, sql.String(), args...)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		groups = append(groups, v)
+	}
+
+	task.Result.Groups = groups
+
+	return nil
+}
+
+func (S *UserService) HandleUserGroupMemberAddTask(a *UserApp, task *UserGroupMemberAddTask) error {
+
+	if task.Gid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group id"
+		return nil
+	}
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	var role = task.Role
+
+	if role == "" {
+		role = UserGroupRoleMember
+	}
+
+	if role != UserGroupRoleMember && role != UserGroupRoleOwner {
+		task.Result.Errno = ERROR_USER_GROUP
+		task.Result.Errmsg = fmt.Sprintf("Invalid member role %s", role)
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+
+	g, err := GetUserGroup(a, db, task.Tid, task.Gid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if g == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group"
+		return nil
+	}
+
+	u, err := getTenantUser(a, db, task.Tid, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if u == nil || u.Status == UserStatusDeleted {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
+
+	var v = UserGroupMember{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserGroupMemberTable, prefix, " WHERE gid=? AND uid=?", task.Gid, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if v.Role != role {
+
+			v.Role = role
+
+			_, err = kk.DBUpdateWithKeys(db, &a.UserGroupMemberTable, prefix, &v, map[string]bool{"role": true})
+
+			if err != nil {
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+				return nil
+			}
+		}
+
+	} else {
+
+		v.Gid = task.Gid
+		v.Uid = task.Uid
+		v.Role = role
+		v.Ctime = time.Now().Unix()
+
+		r, err := kk.DBInsert(db, &a.UserGroupMemberTable, prefix, &v)
+
+		if err == nil {
+			v.Id, err = r.LastInsertId()
+		}
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+	}
+
+	task.Result.Member = &v
+
+	return nil
+}
+
+func (S *UserService) HandleUserGroupMemberRemoveTask(a *UserApp, task *UserGroupMemberRemoveTask) error {
+
+	if task.Gid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group id"
+		return nil
+	}
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	g, err := GetUserGroup(a, db, task.Tid, task.Gid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if g == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group"
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE gid=? AND uid=?", a.DB.Prefix, a.UserGroupMemberTable.Name), task.Gid, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	return nil
+}
+
+func (S *UserService) HandleUserGroupMemberQueryTask(a *UserApp, task *UserGroupMemberQueryTask) error {
+
+	if task.Gid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group id"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	g, err := GetUserGroup(a, db, task.Tid, task.Gid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if g == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_GROUP
+		task.Result.Errmsg = "Not found group"
+		return nil
+	}
+
+	var members = []UserGroupMember{}
+	var prefix = a.DB.Prefix
+
+	sql := bytes.NewBuffer(nil)
+
+	args := []interface{}{task.Gid}
+
+	sql.WriteString(" WHERE gid=?")
+
+	if task.Role != "" {
+		sql.WriteString(" AND role=?")
+		args = append(args, task.Role)
+	}
+
+	if task.OrderBy == "asc" {
+		sql.WriteString(" ORDER BY id ASC")
+	} else {
+		sql.WriteString(" ORDER BY id DESC")
+	}
+
+	var pageIndex = task.PageIndex
+	var pageSize = task.PageSize
+
+	if pageIndex < 1 {
+		pageIndex = 1
+	}
+
+	if pageSize < 1 {
+		pageSize = 10
+	}
+
+	if task.Counter {
+		task.Result.Counter, err = NewUserQueryCounter(db, &a.UserGroupMemberTable, prefix, pageIndex, pageSize, sql.String(), args...)
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+	}
+
+	sql.WriteString(fmt.Sprintf(" LIMIT %d,%d", (pageIndex-1)*pageSize, pageSize))
+
+	var v = UserGroupMember{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserGroupMemberTable, prefix, sql.String(), args...)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		members = append(members, v)
+	}
+
+	task.Result.Members = members
+
+	return nil
+}
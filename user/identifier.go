@@ -0,0 +1,563 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/json"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const UserIdentifierEmail = "email"
+const UserIdentifierPhone = "phone"
+
+const UserChallengeTypeVerify = "verify."
+
+/**
+ * email/phone 的值, 未设置 (空字符串) 时以 NULL 存储
+ * 唯一索引 (tid,email)/(tid,phone) 不限制 NULL, 未设置的用户不冲突
+ */
+type UserIdentifierValue string
+
+func (v UserIdentifierValue) Value() (driver.Value, error) {
+	if v == "" {
+		return nil, nil
+	}
+	return string(v), nil
+}
+
+func (v *UserIdentifierValue) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*v = ""
+	case []byte:
+		*v = UserIdentifierValue(s)
+	case string:
+		*v = UserIdentifierValue(s)
+	default:
+		return fmt.Errorf("Invalid identifier value %v", src)
+	}
+	return nil
+}
+
+/**
+ * 返回标识对应的列和验证标志列
+ */
+func UserIdentifierColumns(stype string) (string, string, error) {
+	switch stype {
+	case UserIdentifierEmail:
+		return "email", "emailverified", nil
+	case UserIdentifierPhone:
+		return "phone", "phoneverified", nil
+	}
+	return "", "", fmt.Errorf("Invalid identifier type %s", stype)
+}
+
+func NormalizeUserIdentifier(stype string, value string) (string, error) {
+
+	value = strings.TrimSpace(value)
+
+	if value == "" {
+		return "", nil
+	}
+
+	switch stype {
+	case UserIdentifierEmail:
+		i := strings.LastIndex(value, "@")
+		if i < 1 || i == len(value)-1 || strings.ContainsAny(value, " \t\r\n") {
+			return "", fmt.Errorf("Invalid email %s", value)
+		}
+		return strings.ToLower(value), nil
+	case UserIdentifierPhone:
+		var b = []byte{}
+		for i, c := range []byte(value) {
+			if c >= '0' && c <= '9' || c == '+' && i == 0 {
+				b = append(b, c)
+			} else if c != ' ' && c != '-' && c != '(' && c != ')' {
+				return "", fmt.Errorf("Invalid phone %s", value)
+			}
+		}
+		if len(b) < 5 {
+			return "", fmt.Errorf("Invalid phone %s", value)
+		}
+		return string(b), nil
+	}
+
+	return "", fmt.Errorf("Invalid identifier type %s", stype)
+}
+
+func (U *User) Identifier(stype string) (string, bool) {
+	switch stype {
+	case UserIdentifierEmail:
+		return string(U.Email), U.EmailVerified != 0
+	case UserIdentifierPhone:
+		return string(U.Phone), U.PhoneVerified != 0
+	}
+	return "", false
+}
+
+/**
+ * 标识是否已被同一租户的其他用户使用
+ * 只用于提前返回错误, 并发写入由唯一索引 uk_tid_email/uk_tid_phone 保证
+ */
+func IsUserIdentifierTaken(a *UserApp, db *sql.DB, stype string, value string, tid int64, uid int64) (bool, error) {
+
+	column, _, err := UserIdentifierColumns(stype)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := kk.DBQueryCount(db, &a.UserTable, a.DB.Prefix, fmt.Sprintf(" WHERE tid=? AND %s=? AND id<>?", column), tid, value, uid)
+
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func NewVerifyCode() (string, error) {
+
+	v, err := rand.Int(rand.Reader, big.NewInt(1000000))
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%06d", v.Int64()), nil
+}
+
+type userVerifyData struct {
+	Value string `json:"value"`
+	Code  string `json:"code"` // sha256(code)
+}
+
+func FindUserChallenge(a *UserApp, db *sql.DB, uid int64, stype string) (*UserChallenge, error) {
+
+	var v = UserChallenge{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserChallengeTable, a.DB.Prefix, " WHERE uid=? AND type=? AND etime>? ORDER BY id DESC LIMIT 1", uid, stype, time.Now().Unix())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &v, nil
+	}
+
+	return nil, nil
+}
+
+func getUserById(a *UserApp, db *sql.DB, uid int64) (*User, error) {
+
+	var v = User{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserTable, a.DB.Prefix, " WHERE id=?", uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &v, nil
+	}
+
+	return nil, nil
+}
+
+/**
+ * 租户下的用户, 不存在或属于其他租户时返回 nil
+ */
+func getTenantUser(a *UserApp, db *sql.DB, tid int64, uid int64) (*User, error) {
+
+	v, err := getUserById(a, db, uid)
+
+	if err != nil || v == nil || v.Tid != tid {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (S *UserService) HandleUserSetIdentifierTask(a *UserApp, task *UserSetIdentifierTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	column, verified, err := UserIdentifierColumns(task.Type)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER_IDENTIFIER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	value, err := NormalizeUserIdentifier(task.Type, task.Value)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER_IDENTIFIER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	v, err := getUserById(a, db, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil || v.Tid != task.Tid || v.Status == UserStatusDeleted {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
+
+	if value != "" {
+
+		taken, err := IsUserIdentifierTaken(a, db, task.Type, value, v.Tid, v.Id)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if taken {
+			task.Result.Errno = ERROR_USER_IDENTIFIER_EXISTS
+			task.Result.Errmsg = fmt.Sprintf("The %s already exists", task.Type)
+			return nil
+		}
+	}
+
+	if old, _ := v.Identifier(task.Type); old != value {
+
+		if task.Type == UserIdentifierEmail {
+			v.Email = UserIdentifierValue(value)
+			v.EmailVerified = 0
+		} else {
+			v.Phone = UserIdentifierValue(value)
+			v.PhoneVerified = 0
+		}
+
+		v.Mtime = time.Now().Unix()
+
+		tx, err := db.Begin()
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		_, err = kk.DBUpdateWithKeys(tx, &a.UserTable, a.DB.Prefix, v, map[string]bool{column: true, verified: true, "mtime": true})
+
+		if err == nil {
+			err = WriteUserEvent(a, tx, v.Tid, v.Id, UserEventUpdated, v)
+		}
+
+		if err == nil {
+			err = tx.Commit()
+		}
+
+		if IsDuplicateKeyError(err) {
+			tx.Rollback()
+			task.Result.Errno = ERROR_USER_IDENTIFIER_EXISTS
+			task.Result.Errmsg = fmt.Sprintf("The %s already exists", task.Type)
+			return nil
+		}
+
+		if err != nil {
+			tx.Rollback()
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		RemoveUserCache(a, v.Tid, v.Id, "")
+
+		err = RemoveUserChallenges(a, db, v.Id, UserChallengeTypeVerify+task.Type)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+	}
+
+	task.Result.User = v
+
+	return nil
+}
+
+/**
+ * 发送验证码和链接 token, 二者任选其一用于 User.Verify.Confirm
+ */
+func (S *UserService) HandleUserVerifyRequestTask(a *UserApp, task *UserVerifyRequestTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	_, _, err := UserIdentifierColumns(task.Type)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER_IDENTIFIER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	v, err := getTenantUser(a, db, task.Tid, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
+
+	if !CheckUserStatus(v, &task.Result.Result) {
+		return nil
+	}
+
+	value, _ := v.Identifier(task.Type)
+
+	if value == "" {
+		task.Result.Errno = ERROR_USER_IDENTIFIER
+		task.Result.Errmsg = fmt.Sprintf("Not found %s", task.Type)
+		return nil
+	}
+
+	code, err := NewVerifyCode()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var expires = task.Expires
+
+	if expires <= 0 {
+		expires = a.VerifyExpires
+	}
+
+	err = RemoveUserChallenges(a, db, v.Id, UserChallengeTypeVerify+task.Type)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	token, err := NewUserChallenge(a, db, v.Id, UserChallengeTypeVerify+task.Type, &userVerifyData{Value: value, Code: EncodeSessionToken(code)}, expires)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var n = Notification{}
+	n.Type = UserChallengeTypeVerify + task.Type
+	n.Uid = v.Id
+	n.Name = v.Name
+	n.To = value
+	n.Token = token
+	n.Code = code
+	n.Expires = expires
+
+	err = Notify(a, &n)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	return nil
+}
+
+func (S *UserService) HandleUserVerifyConfirmTask(a *UserApp, task *UserVerifyConfirmTask) error {
+
+	_, verified, err := UserIdentifierColumns(task.Type)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER_IDENTIFIER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if task.Token == "" && (task.Uid == 0 || task.Code == "") {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_CODE
+		task.Result.Errmsg = "Not found code"
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var stype = UserChallengeTypeVerify + task.Type
+	var challenge *UserChallenge = nil
+	var data = userVerifyData{}
+
+	if task.Token != "" {
+		challenge, err = GetUserChallenge(a, db, stype, task.Token)
+	} else {
+		challenge, err = FindUserChallenge(a, db, task.Uid, stype)
+	}
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if challenge == nil {
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = "The code is invalid or has expired"
+		return nil
+	}
+
+	v, err := getTenantUser(a, db, task.Tid, challenge.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil {
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = "The code is invalid or has expired"
+		return nil
+	}
+
+	json.Decode([]byte(challenge.Data), &data)
+
+	if task.Token == "" && subtle.ConstantTimeCompare([]byte(EncodeSessionToken(strings.TrimSpace(task.Code))), []byte(data.Code)) != 1 {
+		FailUserChallenge(a, db, challenge)
+		task.Result.Errno = ERROR_USER_CODE
+		task.Result.Errmsg = "The code is invalid"
+		return nil
+	}
+
+	if value, _ := v.Identifier(task.Type); value == "" || value != data.Value {
+		UseUserChallenge(a, db, challenge)
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = fmt.Sprintf("The %s has changed", task.Type)
+		return nil
+	}
+
+	ok, err := UseUserChallenge(a, db, challenge)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if !ok {
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = "The code is invalid or has expired"
+		return nil
+	}
+
+	if task.Type == UserIdentifierEmail {
+		v.EmailVerified = 1
+	} else {
+		v.PhoneVerified = 1
+	}
+
+	v.Mtime = time.Now().Unix()
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	_, err = kk.DBUpdateWithKeys(tx, &a.UserTable, a.DB.Prefix, v, map[string]bool{verified: true, "mtime": true})
+
+	if err == nil {
+		err = WriteUserEvent(a, tx, v.Tid, v.Id, UserEventUpdated, v)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		tx.Rollback()
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	RemoveUserCache(a, v.Tid, v.Id, "")
+
+	task.Result.User = v
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package user
+
+import (
+	"testing"
+)
+
+func TestNormalizeUserIdentifier(t *testing.T) {
+
+	var cases = []struct {
+		stype string
+		value string
+		want  string
+		err   bool
+	}{
+		{UserIdentifierEmail, " User@Example.COM ", "user@example.com", false},
+		{UserIdentifierEmail, "", "", false},
+		{UserIdentifierEmail, "user", "", true},
+		{UserIdentifierEmail, "@example.com", "", true},
+		{UserIdentifierEmail, "user@", "", true},
+		{UserIdentifierEmail, "us er@example.com", "", true},
+		{UserIdentifierPhone, "+86 (138) 0013-8000", "+8613800138000", false},
+		{UserIdentifierPhone, "1234", "", true},
+		{UserIdentifierPhone, "138a0013800", "", true},
+		{UserIdentifierPhone, "138+0013800", "", true},
+		{"name", "x", "", true},
+	}
+
+	for _, c := range cases {
+
+		v, err := NormalizeUserIdentifier(c.stype, c.value)
+
+		if (err != nil) != c.err || v != c.want {
+			t.Errorf("NormalizeUserIdentifier(%q, %q) = %q, %v", c.stype, c.value, v, err)
+		}
+	}
+}
+
+func TestUserIdentifierValue(t *testing.T) {
+
+	if v, err := UserIdentifierValue("").Value(); v != nil || err != nil {
+		t.Fatalf("empty identifier stored as %v %v", v, err)
+	}
+
+	if v, err := UserIdentifierValue("a@b.c").Value(); v != "a@b.c" || err != nil {
+		t.Fatalf("identifier stored as %v %v", v, err)
+	}
+
+	var v = UserIdentifierValue("x")
+
+	if err := v.Scan(nil); err != nil || v != "" {
+		t.Fatalf("NULL scanned as %q %v", v, err)
+	}
+
+	if err := v.Scan([]byte("a@b.c")); err != nil || v != "a@b.c" {
+		t.Fatalf("scanned %q %v", v, err)
+	}
+
+	if err := v.Scan(1); err == nil {
+		t.Fatal("int scanned")
+	}
+}
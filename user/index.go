@@ -0,0 +1,177 @@
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"log"
+	"strings"
+)
+
+/**
+ * kk.DBTable 只支持单列索引, 多列唯一索引在初始化时创建
+ * email/phone 为可空列, 未设置时为 NULL, 未设置的用户不冲突
+ */
+type UserUniqueIndex struct {
+	Table   string
+	Name    string
+	Columns string
+}
+
+func UserUniqueIndexs(a *UserApp) []UserUniqueIndex {
+	return []UserUniqueIndex{
+		{a.UserTable.Name, "uk_tid_name", "tid,name"},
+		{a.UserTable.Name, "uk_tid_email", "tid,email"},
+		{a.UserTable.Name, "uk_tid_phone", "tid,phone"},
+		{a.UserOptionsTable.Name, "uk_tid_uid_name", "tid,uid,name"},
+		{a.UserLockoutTable.Name, "uk_key", "`key`"},
+		{a.UserRoleTable.Name, "uk_tid_name", "tid,name"},
+	}
+}
+
+/**
+ * 把 email/phone 改为可空列, 并把以前存储的空字符串改为 NULL
+ */
+func EnsureUserIdentifierColumns(a *UserApp, db *sql.DB) error {
+
+	var table = a.DB.Prefix + a.UserTable.Name
+
+	for _, column := range []string{"email", "phone"} {
+
+		var nullable = ""
+		var ctype = ""
+
+		err := db.QueryRow("SELECT is_nullable, column_type FROM information_schema.columns WHERE table_schema=DATABASE() AND table_name=? AND column_name=?", table, column).Scan(&nullable, &ctype)
+
+		if err == nil && nullable != "YES" {
+			_, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s` MODIFY `%s` %s NULL DEFAULT NULL", table, column, ctype))
+			if err == nil {
+				log.Println("Alter column " + table + "." + column + " NULL")
+			}
+		}
+
+		if err == nil {
+			_, err = db.Exec(fmt.Sprintf("UPDATE `%s` SET `%s`=NULL WHERE `%s`=''", table, column, column))
+		}
+
+		if err != nil {
+			return fmt.Errorf("Alter column %s.%s: %s", table, column, err.Error())
+		}
+	}
+
+	return nil
+}
+
+/**
+ * 违反唯一索引的重复值, 最多返回 limit 组, 形如 (0,a@b.c)x2
+ */
+func FindUserUniqueIndexDuplicates(db *sql.DB, table string, columns string, limit int) ([]string, error) {
+
+	var where = []string{}
+
+	for _, column := range strings.Split(columns, ",") {
+		where = append(where, column+" IS NOT NULL")
+	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s, COUNT(*) FROM `%s` WHERE %s GROUP BY %s HAVING COUNT(*)>1 LIMIT %d",
+		columns, table, strings.Join(where, " AND "), columns, limit))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var n = len(strings.Split(columns, ","))
+	var vs = []string{}
+
+	for rows.Next() {
+
+		var values = make([]sql.RawBytes, n)
+		var count = 0
+		var dest = []interface{}{}
+
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		err = rows.Scan(append(dest, &count)...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var items = []string{}
+
+		for _, value := range values {
+			items = append(items, string(value))
+		}
+
+		vs = append(vs, fmt.Sprintf("(%s)x%d", strings.Join(items, ","), count))
+	}
+
+	return vs, rows.Err()
+}
+
+/**
+ * 创建缺失的唯一索引
+ * 唯一索引是并发创建/设置的唯一保证, 已有重复数据时返回列出重复值的错误, 服务不能启动
+ * 重复数据需先按 app.ini 中的说明清理
+ */
+func EnsureUserUniqueIndexs(a *UserApp, db *sql.DB) error {
+
+	err := EnsureUserIdentifierColumns(a, db)
+
+	if err != nil {
+		return err
+	}
+
+	for _, index := range UserUniqueIndexs(a) {
+
+		var table = a.DB.Prefix + index.Table
+		var count = 0
+
+		err := db.QueryRow("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema=DATABASE() AND table_name=? AND index_name=?", table, index.Name).Scan(&count)
+
+		if err != nil {
+			return fmt.Errorf("Create unique index %s.%s: %s", table, index.Name, err.Error())
+		}
+
+		if count > 0 {
+			continue
+		}
+
+		duplicates, err := FindUserUniqueIndexDuplicates(db, table, index.Columns, 10)
+
+		if err == nil && len(duplicates) > 0 {
+			err = fmt.Errorf("duplicate (%s) %s, remove the duplicates and restart", index.Columns, strings.Join(duplicates, " "))
+		}
+
+		if err == nil {
+			_, err = db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX `%s` ON `%s` (%s)", index.Name, table, index.Columns))
+			if err == nil {
+				log.Println("Create unique index " + table + "." + index.Name)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("Create unique index %s.%s: %s", table, index.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+/**
+ * MySQL ER_DUP_ENTRY
+ */
+func IsDuplicateKeyError(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	e, ok := err.(*mysql.MySQLError)
+
+	return ok && e.Number == 1062
+}
@@ -0,0 +1,484 @@
+package user
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const JWTAlgHS256 = "HS256"
+const JWTAlgRS256 = "RS256"
+const JWTAlgEdDSA = "EdDSA"
+
+/**
+ * JWT 密钥, PrivateKey/PublicKey 为 PEM 文件路径
+ * 只有 PublicKey (或 HS256 的 Secret) 的密钥仅用于校验, 轮换期间保留旧密钥
+ * HS256 的密钥不应提交到 app.ini, 依次读取 SecretEnv 环境变量, SecretFile 文件, Secret
+ */
+type JWTKey struct {
+	Alg        string
+	Secret     string
+	SecretEnv  string // 环境变量名, 如 KK_USER_JWT_SECRET
+	SecretFile string // 不纳入版本管理的文件, 如 /config/jwt-k1.secret
+	PrivateKey string
+	PublicKey  string
+}
+
+const JWTSecretMinLength = 32
+
+/**
+ * 曾提交到仓库的示例密钥, 拒绝使用
+ */
+var JWTSampleSecrets = map[string]bool{
+	"(*&^GHJKLO*&^TFGHJ)(*": true,
+}
+
+type JWTConfig struct {
+	Issuer  string
+	Expires int64
+	Kid     string // 签名使用的密钥
+	Keys    map[string]JWTKey
+
+	once sync.Once
+	keys map[string]*jwtKey
+	err  error
+}
+
+type JWTClaims struct {
+	Iss  string `json:"iss,omitempty"`
+	Sub  string `json:"sub"`
+	Uid  int64  `json:"uid"`
+	Name string `json:"name"`
+	Iat  int64  `json:"iat"`
+	Exp  int64  `json:"exp"`
+}
+
+/**
+ * JSON Web Key (RFC 7517)
+ */
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type jwtKey struct {
+	alg     string
+	secret  []byte
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+func readPEM(path string) (*pem.Block, error) {
+
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM file %s", path)
+	}
+
+	return block, nil
+}
+
+func jwtSecret(v *JWTKey) (string, error) {
+
+	if v.SecretEnv != "" {
+		if s := os.Getenv(v.SecretEnv); s != "" {
+			return s, nil
+		}
+	}
+
+	if v.SecretFile != "" {
+
+		b, err := ioutil.ReadFile(v.SecretFile)
+
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	return v.Secret, nil
+}
+
+func parseJWTKey(v *JWTKey) (*jwtKey, error) {
+
+	var k = jwtKey{alg: v.Alg}
+
+	switch v.Alg {
+	case JWTAlgHS256:
+
+		secret, err := jwtSecret(v)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if secret == "" {
+			return nil, fmt.Errorf("HS256 key without secret")
+		}
+
+		if JWTSampleSecrets[secret] {
+			return nil, fmt.Errorf("HS256 key uses the sample secret")
+		}
+
+		if len(secret) < JWTSecretMinLength {
+			return nil, fmt.Errorf("HS256 secret shorter than %d bytes", JWTSecretMinLength)
+		}
+
+		k.secret = []byte(secret)
+		return &k, nil
+	case JWTAlgRS256, JWTAlgEdDSA:
+	default:
+		return nil, fmt.Errorf("unsupported JWT alg %s", v.Alg)
+	}
+
+	if v.PrivateKey != "" {
+
+		block, err := readPEM(v.PrivateKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var key interface{} = nil
+
+		if block.Type == "RSA PRIVATE KEY" {
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		} else {
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		signer, ok := key.(crypto.Signer)
+
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key %s", v.PrivateKey)
+		}
+
+		k.private = signer
+		k.public = signer.Public()
+
+	} else if v.PublicKey != "" {
+
+		block, err := readPEM(v.PublicKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if block.Type == "RSA PUBLIC KEY" {
+			k.public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		} else {
+			k.public, err = x509.ParsePKIXPublicKey(block.Bytes)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+	} else {
+		return nil, fmt.Errorf("%s key without PrivateKey or PublicKey", v.Alg)
+	}
+
+	switch k.public.(type) {
+	case *rsa.PublicKey:
+		if v.Alg != JWTAlgRS256 {
+			return nil, fmt.Errorf("RSA key used with %s", v.Alg)
+		}
+	case ed25519.PublicKey:
+		if v.Alg != JWTAlgEdDSA {
+			return nil, fmt.Errorf("Ed25519 key used with %s", v.Alg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key for %s", v.Alg)
+	}
+
+	return &k, nil
+}
+
+func (C *JWTConfig) load() error {
+
+	C.once.Do(func() {
+
+		C.keys = map[string]*jwtKey{}
+
+		for kid, v := range C.Keys {
+
+			k, err := parseJWTKey(&v)
+
+			if err != nil {
+				C.err = fmt.Errorf("JWT key %s: %s", kid, err.Error())
+				return
+			}
+
+			C.keys[kid] = k
+		}
+	})
+
+	return C.err
+}
+
+/**
+ * 启动时检查密钥, 配置错误时拒绝启动
+ */
+func (C *JWTConfig) Check() error {
+
+	if C == nil {
+		return nil
+	}
+
+	err := C.load()
+
+	if err != nil {
+		return err
+	}
+
+	if _, ok := C.keys[C.Kid]; C.Kid != "" && !ok {
+		return fmt.Errorf("Not found JWT key %s", C.Kid)
+	}
+
+	return nil
+}
+
+func (k *jwtKey) sign(data []byte) ([]byte, error) {
+
+	switch k.alg {
+	case JWTAlgHS256:
+		m := hmac.New(sha256.New, k.secret)
+		m.Write(data)
+		return m.Sum(nil), nil
+	case JWTAlgRS256:
+		if k.private == nil {
+			return nil, fmt.Errorf("the key cannot sign")
+		}
+		h := sha256.Sum256(data)
+		return k.private.Sign(rand.Reader, h[:], crypto.SHA256)
+	case JWTAlgEdDSA:
+		if k.private == nil {
+			return nil, fmt.Errorf("the key cannot sign")
+		}
+		return k.private.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+
+	return nil, fmt.Errorf("unsupported JWT alg %s", k.alg)
+}
+
+func (k *jwtKey) verify(data []byte, sig []byte) bool {
+
+	switch k.alg {
+	case JWTAlgHS256:
+		m := hmac.New(sha256.New, k.secret)
+		m.Write(data)
+		return hmac.Equal(m.Sum(nil), sig)
+	case JWTAlgRS256:
+		h := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(k.public.(*rsa.PublicKey), crypto.SHA256, h[:], sig) == nil
+	case JWTAlgEdDSA:
+		return ed25519.Verify(k.public.(ed25519.PublicKey), data, sig)
+	}
+
+	return false
+}
+
+func (C *JWTConfig) Sign(user *User) (string, int64, error) {
+
+	if C == nil || C.Kid == "" {
+		return "", 0, fmt.Errorf("JWT is not configured")
+	}
+
+	err := C.load()
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	k, ok := C.keys[C.Kid]
+
+	if !ok {
+		return "", 0, fmt.Errorf("Not found JWT key %s", C.Kid)
+	}
+
+	var expires = C.Expires
+
+	if expires <= 0 {
+		expires = 3600
+	}
+
+	var claims = JWTClaims{}
+
+	claims.Iss = C.Issuer
+	claims.Sub = fmt.Sprintf("%d", user.Id)
+	claims.Uid = user.Id
+	claims.Name = user.Name
+	claims.Iat = time.Now().Unix()
+	claims.Exp = claims.Iat + expires
+
+	header, _ := json.Encode(&jwtHeader{Alg: k.alg, Typ: "JWT", Kid: C.Kid})
+	payload, _ := json.Encode(&claims)
+
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	sig, err := k.sign([]byte(data))
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	return data + "." + base64.RawURLEncoding.EncodeToString(sig), expires, nil
+}
+
+/**
+ * 使用 kid 对应的任一已配置密钥校验
+ */
+func (C *JWTConfig) Verify(token string) (*JWTClaims, error) {
+
+	if C == nil {
+		return nil, fmt.Errorf("JWT is not configured")
+	}
+
+	err := C.load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	vs := strings.Split(token, ".")
+
+	if len(vs) != 3 {
+		return nil, fmt.Errorf("invalid JWT")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(vs[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	var header = jwtHeader{}
+
+	err = json.Decode(b, &header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	k, ok := C.keys[header.Kid]
+
+	if !ok || k.alg != header.Alg {
+		return nil, fmt.Errorf("unknown JWT key %s", header.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(vs[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !k.verify([]byte(vs[0]+"."+vs[1]), sig) {
+		return nil, fmt.Errorf("invalid JWT signature")
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(vs[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	var claims = JWTClaims{}
+
+	err = json.Decode(b, &claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Exp <= time.Now().Unix() {
+		return nil, fmt.Errorf("the JWT has expired")
+	}
+
+	return &claims, nil
+}
+
+/**
+ * 公钥集合 (JWKS), HS256 密钥不公开
+ */
+func (C *JWTConfig) JWKS() ([]JWK, error) {
+
+	var keys = []JWK{}
+
+	if C == nil {
+		return keys, nil
+	}
+
+	err := C.load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for kid, k := range C.keys {
+
+		switch pub := k.public.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{Kty: "RSA", Kid: kid, Alg: k.alg, Use: "sig",
+				N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())})
+		case ed25519.PublicKey:
+			keys = append(keys, JWK{Kty: "OKP", Kid: kid, Alg: k.alg, Use: "sig", Crv: "Ed25519",
+				X: base64.RawURLEncoding.EncodeToString(pub)})
+		}
+	}
+
+	return keys, nil
+}
+
+func (S *UserService) HandleUserKeysTask(a *UserApp, task *UserKeysTask) error {
+
+	var keys, err = a.JWT.JWKS()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Keys = keys
+
+	return nil
+}
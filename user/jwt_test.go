@@ -0,0 +1,150 @@
+package user
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+func TestJWTSignVerifyHS256(t *testing.T) {
+
+	var C = JWTConfig{Issuer: "test", Kid: "k1", Keys: map[string]JWTKey{"k1": {Alg: JWTAlgHS256, Secret: testJWTSecret}}}
+
+	token, expires, err := C.Sign(&User{Id: 10, Name: "u"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expires != 3600 {
+		t.Fatalf("expires %d", expires)
+	}
+
+	claims, err := C.Verify(token)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Uid != 10 || claims.Name != "u" || claims.Iss != "test" {
+		t.Fatalf("claims %v", claims)
+	}
+
+	vs := strings.Split(token, ".")
+
+	_, err = C.Verify(vs[0] + "." + vs[1] + "." + vs[2][1:])
+
+	if err == nil {
+		t.Fatal("tampered signature verified")
+	}
+}
+
+func TestJWTSecretRejected(t *testing.T) {
+
+	for secret := range JWTSampleSecrets {
+		var C = JWTConfig{Kid: "k1", Keys: map[string]JWTKey{"k1": {Alg: JWTAlgHS256, Secret: secret}}}
+		if C.Check() == nil {
+			t.Fatal("sample secret accepted")
+		}
+	}
+
+	var C = JWTConfig{Kid: "k1", Keys: map[string]JWTKey{"k1": {Alg: JWTAlgHS256, Secret: "short"}}}
+
+	if C.Check() == nil {
+		t.Fatal("short secret accepted")
+	}
+
+	C = JWTConfig{Kid: "k2", Keys: map[string]JWTKey{"k1": {Alg: JWTAlgHS256, Secret: testJWTSecret}}}
+
+	if C.Check() == nil {
+		t.Fatal("missing kid accepted")
+	}
+}
+
+func TestJWTSecretEnvAndFile(t *testing.T) {
+
+	os.Setenv("KK_USER_TEST_JWT_SECRET", testJWTSecret)
+	defer os.Unsetenv("KK_USER_TEST_JWT_SECRET")
+
+	var C = JWTConfig{Kid: "k1", Keys: map[string]JWTKey{"k1": {Alg: JWTAlgHS256, SecretEnv: "KK_USER_TEST_JWT_SECRET"}}}
+
+	if err := C.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "jwt")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "k1.secret")
+
+	if err = ioutil.WriteFile(path, []byte(testJWTSecret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	C = JWTConfig{Kid: "k1", Keys: map[string]JWTKey{"k1": {Alg: JWTAlgHS256, SecretFile: path}}}
+
+	if err := C.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(C.keys["k1"].secret) != testJWTSecret {
+		t.Fatalf("secret %q", C.keys["k1"].secret)
+	}
+}
+
+func TestJWTSignVerifyEdDSA(t *testing.T) {
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "jwt")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	b, _ := x509.MarshalPKCS8PrivateKey(priv)
+	privPath := filepath.Join(dir, "k.pem")
+	ioutil.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600)
+
+	b, _ = x509.MarshalPKIXPublicKey(pub)
+	pubPath := filepath.Join(dir, "k.pub.pem")
+	ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0600)
+
+	var signer = JWTConfig{Kid: "k1", Keys: map[string]JWTKey{"k1": {Alg: JWTAlgEdDSA, PrivateKey: privPath}}}
+	var verifier = JWTConfig{Keys: map[string]JWTKey{"k1": {Alg: JWTAlgEdDSA, PublicKey: pubPath}}}
+
+	token, _, err := signer.Sign(&User{Id: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = verifier.Verify(token); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := verifier.JWKS()
+
+	if err != nil || len(keys) != 1 || keys[0].Crv != "Ed25519" {
+		t.Fatalf("JWKS %v %v", keys, err)
+	}
+}
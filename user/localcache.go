@@ -0,0 +1,522 @@
+package user
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/kkserver/kk-cache/cache"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/app"
+	"github.com/kkserver/kk-lib/kk/app/remote"
+	"github.com/kkserver/kk-lib/kk/json"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * 进程内 LRU 缓存, 位于 ClientCache 之前, 用于用户和配置
+ * 键变更时删除本地缓存, 并通过 Broadcast 通知其他实例 (User.Cache.Invalidate)
+ * 广播是尽力而为的, Expires 应保持较短
+ */
+type LocalCacheConfig struct {
+	Size      int    // 最多缓存的键数, 默认 10000
+	Expires   int64  // 本地缓存时间 (秒), 默认 5, 不超过写入时的 Expires
+	Broadcast string // 失效广播的 kk 消息目标, 如 kk.message.user.cache., 为空不广播
+	Address   string // 订阅失效广播的 kk 路由地址, 以 Broadcast* 为名连接, 为空不订阅
+
+	lock   sync.Mutex
+	items  map[string]*list.Element
+	list   *list.List
+	origin string
+}
+
+type localCacheItem struct {
+	key     string
+	value   string
+	expires int64
+}
+
+/**
+ * 失效广播的消息体, Origin 为发送的实例, 收到自己的广播时忽略
+ */
+type LocalCacheInvalidateMessage struct {
+	Origin string   `json:"origin"`
+	Keys   []string `json:"keys"`
+}
+
+func (C *LocalCacheConfig) size() int {
+	if C.Size > 0 {
+		return C.Size
+	}
+	return 10000
+}
+
+func (C *LocalCacheConfig) expires() int64 {
+	if C.Expires > 0 {
+		return C.Expires
+	}
+	return 5
+}
+
+/**
+ * 实例标识, 首次使用时生成
+ */
+func (C *LocalCacheConfig) Origin() string {
+
+	C.lock.Lock()
+	defer C.lock.Unlock()
+
+	if C.origin == "" {
+		C.origin, _ = NewSessionToken()
+	}
+
+	return C.origin
+}
+
+func (C *LocalCacheConfig) Get(key string) (string, bool) {
+
+	C.lock.Lock()
+	defer C.lock.Unlock()
+
+	if C.items == nil {
+		return "", false
+	}
+
+	e, ok := C.items[key]
+
+	if !ok {
+		return "", false
+	}
+
+	var item = e.Value.(*localCacheItem)
+
+	if item.expires <= time.Now().Unix() {
+		C.list.Remove(e)
+		delete(C.items, key)
+		return "", false
+	}
+
+	C.list.MoveToFront(e)
+
+	return item.value, true
+}
+
+func (C *LocalCacheConfig) Set(key string, value string, expires int64) {
+
+	if expires <= 0 || expires > C.expires() {
+		expires = C.expires()
+	}
+
+	C.lock.Lock()
+	defer C.lock.Unlock()
+
+	if C.items == nil {
+		C.items = map[string]*list.Element{}
+		C.list = list.New()
+	}
+
+	var item = &localCacheItem{key, value, time.Now().Unix() + expires}
+
+	if e, ok := C.items[key]; ok {
+		e.Value = item
+		C.list.MoveToFront(e)
+		return
+	}
+
+	C.items[key] = C.list.PushFront(item)
+
+	for C.list.Len() > C.size() {
+		e := C.list.Back()
+		C.list.Remove(e)
+		delete(C.items, e.Value.(*localCacheItem).key)
+	}
+}
+
+func (C *LocalCacheConfig) Remove(key string) {
+
+	C.lock.Lock()
+	defer C.lock.Unlock()
+
+	if C.items == nil {
+		return
+	}
+
+	if e, ok := C.items[key]; ok {
+		C.list.Remove(e)
+		delete(C.items, key)
+	}
+}
+
+/**
+ * 通知其他实例删除本地缓存, 失败只记录日志
+ */
+func (C *LocalCacheConfig) broadcast(a *UserApp, keys []string) {
+
+	if C.Broadcast == "" || len(keys) == 0 {
+		return
+	}
+
+	b, err := json.Encode(&LocalCacheInvalidateMessage{C.Origin(), keys})
+
+	if err != nil {
+		log.Println("[LocalCacheConfig][broadcast]" + err.Error())
+		return
+	}
+
+	var task = remote.RemoteSendMessageTask{}
+
+	task.Message = kk.Message{Method: "MESSAGE", To: C.Broadcast, Type: "text/json", Content: b}
+
+	err = app.Handle(a, &task)
+
+	if err == nil && task.Result.Errno != 0 {
+		log.Println("[LocalCacheConfig][broadcast]" + task.Result.Errmsg)
+	} else if err != nil {
+		log.Println("[LocalCacheConfig][broadcast]" + err.Error())
+	}
+}
+
+/**
+ * 订阅其他实例的失效广播, 收到后由 User.Cache.Invalidate 删除本地缓存
+ * 断开后 1 秒重连
+ */
+func (C *LocalCacheConfig) Subscribe(a *UserApp) {
+
+	if C.Broadcast == "" || C.Address == "" {
+		return
+	}
+
+	kk.GetDispatchMain().Async(func() {
+		C.subscribe(a)
+	})
+}
+
+func (C *LocalCacheConfig) subscribe(a *UserApp) {
+
+	var client = kk.NewTCPClient(C.Broadcast+"*", C.Address, map[string]interface{}{})
+
+	client.OnMessage = func(message *kk.Message) {
+
+		task, ok := decodeCacheInvalidateMessage(message)
+
+		if ok {
+			app.Handle(a, task)
+		}
+	}
+
+	client.OnDisconnected = func(err error) {
+
+		log.Println("[LocalCacheConfig][subscribe]" + err.Error())
+
+		kk.GetDispatchMain().AsyncDelay(func() {
+			C.subscribe(a)
+		}, time.Second)
+	}
+}
+
+/**
+ * 失效广播转换为 User.Cache.Invalidate, 不是广播消息时返回 false
+ */
+func decodeCacheInvalidateMessage(message *kk.Message) (*UserCacheInvalidateTask, bool) {
+
+	if message.Method != "MESSAGE" {
+		return nil, false
+	}
+
+	var m = LocalCacheInvalidateMessage{}
+
+	err := json.Decode(message.Content, &m)
+
+	if err != nil {
+		log.Println("[decodeCacheInvalidateMessage]" + err.Error())
+		return nil, false
+	}
+
+	var task = UserCacheInvalidateTask{}
+
+	task.Origin = m.Origin
+	task.Keys = m.Keys
+
+	return &task, true
+}
+
+/**
+ * 合并同一个键的并发加载, 只有第一个调用执行 fn, 其余等待并共享结果
+ */
+type loadCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+type loadGroup struct {
+	lock  sync.Mutex
+	calls map[string]*loadCall
+}
+
+var cacheLoadGroup = loadGroup{}
+
+func (G *loadGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+
+	G.lock.Lock()
+
+	if G.calls == nil {
+		G.calls = map[string]*loadCall{}
+	}
+
+	if c, ok := G.calls[key]; ok {
+		G.lock.Unlock()
+		c.wg.Wait()
+		return c.value, c.err
+	}
+
+	var c = &loadCall{}
+
+	c.wg.Add(1)
+	G.calls[key] = c
+
+	G.lock.Unlock()
+
+	/**
+	 * fn panic 时也要唤醒等待者, 等待者收到错误而不是空结果
+	 */
+	defer func() {
+		G.lock.Lock()
+		delete(G.calls, key)
+		G.lock.Unlock()
+		c.wg.Done()
+	}()
+
+	c.err = fmt.Errorf("The load of %s did not complete", key)
+
+	c.value, c.err = fn()
+
+	return c.value, c.err
+}
+
+const CacheValueNotFound = "-" // 不存在的标记, 用于短时的否定缓存
+
+var cacheRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var cacheRandLock = sync.Mutex{}
+
+func cacheRandFloat64() float64 {
+	cacheRandLock.Lock()
+	defer cacheRandLock.Unlock()
+	return cacheRand.Float64()
+}
+
+/**
+ * 写入缓存的值前加上到期时间 "etime|value", 用于提前刷新
+ * 没有前缀的值按原样返回, 到期时间为 0
+ */
+func encodeCacheValue(value string, etime int64) string {
+	return strconv.FormatInt(etime, 10) + "|" + value
+}
+
+func decodeCacheValue(s string) (string, int64) {
+
+	i := strings.IndexByte(s, '|')
+
+	if i > 0 {
+		etime, err := strconv.ParseInt(s[0:i], 10, 64)
+		if err == nil {
+			return s[i+1:], etime
+		}
+	}
+
+	return s, 0
+}
+
+/**
+ * 概率提前刷新 (XFetch), 越接近到期越可能返回 true
+ * 只有被选中的调用方重新加载, 其余继续使用缓存的值
+ */
+func cacheShouldRefresh(a *UserApp, etime int64) bool {
+
+	if a.EarlyRefresh <= 0 || etime <= 0 {
+		return false
+	}
+
+	var now = float64(time.Now().UnixNano()) / float64(time.Second)
+	var r = cacheRandFloat64()
+
+	if r <= 0 {
+		return true
+	}
+
+	return now-float64(a.EarlyRefresh)*math.Log(r) >= float64(etime)
+}
+
+/**
+ * ClientCache 中值的格式版本, 作为键的前缀
+ * 值为 "etime|value" 后与旧版本不兼容, 换用新的键, 滚动升级期间新旧实例不读取对方写入的值
+ * 删除时同时删除旧版本的键, 旧实例写入后只删除旧的键, 新实例最多 Expires 秒后读到变更
+ */
+const CacheValueVersion = "v2"
+
+func clientCacheKey(key string) string {
+	return CacheValueVersion + "/" + key
+}
+
+/**
+ * 先读本地缓存, 再读 ClientCache, 命中 ClientCache 时写入本地缓存
+ * refresh 为 true 时调用方应重新加载并写入缓存
+ */
+/**
+ * 只查本地缓存, ok 为是否命中
+ */
+func getLocalCacheValue(a *UserApp, key string) (value string, refresh bool, ok bool) {
+
+	if a.LocalCache == nil {
+		return "", false, false
+	}
+
+	v, ok := a.LocalCache.Get(key)
+
+	if !ok {
+		return "", false, false
+	}
+
+	value, etime := decodeCacheValue(v)
+
+	return value, cacheShouldRefresh(a, etime), true
+}
+
+func GetCacheValueWithRefresh(a *UserApp, key string) (value string, refresh bool) {
+
+	if value, refresh, ok := getLocalCacheValue(a, key); ok {
+		return value, refresh
+	}
+
+	var cache = cache.CacheTask{}
+
+	cache.Key = clientCacheKey(key)
+
+	var err = app.Handle(a, &cache)
+
+	if err == nil && cache.Result.Errno == 0 && cache.Result.Value != "" {
+
+		value, etime := decodeCacheValue(cache.Result.Value)
+
+		if a.LocalCache != nil {
+			var expires = a.Expires
+			if etime > 0 {
+				expires = etime - time.Now().Unix()
+			}
+			if expires > 0 {
+				a.LocalCache.Set(key, cache.Result.Value, expires)
+			}
+		}
+
+		return value, cacheShouldRefresh(a, etime)
+	}
+
+	return "", false
+}
+
+func GetCacheValue(a *UserApp, key string) string {
+	value, _ := GetCacheValueWithRefresh(a, key)
+	return value
+}
+
+/**
+ * 写入本地缓存和 ClientCache, 缓存时间加上 0 ~ ExpiresJitter 秒的随机值 (不超过缓存时间), 避免同时到期
+ */
+func SetCacheValue(a *UserApp, key string, value string, expires int64) {
+
+	var jitter = a.ExpiresJitter
+
+	if jitter > expires {
+		jitter = expires
+	}
+
+	if jitter > 0 {
+		expires = expires + int64(cacheRandFloat64()*float64(jitter+1))
+	}
+
+	var v = encodeCacheValue(value, time.Now().Unix()+expires)
+
+	if a.LocalCache != nil {
+		a.LocalCache.Set(key, v, expires)
+	}
+
+	var cache = cache.CacheSetTask{}
+
+	cache.Key = clientCacheKey(key)
+	cache.Value = v
+	cache.Expires = expires
+
+	app.Handle(a, &cache)
+}
+
+/**
+ * 缓存失效计数, 删除键或收到其他实例的失效广播时加一
+ * 读数据库后回填缓存前比较计数, 读取期间发生过失效时不回填, 避免旧值在删除之后写入
+ */
+var cacheInvalidations int64 = 0
+
+func CacheInvalidations() int64 {
+	return atomic.LoadInt64(&cacheInvalidations)
+}
+
+/**
+ * 回填读数据库得到的值, invalidations 为读数据库前的失效计数
+ * 读取期间有失效时不写入, 写入后才发生的失效删除刚写入的值
+ */
+func fillCacheValue(a *UserApp, key string, value string, expires int64, invalidations int64) {
+
+	if CacheInvalidations() != invalidations {
+		return
+	}
+
+	SetCacheValue(a, key, value, expires)
+
+	if CacheInvalidations() != invalidations {
+		RemoveCacheValues(a, key)
+	}
+}
+
+/**
+ * 删除本地和 ClientCache 中的键, 并广播给其他实例
+ */
+func RemoveCacheValues(a *UserApp, keys ...string) {
+
+	atomic.AddInt64(&cacheInvalidations, 1)
+
+	for _, key := range keys {
+
+		if a.LocalCache != nil {
+			a.LocalCache.Remove(key)
+		}
+
+		for _, k := range []string{clientCacheKey(key), key} {
+			var cache = cache.CacheRemoveTask{}
+			cache.Key = k
+			app.Handle(a, &cache)
+		}
+	}
+
+	if a.LocalCache != nil {
+		a.LocalCache.broadcast(a, keys)
+	}
+}
+
+func (S *UserService) HandleUserCacheInvalidateTask(a *UserApp, task *UserCacheInvalidateTask) error {
+
+	if a.LocalCache == nil || task.Origin == a.LocalCache.Origin() {
+		return nil
+	}
+
+	atomic.AddInt64(&cacheInvalidations, 1)
+
+	for _, key := range task.Keys {
+		a.LocalCache.Remove(key)
+	}
+
+	return nil
+}
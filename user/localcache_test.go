@@ -0,0 +1,184 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFillCacheValueSkipsStaleLoad(t *testing.T) {
+
+	var a = UserApp{Expires: 60, LocalCache: &LocalCacheConfig{Expires: 60}}
+
+	var invalidations = CacheInvalidations()
+
+	RemoveCacheValues(&a, "k")
+
+	fillCacheValue(&a, "k", "stale", 60, invalidations)
+
+	if v, ok := a.LocalCache.Get("k"); ok {
+		t.Fatalf("stale value %q filled after invalidation", v)
+	}
+
+	fillCacheValue(&a, "k", "fresh", 60, CacheInvalidations())
+
+	if GetCacheValue(&a, "k") != "fresh" {
+		t.Fatal("value not filled")
+	}
+}
+
+func TestLocalCacheLRU(t *testing.T) {
+
+	var C = LocalCacheConfig{Size: 2, Expires: 60}
+
+	C.Set("a", "1", 60)
+	C.Set("b", "2", 60)
+
+	if v, ok := C.Get("a"); !ok || v != "1" {
+		t.Fatalf("a %q %v", v, ok)
+	}
+
+	C.Set("c", "3", 60)
+
+	if _, ok := C.Get("b"); ok {
+		t.Fatal("least recently used b not evicted")
+	}
+
+	if _, ok := C.Get("a"); !ok {
+		t.Fatal("a evicted")
+	}
+
+	C.Set("a", "4", 60)
+
+	if v, _ := C.Get("a"); v != "4" || C.list.Len() != 2 {
+		t.Fatalf("a %q len %d", v, C.list.Len())
+	}
+
+	C.Remove("a")
+
+	if _, ok := C.Get("a"); ok {
+		t.Fatal("a not removed")
+	}
+
+	C.items["c"].Value.(*localCacheItem).expires = 0
+
+	if _, ok := C.Get("c"); ok || C.list.Len() != 0 {
+		t.Fatal("expired c returned")
+	}
+}
+
+func TestLoadGroup(t *testing.T) {
+
+	var G = loadGroup{}
+	var calls int32 = 0
+	var start = make(chan bool)
+	var wg = sync.WaitGroup{}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := G.Do("k", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-start
+				return "v", nil
+			})
+			if v != "v" || err != nil {
+				t.Errorf("Do %v %v", v, err)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(start)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("calls %d", calls)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic not propagated")
+			}
+		}()
+		G.Do("p", func() (interface{}, error) {
+			panic("load")
+		})
+	}()
+
+	if len(G.calls) != 0 {
+		t.Fatal("panicked call not removed")
+	}
+
+	v, err := G.Do("p", func() (interface{}, error) {
+		return "ok", nil
+	})
+
+	if v != "ok" || err != nil {
+		t.Fatalf("Do after panic %v %v", v, err)
+	}
+}
+
+func TestCacheInvalidateBroadcast(t *testing.T) {
+
+	var a = UserApp{LocalCache: &LocalCacheConfig{Expires: 60}}
+	var S = UserService{}
+
+	a.LocalCache.Set("k", "v", 60)
+
+	b, _ := json.Encode(&LocalCacheInvalidateMessage{a.LocalCache.Origin(), []string{"k"}})
+
+	task, ok := decodeCacheInvalidateMessage(&kk.Message{Method: "MESSAGE", Type: "text/json", Content: b})
+
+	if !ok {
+		t.Fatal("message not decoded")
+	}
+
+	S.HandleUserCacheInvalidateTask(&a, task)
+
+	if _, ok := a.LocalCache.Get("k"); !ok {
+		t.Fatal("own broadcast removed the key")
+	}
+
+	b, _ = json.Encode(&LocalCacheInvalidateMessage{"other", []string{"k"}})
+
+	task, ok = decodeCacheInvalidateMessage(&kk.Message{Method: "MESSAGE", Type: "text/json", Content: b})
+
+	if !ok || task.Origin != "other" {
+		t.Fatal("message not decoded")
+	}
+
+	S.HandleUserCacheInvalidateTask(&a, task)
+
+	if _, ok := a.LocalCache.Get("k"); ok {
+		t.Fatal("key not removed by broadcast")
+	}
+
+	if _, ok = decodeCacheInvalidateMessage(&kk.Message{Method: "REQUEST", Content: b}); ok {
+		t.Fatal("request decoded as broadcast")
+	}
+}
+
+func TestCacheValueFormat(t *testing.T) {
+
+	if clientCacheKey("user/options.0.1.app") != "v2/user/options.0.1.app" {
+		t.Fatal(clientCacheKey("user/options.0.1.app"))
+	}
+
+	value, etime := decodeCacheValue(encodeCacheValue("a|b", 100))
+
+	if value != "a|b" || etime != 100 {
+		t.Fatalf("%q %d", value, etime)
+	}
+
+	value, etime = decodeCacheValue("{\"id\":1}")
+
+	if value != "{\"id\":1}" || etime != 0 {
+		t.Fatalf("%q %d", value, etime)
+	}
+}
@@ -0,0 +1,486 @@
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-cache/cache"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/app"
+	"github.com/kkserver/kk-lib/kk/json"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+/**
+ * 登录失败锁定
+ * 连续失败 MaxFailures 次后锁定 LockTime 秒, 每次再锁定时长加倍, 不超过 MaxLockTime
+ * 计数优先保存在缓存, 缓存不可用时保存在 UserLockoutTable
+ */
+type LockoutConfig struct {
+	MaxFailures     int64 // 按账号
+	AddrMaxFailures int64 // 按来源地址
+	Window          int64 // 失败计数有效期 (秒)
+	LockTime        int64
+	MaxLockTime     int64
+	CacheKey        string
+}
+
+type UserLockout struct {
+	Id    int64  `json:"id"`
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+	Locks int64  `json:"locks"`
+	Ltime int64  `json:"ltime"` // 锁定到期时间
+	Mtime int64  `json:"mtime"`
+}
+
+func LockoutUidKey(uid int64) string {
+	return fmt.Sprintf("uid.%d", uid)
+}
+
+func LockoutAddrKey(addr string) string {
+	return fmt.Sprintf("addr.%s", addr)
+}
+
+/**
+ * 缓存服务没有自增操作, 同一 key 的读改写在本实例内串行
+ */
+var lockoutLocks [64]sync.Mutex
+
+func lockoutLock(key string) *sync.Mutex {
+	var h = fnv.New32a()
+	h.Write([]byte(key))
+	return &lockoutLocks[h.Sum32()%uint32(len(lockoutLocks))]
+}
+
+func (C *LockoutConfig) cacheKey(key string) string {
+	return fmt.Sprintf("%s.%s", C.CacheKey, key)
+}
+
+/**
+ * 读缓存, 未配置缓存, 缓存不可用或未命中时返回 false
+ */
+func (C *LockoutConfig) getCache(a *UserApp, key string) (*UserLockout, bool) {
+
+	if C.CacheKey == "" {
+		return nil, false
+	}
+
+	var cache = cache.CacheTask{}
+	cache.Key = C.cacheKey(key)
+
+	var err = app.Handle(a, &cache)
+
+	if err != nil || cache.Result.Errno != 0 || cache.Result.Value == "" {
+		return nil, false
+	}
+
+	var v = UserLockout{}
+
+	if json.Decode([]byte(cache.Result.Value), &v) != nil {
+		return nil, false
+	}
+
+	return &v, true
+}
+
+/**
+ * 写缓存, 未配置缓存或缓存不可用时返回 false
+ */
+func (C *LockoutConfig) setCache(a *UserApp, v *UserLockout) bool {
+
+	if C.CacheKey == "" {
+		return false
+	}
+
+	var expires = C.Window
+
+	if v.Ltime-v.Mtime > expires {
+		expires = v.Ltime - v.Mtime
+	}
+
+	b, err := json.Encode(v)
+
+	if err != nil {
+		return false
+	}
+
+	var cache = cache.CacheSetTask{}
+	cache.Key = C.cacheKey(v.Key)
+	cache.Value = string(b)
+	cache.Expires = expires
+
+	err = app.Handle(a, &cache)
+
+	return err == nil && cache.Result.Errno == 0
+}
+
+func (C *LockoutConfig) getDB(a *UserApp, db kk.Database, key string, forUpdate bool) (*UserLockout, error) {
+
+	var v = UserLockout{}
+	var scanner = kk.NewDBScaner(&v)
+	var where = " WHERE `key`=?"
+
+	if forUpdate {
+		where = where + " FOR UPDATE"
+	}
+
+	rows, err := kk.DBQuery(db, &a.UserLockoutTable, a.DB.Prefix, where, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &v, nil
+	}
+
+	return nil, nil
+}
+
+/**
+ * 先读缓存, 缓存不可用或未命中时读数据库
+ */
+func (C *LockoutConfig) get(a *UserApp, db *sql.DB, key string) (*UserLockout, error) {
+
+	if v, ok := C.getCache(a, key); ok {
+		return v, nil
+	}
+
+	return C.getDB(a, db, key, false)
+}
+
+func (C *LockoutConfig) clear(a *UserApp, db *sql.DB, key string) error {
+
+	if C.CacheKey != "" {
+		var cache = cache.CacheRemoveTask{}
+		cache.Key = C.cacheKey(key)
+		app.Handle(a, &cache)
+	}
+
+	_, err := db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE `key`=?", a.DB.Prefix, a.UserLockoutTable.Name), key)
+
+	return err
+}
+
+/**
+ * 返回剩余锁定秒数, 0 表示未锁定
+ */
+func (C *LockoutConfig) RetryAfter(a *UserApp, db *sql.DB, keys ...string) (int64, error) {
+
+	if C == nil {
+		return 0, nil
+	}
+
+	var now = time.Now().Unix()
+	var retryAfter int64 = 0
+
+	for _, key := range keys {
+
+		v, err := C.get(a, db, key)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if v != nil && v.Ltime-now > retryAfter {
+			retryAfter = v.Ltime - now
+		}
+	}
+
+	return retryAfter, nil
+}
+
+/**
+ * 计数加一, 达到上限时锁定
+ */
+func (C *LockoutConfig) incr(v *UserLockout, now int64, max int64) {
+
+	if v.Ltime <= now && now-v.Mtime > C.Window {
+		v.Count = 0
+		v.Locks = 0
+	}
+
+	v.Count = v.Count + 1
+	v.Mtime = now
+
+	if v.Count >= max {
+
+		var lockTime = C.LockTime
+
+		if lockTime <= 0 {
+			lockTime = 60
+		}
+
+		for i := int64(0); i < v.Locks && (C.MaxLockTime <= 0 || lockTime < C.MaxLockTime); i++ {
+			lockTime = lockTime * 2
+		}
+
+		if C.MaxLockTime > 0 && lockTime > C.MaxLockTime {
+			lockTime = C.MaxLockTime
+		}
+
+		v.Count = 0
+		v.Locks = v.Locks + 1
+		v.Ltime = now + lockTime
+	}
+}
+
+/**
+ * 缓存中计数, 缓存未命中时以数据库中的计数为起点, 写入缓存后删除数据库中的计数
+ * 缓存不可用时返回 false, 由数据库计数
+ */
+func (C *LockoutConfig) failCache(a *UserApp, db *sql.DB, key string, max int64, now int64) (*UserLockout, bool, error) {
+
+	if C.CacheKey == "" {
+		return nil, false, nil
+	}
+
+	var lock = lockoutLock(key)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	v, ok := C.getCache(a, key)
+
+	if !ok {
+
+		r, err := C.getDB(a, db, key, false)
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		if r == nil {
+			v = &UserLockout{Key: key}
+		} else {
+			v = r
+		}
+	}
+
+	C.incr(v, now, max)
+
+	if !C.setCache(a, v) {
+		return nil, false, nil
+	}
+
+	if v.Id != 0 {
+		_, err := db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE `key`=?", a.DB.Prefix, a.UserLockoutTable.Name), key)
+		if err != nil {
+			return nil, false, err
+		}
+		v.Id = 0
+	}
+
+	return v, true, nil
+}
+
+/**
+ * 数据库中计数, 计数行依赖 key 的唯一索引预先插入, 在事务中加行锁读改写, 多实例并发失败不会丢失计数
+ */
+func (C *LockoutConfig) failDB(a *UserApp, db *sql.DB, key string, max int64, now int64) (*UserLockout, error) {
+
+	_, err := db.Exec(fmt.Sprintf("INSERT INTO %s%s (`key`,`count`,`locks`,`ltime`,`mtime`) VALUES (?,0,0,0,?) ON DUPLICATE KEY UPDATE id=id", a.DB.Prefix, a.UserLockoutTable.Name), key, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := C.getDB(a, tx, key, true)
+
+	if err == nil && v == nil {
+		err = fmt.Errorf("Not found lockout %s", key)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	C.incr(v, now, max)
+
+	_, err = kk.DBUpdate(tx, &a.UserLockoutTable, a.DB.Prefix, v)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+/**
+ * 记录一次失败, 达到上限时锁定, 返回剩余锁定秒数
+ * 计数在保存它的一层中读改写: 缓存可用时在缓存中 (本实例内按 key 串行), 否则在数据库事务中
+ */
+func (C *LockoutConfig) Fail(a *UserApp, db *sql.DB, key string, max int64) (int64, error) {
+
+	if C == nil || max <= 0 {
+		return 0, nil
+	}
+
+	var now = time.Now().Unix()
+
+	v, ok, err := C.failCache(a, db, key, max, now)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+
+		v, err = C.failDB(a, db, key, max, now)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if v.Ltime > now {
+		return v.Ltime - now, nil
+	}
+
+	return 0, nil
+}
+
+func (C *LockoutConfig) Clear(a *UserApp, db *sql.DB, keys ...string) error {
+
+	if C == nil {
+		return nil
+	}
+
+	for _, key := range keys {
+		err := C.clear(a, db, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+ * 密码错误时调用, 按账号和来源地址计数
+ */
+func (C *LockoutConfig) FailPassword(a *UserApp, db *sql.DB, uid int64, addr string) (int64, error) {
+
+	if C == nil {
+		return 0, nil
+	}
+
+	retryAfter, err := C.Fail(a, db, LockoutUidKey(uid), C.MaxFailures)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if addr != "" {
+
+		r, err := C.Fail(a, db, LockoutAddrKey(addr), C.AddrMaxFailures)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if r > retryAfter {
+			retryAfter = r
+		}
+	}
+
+	return retryAfter, nil
+}
+
+/**
+ * 密码正确时调用, 清除账号和来源地址的失败计数
+ */
+func (C *LockoutConfig) ClearPassword(a *UserApp, db *sql.DB, uid int64, addr string) error {
+
+	if addr == "" {
+		return C.Clear(a, db, LockoutUidKey(uid))
+	}
+
+	return C.Clear(a, db, LockoutUidKey(uid), LockoutAddrKey(addr))
+}
+
+func (C *LockoutConfig) FailAddr(a *UserApp, db *sql.DB, addr string) (int64, error) {
+
+	if C == nil {
+		return 0, nil
+	}
+
+	return C.Fail(a, db, LockoutAddrKey(addr), C.AddrMaxFailures)
+}
+
+func (S *UserService) HandleUserUnlockTask(a *UserApp, task *UserUnlockTask) error {
+
+	if task.Uid == 0 && task.Addr == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var keys = []string{}
+
+	if task.Uid != 0 {
+
+		u, err := getTenantUser(a, db, task.Tid, task.Uid)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if u == nil {
+			task.Result.Errno = ERROR_USER_NOT_FOUND
+			task.Result.Errmsg = "Not found user"
+			return nil
+		}
+
+		keys = append(keys, LockoutUidKey(task.Uid))
+	}
+
+	if task.Addr != "" {
+		keys = append(keys, LockoutAddrKey(task.Addr))
+	}
+
+	err = a.Lockout.Clear(a, db, keys...)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package user
+
+import (
+	"fmt"
+	"github.com/kkserver/kk-lib/kk/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const NotificationTypePasswordReset = "password.reset"
+const NotificationTypeVerifyEmail = UserChallengeTypeVerify + UserIdentifierEmail
+const NotificationTypeVerifyPhone = UserChallengeTypeVerify + UserIdentifierPhone
+
+/**
+ * 发给用户的通知 (重置密码, 验证码等), Token 为明文, 只交给通知渠道
+ */
+type Notification struct {
+	Type    string `json:"type"`
+	Uid     int64  `json:"uid"`
+	Name    string `json:"name"`
+	To      string `json:"to,omitempty"`
+	Token   string `json:"token"`
+	Code    string `json:"code,omitempty"`
+	Expires int64  `json:"expires"`
+	Ctime   int64  `json:"ctime"`
+}
+
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+/**
+ * Type: log (未配置时), file
+ * log 只记录通知, Token 和 Code 以 [REDACTED] 代替, 用户收不到重置链接和验证码, 不能用于生产
+ * file 以 JSON 行追加到 Path (含明文 Token), 由外部投递进程读取发送, 也用于离线环境和测试
+ */
+type NotifierConfig struct {
+	Type string
+	Path string
+
+	once     sync.Once
+	notifier Notifier
+}
+
+func (C *NotifierConfig) Get() Notifier {
+
+	if C == nil {
+		return &LogNotifier{}
+	}
+
+	C.once.Do(func() {
+		if C.Type == "file" && C.Path != "" {
+			C.notifier = &FileNotifier{Path: C.Path}
+		} else {
+			C.notifier = &LogNotifier{}
+		}
+	})
+
+	return C.notifier
+}
+
+type LogNotifier struct {
+}
+
+func (N *LogNotifier) Notify(n *Notification) error {
+
+	var v = *n
+
+	if v.Token != "" {
+		v.Token = UserAuditRedacted
+	}
+
+	if v.Code != "" {
+		v.Code = UserAuditRedacted
+	}
+
+	b, err := json.Encode(&v)
+	if err != nil {
+		return err
+	}
+	log.Println("[Notify]" + string(b))
+	return nil
+}
+
+type FileNotifier struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+func (N *FileNotifier) Notify(n *Notification) error {
+
+	b, err := json.Encode(n)
+
+	if err != nil {
+		return err
+	}
+
+	N.lock.Lock()
+	defer N.lock.Unlock()
+
+	fd, err := os.OpenFile(N.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	_, err = fd.Write(append(b, '\n'))
+
+	return err
+}
+
+func Notify(a *UserApp, n *Notification) error {
+
+	if n.Ctime == 0 {
+		n.Ctime = time.Now().Unix()
+	}
+
+	err := a.Notifier.Get().Notify(n)
+
+	if err != nil {
+		return fmt.Errorf("notify %s: %s", n.Type, err.Error())
+	}
+
+	return nil
+}
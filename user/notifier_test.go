@@ -0,0 +1,56 @@
+package user
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogNotifierRedacts(t *testing.T) {
+
+	var buf bytes.Buffer
+
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	var n = Notification{Type: NotificationTypePasswordReset, Uid: 1, Token: "secret-token", Code: "123456"}
+
+	if err := (&LogNotifier{}).Notify(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), "secret-token") || strings.Contains(buf.String(), "123456") {
+		t.Fatalf("log contains secrets: %s", buf.String())
+	}
+
+	if n.Token != "secret-token" || n.Code != "123456" {
+		t.Fatal("notification modified")
+	}
+}
+
+func TestFileNotifier(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "notifier")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var C = NotifierConfig{Type: "file", Path: filepath.Join(dir, "outbox.log")}
+
+	if err = C.Get().Notify(&Notification{Type: NotificationTypeVerifyEmail, Token: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(C.Path)
+
+	if err != nil || !strings.Contains(string(b), `"token":"t1"`) {
+		t.Fatalf("file %s %v", b, err)
+	}
+}
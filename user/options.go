@@ -0,0 +1,899 @@
+package user
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const UserOptionsBatchMax = 100       // BatchGet/BatchSet 一次最多的配置数
+const UserOptionsCacheConcurrency = 8 // BatchGet 并发查询缓存的请求数
+
+/**
+ * 配置的摘要, Size 为配置内容的字节数
+ */
+type UserOptionsInfo struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int    `json:"size"`
+	Version int64  `json:"version"`
+	Mtime   int64  `json:"mtime"`
+}
+
+type UserOptionsItem struct {
+	Uid     int64       `json:"uid"`
+	Name    string      `json:"name"`
+	Type    string      `json:"type,omitempty"`
+	Options interface{} `json:"options,omitempty"`
+	Version int64       `json:"version"` // 0 表示配置不存在
+}
+
+/**
+ * 在事务中写入配置, 返回 true 表示遇到并发插入需要重试
+ * IfVersion > 0 时按版本比较后更新 (乐观锁), 否则锁定行后合并
+ * schema 由调用方在事务外读取, 不在持有行锁时访问数据库或文件
+ */
+func setUserOptions(a *UserApp, db *sql.DB, task *UserSetOptionsTask, schema map[string]interface{}, v *UserOptions, before *UserOptions) bool {
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return false
+	}
+
+	var retry = setUserOptionsTx(a, tx, task, schema, v, before)
+
+	if task.Result.Errno != 0 {
+		tx.Rollback()
+		return retry && task.IfVersion == 0
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		tx.Rollback()
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return false
+	}
+
+	return false
+}
+
+/**
+ * 在调用方的事务中写入一个配置, 失败时设置 task.Result, 由调用方回滚
+ * 返回 true 表示遇到并发插入, 回滚后可以重试
+ */
+func setUserOptionsTx(a *UserApp, tx *sql.Tx, task *UserSetOptionsTask, schema map[string]interface{}, v *UserOptions, before *UserOptions) bool {
+
+	var prefix = a.DB.Prefix
+	var scanner = kk.NewDBScaner(v)
+	var retry = false
+
+	func() {
+
+		/**
+		 * 先锁定用户行, 同一用户的配置写入串行执行
+		 * 配置不存在时 FOR UPDATE 只加间隙锁, 并发的首次写入会在插入时死锁
+		 */
+		var id int64 = 0
+
+		err := tx.QueryRow(fmt.Sprintf("SELECT id FROM %s%s WHERE id=? AND tid=? FOR UPDATE", prefix, a.UserTable.Name), task.Uid, task.Tid).Scan(&id)
+
+		if err == sql.ErrNoRows {
+			task.Result.Errno = ERROR_USER_NOT_FOUND
+			task.Result.Errmsg = "Not found user"
+			return
+		}
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+		var where = " WHERE tid=? AND uid=? AND name=?"
+
+		if task.IfVersion == 0 {
+			where = where + " FOR UPDATE"
+		}
+
+		rows, err := kk.DBQuery(tx, &a.UserOptionsTable, prefix, where, task.Tid, task.Uid, task.Name)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+		var exists = rows.Next()
+
+		if exists {
+			err = scanner.Scan(rows)
+		}
+
+		rows.Close()
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+		if task.IfVersion != 0 && (!exists || v.Version != task.IfVersion) {
+			task.Result.Errno = ERROR_USER_OPTIONS_CONFLICT
+			task.Result.Errmsg = fmt.Sprintf("The options version is %d, not %d", v.Version, task.IfVersion)
+			task.Result.Version = v.Version
+			return
+		}
+
+		if exists {
+
+			*before = *v
+
+			if task.Type != v.Type {
+				v.Type = task.Type
+				v.Options = ""
+			}
+
+		} else {
+			v.Type = task.Type
+			v.Tid = task.Tid
+			v.Uid = task.Uid
+			v.Name = task.Name
+		}
+
+		err = v.ApplyOptions(task.Mode, task.Options)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER_OPTIONS_PATCH
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+		if schema != nil {
+
+			var errors = ValidateJSONSchema(schema, v.GetOptions(), "")
+
+			if len(errors) > 0 {
+				task.Result.Errno = ERROR_USER_OPTIONS_INVALID
+				task.Result.Errmsg = formatUserOptionsSchemaErrors(errors)
+				task.Result.Errors = errors
+				return
+			}
+		}
+
+		v.Version = v.Version + 1
+		v.Mtime = time.Now().Unix()
+
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET mtime=? WHERE id=? AND tid=?", prefix, a.UserTable.Name), v.Mtime, task.Uid, task.Tid)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+		if exists {
+
+			r, err := tx.Exec(fmt.Sprintf("UPDATE %s%s SET type=?, options=?, version=?, mtime=? WHERE id=? AND version=?", prefix, a.UserOptionsTable.Name),
+				v.Type, v.Options, v.Version, v.Mtime, v.Id, before.Version)
+
+			var n int64 = 0
+
+			if err == nil {
+				n, err = r.RowsAffected()
+			}
+
+			if err != nil {
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+				return
+			}
+
+			if n == 0 {
+				task.Result.Errno = ERROR_USER_OPTIONS_CONFLICT
+				task.Result.Errmsg = "The options has been modified"
+				return
+			}
+
+		} else {
+
+			r, err := kk.DBInsert(tx, &a.UserOptionsTable, prefix, v)
+
+			if err == nil {
+				v.Id, err = r.LastInsertId()
+			}
+
+			if IsDuplicateKeyError(err) {
+				retry = true
+				task.Result.Errno = ERROR_USER_OPTIONS_CONFLICT
+				task.Result.Errmsg = "The options has been created"
+				return
+			}
+
+			if err != nil {
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+				return
+			}
+		}
+
+		err = WriteUserOptionsRevision(a, tx, v, task.Actor)
+
+		if err == nil {
+			err = WriteUserEvent(a, tx, v.Tid, v.Uid, UserEventOptionsChanged, v)
+		}
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+	}()
+
+	return retry
+}
+
+/**
+ * 先读缓存, 未命中时读数据库并写入缓存, 同一配置的并发读取只查询一次, 不存在返回 nil
+ * 不存在时写入 NegativeExpires 秒的否定缓存, 由 SetOptions 删除
+ */
+func LoadUserOptions(a *UserApp, db *sql.DB, tid int64, uid int64, name string) (*UserOptions, error) {
+
+	var key = OptionsCacheKey(a, tid, uid, name)
+
+	value, refresh := GetCacheValueWithRefresh(a, key)
+
+	if value == CacheValueNotFound && !refresh {
+		return nil, nil
+	}
+
+	if value != "" && value != CacheValueNotFound && !refresh {
+		var v = UserOptions{}
+		err := json.Decode([]byte(value), &v)
+		if err == nil {
+			return &v, nil
+		}
+	}
+
+	r, err := cacheLoadGroup.Do(key, func() (interface{}, error) {
+
+		var v = UserOptions{}
+		var scanner = kk.NewDBScaner(&v)
+		var invalidations = CacheInvalidations()
+
+		rows, err := kk.DBQuery(db, &a.UserOptionsTable, a.DB.Prefix, " WHERE tid=? AND uid=? AND name=?", tid, uid, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rows.Close()
+
+		if !rows.Next() {
+			if a.NegativeExpires > 0 {
+				fillCacheValue(a, key, CacheValueNotFound, a.NegativeExpires, invalidations)
+			}
+			return nil, nil
+		}
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		b, _ := json.Encode(&v)
+		fillCacheValue(a, key, string(b), a.Expires, invalidations)
+
+		return &v, nil
+	})
+
+	if err != nil || r == nil {
+		return nil, err
+	}
+
+	var v = *(r.(*UserOptions))
+
+	return &v, nil
+}
+
+func splitUserOptionsKeys(s string) []string {
+
+	var vs = []string{}
+	var set = map[string]bool{}
+
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" && !set[v] {
+			set[v] = true
+			vs = append(vs, v)
+		}
+	}
+
+	return vs
+}
+
+/**
+ * 查询缓存, 返回命中的配置和否定缓存命中的键, 键为 uid.name
+ * 先查本地缓存, 未命中的键由最多 UserOptionsCacheConcurrency 个协程查询 ClientCache (缓存服务只提供单键读取)
+ * 命中的部分不再查询数据库
+ */
+func getUserOptionsCaches(a *UserApp, tid int64, uids []int64, names []string) (map[string]UserOptions, map[string]bool) {
+
+	var keys = []string{}
+	var cacheKeys = []string{}
+
+	for _, uid := range uids {
+		for _, name := range names {
+			keys = append(keys, fmt.Sprintf("%d.%s", uid, name))
+			cacheKeys = append(cacheKeys, OptionsCacheKey(a, tid, uid, name))
+		}
+	}
+
+	var values = make([]string, len(keys))
+	var refreshs = make([]bool, len(keys))
+	var pending = []int{}
+
+	for i, key := range cacheKeys {
+		var ok bool
+		values[i], refreshs[i], ok = getLocalCacheValue(a, key)
+		if !ok {
+			pending = append(pending, i)
+		}
+	}
+
+	if len(pending) > 0 {
+
+		var workers = UserOptionsCacheConcurrency
+		var indexs = make(chan int, len(pending))
+		var wg = sync.WaitGroup{}
+
+		if workers > len(pending) {
+			workers = len(pending)
+		}
+
+		for _, i := range pending {
+			indexs <- i
+		}
+
+		close(indexs)
+
+		for n := 0; n < workers; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indexs {
+					values[i], refreshs[i] = GetCacheValueWithRefresh(a, cacheKeys[i])
+				}
+			}()
+		}
+
+		wg.Wait()
+	}
+
+	var vs = map[string]UserOptions{}
+	var notfound = map[string]bool{}
+
+	for i, key := range keys {
+
+		if refreshs[i] {
+			continue
+		}
+
+		if values[i] == CacheValueNotFound {
+			notfound[key] = true
+		} else if values[i] != "" {
+			var v = UserOptions{}
+			err := json.Decode([]byte(values[i]), &v)
+			if err == nil {
+				vs[key] = v
+			}
+		}
+	}
+
+	return vs, notfound
+}
+
+func (S *UserService) HandleUserOptionsListTask(a *UserApp, task *UserOptionsListTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var items = []UserOptionsInfo{}
+	var v = UserOptions{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserOptionsTable, a.DB.Prefix, " WHERE tid=? AND uid=? ORDER BY name ASC", task.Tid, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		items = append(items, UserOptionsInfo{v.Name, v.Type, len(v.Options), v.Version, v.Mtime})
+	}
+
+	task.Result.Options = items
+
+	return nil
+}
+
+/**
+ * 一个用户的多个配置 (Uid + Names), 或多个用户的同一配置 (Uids + Name)
+ * 先查缓存, 未命中的用一次 IN 查询, 结果按请求的顺序返回
+ */
+func (S *UserService) HandleUserOptionsBatchGetTask(a *UserApp, task *UserOptionsBatchGetTask) error {
+
+	var uids = []int64{}
+	var names = []string{}
+	var byUids = task.Uids != ""
+
+	if byUids {
+
+		if task.Name == "" {
+			task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+			task.Result.Errmsg = "Not found name"
+			return nil
+		}
+
+		for _, v := range splitUserOptionsKeys(task.Uids) {
+			uid, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || uid == 0 {
+				task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+				task.Result.Errmsg = fmt.Sprintf("Invalid uid %q", v)
+				return nil
+			}
+			uids = append(uids, uid)
+		}
+
+		names = append(names, task.Name)
+
+	} else {
+
+		if task.Uid == 0 {
+			task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+			task.Result.Errmsg = "Not found uid"
+			return nil
+		}
+
+		uids = append(uids, task.Uid)
+		names = splitUserOptionsKeys(task.Names)
+	}
+
+	if len(uids)*len(names) > UserOptionsBatchMax {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = fmt.Sprintf("Too many options, at most %d", UserOptionsBatchMax)
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var vs, notfound = getUserOptionsCaches(a, task.Tid, uids, names)
+	var misses = []interface{}{}
+
+	for _, uid := range uids {
+		for _, name := range names {
+			var key = fmt.Sprintf("%d.%s", uid, name)
+			if _, ok := vs[key]; !ok && !notfound[key] {
+				if byUids {
+					misses = append(misses, uid)
+				} else {
+					misses = append(misses, name)
+				}
+			}
+		}
+	}
+
+	if len(misses) > 0 {
+
+		var prefix = a.DB.Prefix
+		var sql = bytes.NewBuffer(nil)
+		var args = []interface{}{task.Tid}
+
+		if byUids {
+			sql.WriteString(" WHERE tid=? AND name=? AND uid IN (")
+			args = append(args, names[0])
+		} else {
+			sql.WriteString(" WHERE tid=? AND uid=? AND name IN (")
+			args = append(args, uids[0])
+		}
+
+		for i, v := range misses {
+			if i != 0 {
+				sql.WriteString(",")
+			}
+			sql.WriteString("?")
+			args = append(args, v)
+		}
+
+		sql.WriteString(")")
+
+		var v = UserOptions{}
+		var scanner = kk.NewDBScaner(&v)
+		var invalidations = CacheInvalidations()
+
+		rows, err := kk.DBQuery(db, &a.UserOptionsTable, prefix, sql.String(), args...)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		for rows.Next() {
+
+			err = scanner.Scan(rows)
+
+			if err != nil {
+				rows.Close()
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+				return nil
+			}
+
+			vs[fmt.Sprintf("%d.%s", v.Uid, v.Name)] = v
+
+			{
+				b, _ := json.Encode(&v)
+				fillCacheValue(a, OptionsCacheKey(a, v.Tid, v.Uid, v.Name), string(b), a.Expires, invalidations)
+			}
+		}
+
+		rows.Close()
+
+		if a.NegativeExpires > 0 {
+			for _, uid := range uids {
+				for _, name := range names {
+					var key = fmt.Sprintf("%d.%s", uid, name)
+					if _, ok := vs[key]; !ok && !notfound[key] {
+						fillCacheValue(a, OptionsCacheKey(a, task.Tid, uid, name), CacheValueNotFound, a.NegativeExpires, invalidations)
+					}
+				}
+			}
+		}
+	}
+
+	var items = []UserOptionsItem{}
+
+	for _, uid := range uids {
+		for _, name := range names {
+
+			var item = UserOptionsItem{Uid: uid, Name: name}
+
+			if v, ok := vs[fmt.Sprintf("%d.%s", uid, name)]; ok {
+				item.Type = v.Type
+				item.Options = ApplyUserOptionsDefaults(a, db, name, v.GetOptions())
+				item.Version = v.Version
+			} else {
+				item.Options = ApplyUserOptionsDefaults(a, db, name, nil)
+			}
+
+			items = append(items, item)
+		}
+	}
+
+	task.Result.Options = items
+
+	return nil
+}
+
+/**
+ * 在一个事务中写入一个用户的多个配置, 任一失败 (含 Schema 校验) 全部不写入
+ * 按配置名排序后写入, 首次写入的并发冲突整体重试
+ */
+func (S *UserService) HandleUserOptionsBatchSetTask(a *UserApp, task *UserOptionsBatchSetTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	var names = []string{}
+
+	for name := range task.Options {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+		task.Result.Errmsg = "Not found options"
+		return nil
+	}
+
+	if len(names) > UserOptionsBatchMax {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = fmt.Sprintf("Too many options, at most %d", UserOptionsBatchMax)
+		return nil
+	}
+
+	sort.Strings(names)
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	u, err := LoadUser(a, db, task.Tid, task.Uid, "")
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if u == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
+
+	var schemas = []map[string]interface{}{}
+
+	for _, name := range names {
+
+		schema, err := GetUserOptionsSchema(a, db, name)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		schemas = append(schemas, schema)
+	}
+
+	var vs = make([]UserOptions, len(names))
+	var befores = make([]UserOptions, len(names))
+
+	for i := 0; i < 3; i++ {
+
+		tx, err := db.Begin()
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		var retry = false
+
+		for n, name := range names {
+
+			var set = UserSetOptionsTask{}
+
+			set.Tid = task.Tid
+			set.Uid = task.Uid
+			set.Name = name
+			set.Type = task.Type
+			set.Options = task.Options[name]
+			set.Mode = task.Mode
+			set.Actor = task.Actor
+			set.Source = task.Source
+
+			vs[n] = UserOptions{}
+			befores[n] = UserOptions{}
+
+			retry = setUserOptionsTx(a, tx, &set, schemas[n], &vs[n], &befores[n])
+
+			if set.Result.Errno != 0 {
+				task.Result.Errno = set.Result.Errno
+				task.Result.Errmsg = name + ": " + set.Result.Errmsg
+				task.Result.Name = name
+				task.Result.Errors = set.Result.Errors
+				break
+			}
+		}
+
+		if task.Result.Errno == 0 {
+			err = tx.Commit()
+			if err != nil {
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+			}
+		}
+
+		if task.Result.Errno == 0 {
+			break
+		}
+
+		tx.Rollback()
+
+		if !retry || i == 2 {
+			return nil
+		}
+
+		task.Result = UserOptionsBatchSetTaskResult{}
+	}
+
+	task.Result.Versions = map[string]int64{}
+
+	for n, name := range names {
+
+		var v = &vs[n]
+
+		task.Result.Versions[name] = v.Version
+
+		PruneUserOptionsRevisions(a, db, v)
+
+		WriteUserAudit(a, db, v.Tid, v.Uid, task.Actor, UserAuditActionSetOptions, NewUserOptionsAuditDiff(a, &befores[n], v), task.Source)
+
+		RemoveCacheValues(a, OptionsCacheKey(a, v.Tid, v.Uid, v.Name))
+	}
+
+	RemoveUserCache(a, task.Tid, task.Uid, "")
+
+	return nil
+}
+
+/**
+ * 删除配置并清除它的历史版本, 删除后无法 Rollback
+ * 重新创建时版本从 1 开始, 保留旧的历史版本会与新版本号冲突
+ * 审计日志记录删除前的配置和清除的历史版本数
+ */
+func (S *UserService) HandleUserOptionsDeleteTask(a *UserApp, task *UserOptionsDeleteTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	if task.Name == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+		task.Result.Errmsg = "Not found name"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+	var v = UserOptions{}
+	var scanner = kk.NewDBScaner(&v)
+	var revisions int64 = 0
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	func() {
+
+		rows, err := kk.DBQuery(tx, &a.UserOptionsTable, prefix, " WHERE tid=? AND uid=? AND name=? FOR UPDATE", task.Tid, task.Uid, task.Name)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+		var exists = rows.Next()
+
+		if exists {
+			err = scanner.Scan(rows)
+		}
+
+		rows.Close()
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+		if !exists {
+			task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+			task.Result.Errmsg = "Not found options"
+			return
+		}
+
+		if task.IfVersion != 0 && v.Version != task.IfVersion {
+			task.Result.Errno = ERROR_USER_OPTIONS_CONFLICT
+			task.Result.Errmsg = fmt.Sprintf("The options version is %d, not %d", v.Version, task.IfVersion)
+			return
+		}
+
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE id=?", prefix, a.UserOptionsTable.Name), v.Id)
+
+		if err == nil {
+			var r sql.Result = nil
+			r, err = tx.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE oid=?", prefix, a.UserOptionsRevisionTable.Name), v.Id)
+			if err == nil {
+				revisions, err = r.RowsAffected()
+			}
+		}
+
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET mtime=? WHERE id=? AND tid=?", prefix, a.UserTable.Name), time.Now().Unix(), task.Uid, task.Tid)
+		}
+
+		if err == nil {
+			err = WriteUserEvent(a, tx, v.Tid, v.Uid, UserEventOptionsDeleted, &v)
+		}
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+	}()
+
+	if task.Result.Errno != 0 {
+		tx.Rollback()
+		return nil
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		tx.Rollback()
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	RemoveUserCache(a, v.Tid, v.Uid, "")
+
+	WriteUserAudit(a, db, v.Tid, v.Uid, task.Actor, UserAuditActionDeleteOptions, NewUserOptionsAuditDiff(a, &v, &UserOptions{Name: v.Name, Type: v.Type}).Set("revisions", revisions, 0), task.Source)
+
+	RemoveCacheValues(a, OptionsCacheKey(a, v.Tid, v.Uid, v.Name))
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package user
+
+import (
+	"fmt"
+	"github.com/kkserver/kk-lib/kk/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetUserOptionsCaches(t *testing.T) {
+
+	var a = UserApp{CacheKey: "test.options", Expires: 60, LocalCache: &LocalCacheConfig{Expires: 60}}
+	var uids = []int64{}
+
+	for uid := int64(1); uid <= 20; uid++ {
+
+		uids = append(uids, uid)
+
+		if uid%2 == 0 {
+			b, _ := json.Encode(&UserOptions{Uid: uid, Name: "app", Type: UserOptionsTypeJson, Options: `{"a":1}`, Version: uid})
+			SetCacheValue(&a, OptionsCacheKey(&a, 0, uid, "app"), string(b), 60)
+		} else if uid%3 == 0 {
+			SetCacheValue(&a, OptionsCacheKey(&a, 0, uid, "app"), CacheValueNotFound, 60)
+		}
+	}
+
+	vs, notfound := getUserOptionsCaches(&a, 0, uids, []string{"app"})
+
+	for _, uid := range uids {
+
+		var key = fmt.Sprintf("%d.app", uid)
+		v, ok := vs[key]
+
+		if uid%2 == 0 {
+			if !ok || v.Version != uid {
+				t.Errorf("%s: %v %v", key, v, ok)
+			}
+		} else if uid%3 == 0 {
+			if ok || !notfound[key] {
+				t.Errorf("%s: want not found", key)
+			}
+		} else if ok || notfound[key] {
+			t.Errorf("%s: want miss", key)
+		}
+	}
+
+	a.LocalCache = nil
+
+	vs, notfound = getUserOptionsCaches(&a, 0, uids, []string{"app", "other"})
+
+	if len(vs) != 0 || len(notfound) != 0 {
+		t.Fatalf("ClientCache misses: %v %v", vs, notfound)
+	}
+}
+
+func TestUserOptionsBatchSet(t *testing.T) {
+
+	a, db := newTestUserApp(t)
+
+	dir, err := ioutil.TempDir("", "schema")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var path = filepath.Join(dir, "b.json")
+
+	if err = ioutil.WriteFile(path, []byte(`{"type":"object","properties":{"size":{"type":"integer"}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a.OptionsSchemas = map[string]interface{}{"b": path}
+
+	defer removeUserOptionsSchemaCache("b")
+
+	var S = UserService{}
+	var create = UserCreateTask{Name: "batch", Password: "123456"}
+
+	S.HandleUserCreateTask(a, &create)
+
+	if create.Result.Errno != 0 {
+		t.Fatal(create.Result.Errmsg)
+	}
+
+	var uid = create.Result.User.Id
+
+	var task = UserOptionsBatchSetTask{Uid: uid, Type: UserOptionsTypeJson, Options: map[string]interface{}{
+		"a": map[string]interface{}{"x": 1},
+		"b": map[string]interface{}{"size": "large"},
+	}}
+
+	S.HandleUserOptionsBatchSetTask(a, &task)
+
+	if task.Result.Errno != ERROR_USER_OPTIONS_INVALID || task.Result.Name != "b" {
+		t.Fatalf("errno %d %s", task.Result.Errno, task.Result.Errmsg)
+	}
+
+	v, err := LoadUserOptions(a, db, 0, uid, "a")
+
+	if err != nil || v != nil {
+		t.Fatalf("options a written by a failed batch: %v %v", v, err)
+	}
+
+	task = UserOptionsBatchSetTask{Uid: uid, Type: UserOptionsTypeJson, Options: map[string]interface{}{
+		"a": map[string]interface{}{"x": 1},
+		"b": map[string]interface{}{"size": 12},
+	}}
+
+	S.HandleUserOptionsBatchSetTask(a, &task)
+
+	if task.Result.Errno != 0 {
+		t.Fatalf("errno %d %s", task.Result.Errno, task.Result.Errmsg)
+	}
+
+	if task.Result.Versions["a"] != 1 || task.Result.Versions["b"] != 1 {
+		t.Fatalf("versions %v", task.Result.Versions)
+	}
+}
@@ -0,0 +1,446 @@
+package user
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/app"
+	"github.com/kkserver/kk-lib/kk/app/remote"
+	"github.com/kkserver/kk-lib/kk/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const UserEventCreated = "user.created"
+const UserEventUpdated = "user.updated"
+const UserEventPasswordChanged = "user.password_changed"
+const UserEventOptionsChanged = "user.options_changed"
+const UserEventOptionsDeleted = "user.options_deleted"
+const UserEventDeleted = "user.deleted"
+
+const UserEventStatusPending = 0
+const UserEventStatusSent = 1
+const UserEventStatusFailed = 2
+
+/**
+ * 投递目标, 每个目标成功后记入 UserEvent.Sinks, 重试时跳过已成功的目标
+ */
+const UserEventSinkWebhooks = 1 // 订阅的 Webhook (写入投递队列)
+const UserEventSinkRemote = 2   // kk 消息通道
+const UserEventSinkWebhook = 4  // Outbox.Webhook
+
+/**
+ * 事件发件箱
+ * 事件与变更在同一事务中写入, 由分发器异步投递 (至少一次)
+ * 多个实例可同时运行分发器, 投递前先认领事件, 每个事件只由一个实例投递
+ */
+type OutboxConfig struct {
+	Interval   int64  // 轮询间隔 (秒), 默认 1
+	Limit      int    // 每次投递的事件数, 默认 100
+	MaxCount   int    // 最大投递次数, 超过后标记为失败, 默认 10
+	Retry      int64  // 重试退避基数 (秒), 默认 2, 按 Retry * 2^(Count-1) 递增
+	MaxRetry   int64  // 最大退避 (秒), 默认 600
+	To         string // kk 消息目标, 如 kk.message.user.
+	Webhook    string // 投递的 URL (POST JSON)
+	Timeout    int64  // Webhook 超时 (秒), 默认 5
+	KeepEvents int64  // 已投递事件的保留时间 (秒), 0 不清理
+	Lease      int64  // 认领的租期 (秒), 默认 300, 超时未完成的事件由其他实例重新投递
+}
+
+type UserEvent struct {
+	Id      int64  `json:"id"`
+	Tid     int64  `json:"tid"`
+	Uid     int64  `json:"uid"`
+	Name    string `json:"name"` // UserEvent*
+	Content string `json:"content"`
+	Status  int    `json:"status"`
+	Sinks   int    `json:"sinks"` // 已成功的投递目标 UserEventSink*
+	Count   int    `json:"count"` // 已投递次数
+	Ntime   int64  `json:"ntime"` // 下次投递时间, 认领后为租期到期时间
+	Owner   string `json:"-"`     // 认领的分发器
+	Ctime   int64  `json:"ctime"`
+	Stime   int64  `json:"stime,omitempty"` // 投递成功时间
+}
+
+/**
+ * 投递的消息体
+ */
+type UserEventMessage struct {
+	Id    int64       `json:"id"`
+	Name  string      `json:"name"`
+	Tid   int64       `json:"tid"`
+	Uid   int64       `json:"uid"`
+	Ctime int64       `json:"ctime"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+/**
+ * 写入事件, db 应为变更所在的事务
+ * 未配置 Outbox 时不写入
+ */
+func WriteUserEvent(a *UserApp, db kk.Database, tid int64, uid int64, name string, data interface{}) error {
+
+	if a.Outbox == nil {
+		return nil
+	}
+
+	var v = UserEvent{}
+
+	v.Tid = tid
+	v.Uid = uid
+	v.Name = name
+	v.Status = UserEventStatusPending
+	v.Ctime = time.Now().Unix()
+	v.Ntime = v.Ctime
+
+	if data != nil {
+
+		b, err := json.Encode(data)
+
+		if err != nil {
+			return err
+		}
+
+		v.Content = string(b)
+	}
+
+	_, err := kk.DBInsert(db, &a.UserEventTable, a.DB.Prefix, &v)
+
+	return err
+}
+
+func (E *UserEvent) Message() *UserEventMessage {
+
+	var m = UserEventMessage{}
+
+	m.Id = E.Id
+	m.Name = E.Name
+	m.Tid = E.Tid
+	m.Uid = E.Uid
+	m.Ctime = E.Ctime
+
+	if E.Content != "" {
+		var data interface{} = nil
+		err := json.Decode([]byte(E.Content), &data)
+		if err == nil {
+			m.Data = data
+		}
+	}
+
+	return &m
+}
+
+func (C *OutboxConfig) interval() time.Duration {
+	if C.Interval > 0 {
+		return time.Duration(C.Interval) * time.Second
+	}
+	return time.Second
+}
+
+func (C *OutboxConfig) limit() int {
+	if C.Limit > 0 {
+		return C.Limit
+	}
+	return 100
+}
+
+func (C *OutboxConfig) lease() int64 {
+	if C.Lease > 0 {
+		return C.Lease
+	}
+	return 300
+}
+
+func (C *OutboxConfig) maxCount() int {
+	if C.MaxCount > 0 {
+		return C.MaxCount
+	}
+	return 10
+}
+
+/**
+ * 第 count 次失败后的退避时间 (秒)
+ */
+func (C *OutboxConfig) backoff(count int) int64 {
+
+	var retry = C.Retry
+	var maxRetry = C.MaxRetry
+
+	if retry <= 0 {
+		retry = 2
+	}
+
+	if maxRetry <= 0 {
+		maxRetry = 600
+	}
+
+	var v = retry
+
+	for i := 1; i < count && v < maxRetry; i++ {
+		v = v * 2
+	}
+
+	if v > maxRetry {
+		v = maxRetry
+	}
+
+	return v
+}
+
+/**
+ * 发布到 kk 消息通道, 在主队列中发送
+ */
+func (C *OutboxConfig) publishRemote(a *UserApp, b []byte) error {
+
+	var err error = nil
+	var done = make(chan bool, 1)
+
+	kk.GetDispatchMain().Async(func() {
+
+		var task = remote.RemoteSendMessageTask{}
+
+		task.Message = kk.Message{Method: "MESSAGE", To: C.To, Type: "text/json", Content: b}
+
+		err = app.Handle(a, &task)
+
+		if err == nil && task.Result.Errno != 0 {
+			err = fmt.Errorf("[%d] %s", task.Result.Errno, task.Result.Errmsg)
+		}
+
+		done <- true
+	})
+
+	<-done
+
+	return err
+}
+
+func (C *OutboxConfig) publishWebhook(b []byte) error {
+
+	var timeout = C.Timeout
+
+	if timeout <= 0 {
+		timeout = 5
+	}
+
+	var client = http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	resp, err := client.Post(C.Webhook, "application/json; charset=utf-8", bytes.NewReader(b))
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s status %d", C.Webhook, resp.StatusCode)
+	}
+
+	return nil
+}
+
+/**
+ * 记录投递成功的目标
+ */
+func setUserEventSink(a *UserApp, db kk.Database, v *UserEvent, sink int) error {
+
+	_, err := db.Exec(fmt.Sprintf("UPDATE %s%s SET sinks=sinks|? WHERE id=?", a.DB.Prefix, a.UserEventTable.Name), sink, v.Id)
+
+	if err == nil {
+		v.Sinks = v.Sinks | sink
+	}
+
+	return err
+}
+
+/**
+ * 先分发给订阅的 Webhook, 再发布到 kk 消息通道和 Webhook
+ * 每个目标单独记录是否成功, 一个目标失败不影响其他目标, 重试时只投递失败的目标
+ */
+func (C *OutboxConfig) Publish(a *UserApp, db *sql.DB, v *UserEvent) error {
+
+	b, err := json.Encode(v.Message())
+
+	if err != nil {
+		return err
+	}
+
+	var errs = []string{}
+
+	if v.Sinks&UserEventSinkWebhooks == 0 {
+		err = EnqueueUserWebhookDeliveries(a, db, v, b)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if C.To != "" && v.Sinks&UserEventSinkRemote == 0 {
+		err = C.publishRemote(a, b)
+		if err == nil {
+			err = setUserEventSink(a, db, v, UserEventSinkRemote)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if C.Webhook != "" && v.Sinks&UserEventSinkWebhook == 0 {
+		err = C.publishWebhook(b)
+		if err == nil {
+			err = setUserEventSink(a, db, v, UserEventSinkWebhook)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+/**
+ * 认领到期的行 (ntime<=now), 写入 owner 并把 ntime 推迟到租期结束, 返回 owner
+ * 认领在一条 UPDATE 中完成, 多个实例并发时每行只被一个实例认领
+ * 认领的实例崩溃时, 租期结束后其他实例可以重新认领
+ */
+func claimDispatchRows(db *sql.DB, table string, where string, lease int64, limit int, args ...interface{}) (string, error) {
+
+	owner, err := NewSessionToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	var now = time.Now().Unix()
+
+	_, err = db.Exec(fmt.Sprintf("UPDATE %s SET owner=?, ntime=? WHERE ntime<=?%s ORDER BY id ASC LIMIT %d", table, where, limit),
+		append([]interface{}{owner, now + lease, now}, args...)...)
+
+	if err != nil {
+		return "", err
+	}
+
+	return owner, nil
+}
+
+/**
+ * 认领并投递一批到期的事件, 返回投递的事件数
+ * 先投递后标记, 崩溃或标记失败时会重复投递, 消费方应按 id 去重
+ */
+func DispatchUserEvents(a *UserApp, db *sql.DB) (int, error) {
+
+	var C = a.Outbox
+	var prefix = a.DB.Prefix
+	var now = time.Now().Unix()
+	var events = []UserEvent{}
+
+	var v = UserEvent{}
+	var scanner = kk.NewDBScaner(&v)
+
+	owner, err := claimDispatchRows(db, prefix+a.UserEventTable.Name, " AND status=?", C.lease(), C.limit(), UserEventStatusPending)
+
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := kk.DBQuery(db, &a.UserEventTable, prefix, " WHERE owner=? AND status=? ORDER BY id ASC", owner, UserEventStatusPending)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		events = append(events, v)
+	}
+
+	rows.Close()
+
+	for i := range events {
+
+		var e = &events[i]
+
+		err = C.Publish(a, db, e)
+
+		e.Count = e.Count + 1
+		e.Owner = ""
+
+		if err == nil {
+			e.Status = UserEventStatusSent
+			e.Stime = time.Now().Unix()
+		} else {
+
+			log.Println(fmt.Sprintf("[DispatchUserEvents] %d %s %s", e.Id, e.Name, err.Error()))
+
+			if e.Count >= C.maxCount() {
+				e.Status = UserEventStatusFailed
+			} else {
+				e.Ntime = time.Now().Unix() + C.backoff(e.Count)
+			}
+		}
+
+		_, err = kk.DBUpdateWithKeys(db, &a.UserEventTable, prefix, e, map[string]bool{"status": true, "count": true, "ntime": true, "stime": true, "owner": true})
+
+		if err != nil {
+			return i, err
+		}
+	}
+
+	if C.KeepEvents > 0 {
+
+		_, err = db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE status=? AND stime<?", prefix, a.UserEventTable.Name), UserEventStatusSent, now-C.KeepEvents)
+
+		if err != nil {
+			return len(events), err
+		}
+	}
+
+	return len(events), nil
+}
+
+/**
+ * 启动事件和 Webhook 分发器, 在 HandleInitTask 中调用
+ */
+func StartUserEventDispatcher(a *UserApp, db *sql.DB) {
+
+	if a.Outbox == nil {
+		return
+	}
+
+	go func() {
+
+		for {
+
+			n, err := DispatchUserEvents(a, db)
+
+			if err != nil {
+				log.Println("[StartUserEventDispatcher]" + err.Error())
+			}
+
+			m, err := DispatchUserWebhooks(a, db)
+
+			if err != nil {
+				log.Println("[StartUserEventDispatcher]" + err.Error())
+			}
+
+			if n < a.Outbox.limit() && m < a.Webhook.limit() {
+				time.Sleep(a.Outbox.interval())
+			}
+		}
+
+	}()
+}
@@ -0,0 +1,35 @@
+package user
+
+import (
+	"testing"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+
+	var C = OutboxConfig{Retry: 2, MaxRetry: 30}
+
+	for count, want := range map[int]int64{1: 2, 2: 4, 3: 8, 4: 16, 5: 30, 20: 30} {
+		if v := C.backoff(count); v != want {
+			t.Errorf("backoff(%d) = %d, want %d", count, v, want)
+		}
+	}
+
+	C = OutboxConfig{}
+
+	if C.backoff(1) != 2 || C.backoff(100) != 600 || C.lease() != 300 || C.limit() != 100 {
+		t.Fatal("defaults")
+	}
+}
+
+func TestUserEventMessage(t *testing.T) {
+
+	var e = UserEvent{Id: 1, Tid: 2, Uid: 3, Name: UserEventCreated, Content: `{"name":"u"}`, Ctime: 4}
+
+	m := e.Message()
+
+	data, ok := m.Data.(map[string]interface{})
+
+	if m.Id != 1 || m.Tid != 2 || m.Uid != 3 || !ok || data["name"] != "u" {
+		t.Fatalf("Message %v", m)
+	}
+}
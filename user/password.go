@@ -0,0 +1,313 @@
+package user
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"strings"
+)
+
+const PasswordAlgorithmMD5 = "md5"
+const PasswordAlgorithmBcrypt = "bcrypt"
+const PasswordAlgorithmArgon2id = "argon2id"
+
+/**
+ * 密码哈希
+ * Encode 生成自描述的哈希串 (算法, 参数, 盐)
+ */
+type PasswordHasher interface {
+	Algorithm() string
+	Encode(password string) (string, error)
+	Verify(password string, hash string) bool
+	NeedsRehash(hash string) bool
+}
+
+type PasswordConfig struct {
+	Algorithm  string // bcrypt, argon2id, md5
+	Cost       int    // bcrypt
+	Time       int    // argon2id
+	Memory     int    // argon2id KiB
+	Threads    int    // argon2id
+	KeyLength  int    // argon2id
+	SaltLength int    // argon2id
+}
+
+func (C *PasswordConfig) Hasher(a *UserApp) PasswordHasher {
+
+	var algorithm = PasswordAlgorithmBcrypt
+
+	if C != nil && C.Algorithm != "" {
+		algorithm = C.Algorithm
+	}
+
+	switch algorithm {
+	case PasswordAlgorithmArgon2id:
+		var h = &Argon2idPasswordHasher{Time: 3, Memory: 64 * 1024, Threads: 2, KeyLength: 32, SaltLength: 16}
+		if C.Time > 0 {
+			h.Time = uint32(C.Time)
+		}
+		if C.Memory > 0 {
+			h.Memory = uint32(C.Memory)
+		}
+		if C.Threads > 0 {
+			h.Threads = uint8(C.Threads)
+		}
+		if C.KeyLength > 0 {
+			h.KeyLength = uint32(C.KeyLength)
+		}
+		if C.SaltLength > 0 {
+			h.SaltLength = C.SaltLength
+		}
+		return h
+	case PasswordAlgorithmMD5:
+		return &MD5PasswordHasher{Token: a.Token}
+	}
+
+	var h = &BcryptPasswordHasher{Cost: bcrypt.DefaultCost}
+
+	if C != nil && C.Cost > 0 {
+		h.Cost = C.Cost
+	}
+
+	return h
+}
+
+/**
+ * 旧版 md5(password + Token), 仅用于校验和迁移
+ */
+type MD5PasswordHasher struct {
+	Token string
+}
+
+func (H *MD5PasswordHasher) Algorithm() string {
+	return PasswordAlgorithmMD5
+}
+
+func (H *MD5PasswordHasher) Encode(password string) (string, error) {
+	m := md5.New()
+	m.Write([]byte(password))
+	m.Write([]byte(H.Token))
+	v := m.Sum(nil)
+	return hex.EncodeToString(v), nil
+}
+
+func (H *MD5PasswordHasher) Verify(password string, hash string) bool {
+	v, _ := H.Encode(password)
+	return subtle.ConstantTimeCompare([]byte(v), []byte(hash)) == 1
+}
+
+func (H *MD5PasswordHasher) NeedsRehash(hash string) bool {
+	return !IsMD5PasswordHash(hash)
+}
+
+func IsMD5PasswordHash(hash string) bool {
+	if len(hash) != md5.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+type BcryptPasswordHasher struct {
+	Cost int
+}
+
+func (H *BcryptPasswordHasher) Algorithm() string {
+	return PasswordAlgorithmBcrypt
+}
+
+func (H *BcryptPasswordHasher) Encode(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), H.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (H *BcryptPasswordHasher) Verify(password string, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (H *BcryptPasswordHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != H.Cost
+}
+
+func IsBcryptPasswordHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+/**
+ * $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+ */
+type Argon2idPasswordHasher struct {
+	Time       uint32
+	Memory     uint32
+	Threads    uint8
+	KeyLength  uint32
+	SaltLength int
+}
+
+func (H *Argon2idPasswordHasher) Algorithm() string {
+	return PasswordAlgorithmArgon2id
+}
+
+func (H *Argon2idPasswordHasher) Encode(password string) (string, error) {
+
+	salt := make([]byte, H.SaltLength)
+
+	_, err := rand.Read(salt)
+
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, H.Time, H.Memory, H.Threads, H.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, H.Memory, H.Time, H.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (H *Argon2idPasswordHasher) Verify(password string, hash string) bool {
+
+	var p, salt, key, err = decodeArgon2idPasswordHash(hash)
+
+	if err != nil {
+		return false
+	}
+
+	v := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(v, key) == 1
+}
+
+func (H *Argon2idPasswordHasher) NeedsRehash(hash string) bool {
+
+	var p, salt, key, err = decodeArgon2idPasswordHash(hash)
+
+	if err != nil {
+		return true
+	}
+
+	return p.Time != H.Time || p.Memory != H.Memory || p.Threads != H.Threads ||
+		uint32(len(key)) != H.KeyLength || len(salt) != H.SaltLength
+}
+
+func IsArgon2idPasswordHash(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func decodeArgon2idPasswordHash(hash string) (*Argon2idPasswordHasher, []byte, []byte, error) {
+
+	var vs = strings.Split(hash, "$")
+
+	if len(vs) != 6 || vs[1] != PasswordAlgorithmArgon2id {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+
+	_, err := fmt.Sscanf(vs[2], "v=%d", &version)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	var p = Argon2idPasswordHasher{}
+
+	_, err = fmt.Sscanf(vs[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(vs[4])
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(vs[5])
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return &p, salt, key, nil
+}
+
+func EncodePassword(a *UserApp, password string) (string, error) {
+	return a.Password.Hasher(a).Encode(password)
+}
+
+func NewPassword(a *UserApp) (string, error) {
+
+	b := make([]byte, 24)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return EncodePassword(a, hex.EncodeToString(b))
+}
+
+/**
+ * 校验密码, 按哈希串识别算法 (兼容旧版 md5)
+ * rehash 为 true 时调用方应以当前配置的算法重新生成哈希
+ */
+func VerifyPassword(a *UserApp, password string, hash string) (ok bool, rehash bool) {
+
+	var hasher = a.Password.Hasher(a)
+	var h PasswordHasher = nil
+
+	if IsBcryptPasswordHash(hash) {
+		h = &BcryptPasswordHasher{}
+	} else if IsArgon2idPasswordHash(hash) {
+		h = &Argon2idPasswordHasher{}
+	} else if IsMD5PasswordHash(hash) {
+		h = &MD5PasswordHasher{Token: a.Token}
+	} else {
+		return false, false
+	}
+
+	if !h.Verify(password, hash) {
+		return false, false
+	}
+
+	return true, hasher.NeedsRehash(hash)
+}
+
+/**
+ * 以当前配置的算法重新生成哈希, 失败只记录日志
+ */
+func RehashPassword(a *UserApp, db *sql.DB, v *User, password string) {
+
+	hash, err := EncodePassword(a, password)
+
+	if err != nil {
+		log.Println("[RehashPassword]" + err.Error())
+		return
+	}
+
+	v.Password = hash
+
+	_, err = kk.DBUpdateWithKeys(db, &a.UserTable, a.DB.Prefix, v, map[string]bool{"password": true})
+
+	if err != nil {
+		log.Println("[RehashPassword]" + err.Error())
+	}
+}
@@ -0,0 +1,347 @@
+package user
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk/json"
+	"strconv"
+	"strings"
+)
+
+const UserOptionsModeMerge = "merge"            // 按顶层键覆盖 (默认)
+const UserOptionsModeMergePatch = "merge-patch" // RFC 7386, null 删除, 递归合并
+const UserOptionsModeJSONPatch = "json-patch"   // RFC 6902, add/remove/replace/test
+const UserOptionsModeReplace = "replace"        // 整体替换
+
+/**
+ * RFC 7386 JSON Merge Patch
+ */
+func MergePatch(target interface{}, patch interface{}) interface{} {
+
+	p, ok := patch.(map[string]interface{})
+
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+
+	if !ok {
+		t = map[string]interface{}{}
+	}
+
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = MergePatch(t[key], value)
+		}
+	}
+
+	return t
+}
+
+/**
+ * RFC 6901 JSON Pointer, 返回解码后的路径
+ */
+func ParseJSONPointer(pointer string) ([]string, error) {
+
+	if pointer == "" {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q, must start with /", pointer)
+	}
+
+	var keys = strings.Split(pointer[1:], "/")
+
+	for i, key := range keys {
+		keys[i] = strings.Replace(strings.Replace(key, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return keys, nil
+}
+
+func jsonPatchIndex(key string, length int, add bool) (int, error) {
+
+	if add && key == "-" {
+		return length, nil
+	}
+
+	i, err := strconv.Atoi(key)
+
+	if err != nil || i < 0 || (key != "0" && strings.HasPrefix(key, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", key)
+	}
+
+	if i > length || (!add && i == length) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+
+	return i, nil
+}
+
+/**
+ * 取 keys 指向的值
+ */
+func jsonPatchGet(doc interface{}, keys []string) (interface{}, error) {
+
+	var v = doc
+
+	for _, key := range keys {
+
+		switch o := v.(type) {
+		case map[string]interface{}:
+			vv, ok := o[key]
+			if !ok {
+				return nil, fmt.Errorf("path not found at %q", key)
+			}
+			v = vv
+		case []interface{}:
+			i, err := jsonPatchIndex(key, len(o), false)
+			if err != nil {
+				return nil, err
+			}
+			v = o[i]
+		default:
+			return nil, fmt.Errorf("path not found at %q", key)
+		}
+	}
+
+	return v, nil
+}
+
+/**
+ * 在 keys 指向的位置执行 op (add, remove, replace), 返回新的文档
+ */
+func jsonPatchSet(doc interface{}, keys []string, op string, value interface{}) (interface{}, error) {
+
+	if len(keys) == 0 {
+		if op == "remove" {
+			return nil, nil
+		}
+		return value, nil
+	}
+
+	var key = keys[0]
+
+	switch o := doc.(type) {
+	case map[string]interface{}:
+
+		if len(keys) > 1 {
+
+			vv, ok := o[key]
+
+			if !ok {
+				return nil, fmt.Errorf("path not found at %q", key)
+			}
+
+			vv, err := jsonPatchSet(vv, keys[1:], op, value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			o[key] = vv
+
+			return o, nil
+		}
+
+		_, ok := o[key]
+
+		if !ok && op != "add" {
+			return nil, fmt.Errorf("path not found at %q", key)
+		}
+
+		if op == "remove" {
+			delete(o, key)
+		} else {
+			o[key] = value
+		}
+
+		return o, nil
+
+	case []interface{}:
+
+		if len(keys) > 1 {
+
+			i, err := jsonPatchIndex(key, len(o), false)
+
+			if err != nil {
+				return nil, err
+			}
+
+			vv, err := jsonPatchSet(o[i], keys[1:], op, value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			o[i] = vv
+
+			return o, nil
+		}
+
+		i, err := jsonPatchIndex(key, len(o), op == "add")
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case "add":
+			o = append(o, nil)
+			copy(o[i+1:], o[i:])
+			o[i] = value
+		case "remove":
+			o = append(o[:i], o[i+1:]...)
+		default:
+			o[i] = value
+		}
+
+		return o, nil
+	}
+
+	return nil, fmt.Errorf("path not found at %q", key)
+}
+
+func jsonPatchEqual(a interface{}, b interface{}) bool {
+	ab, _ := json.Encode(a)
+	bb, _ := json.Encode(b)
+	return bytes.Equal(ab, bb)
+}
+
+/**
+ * RFC 6902 JSON Patch, 支持 add, remove, replace, test
+ * 任一操作失败时返回错误, 不修改原文档的语义由调用方保证 (传入解码后的副本)
+ */
+func JSONPatch(doc interface{}, patch interface{}) (interface{}, error) {
+
+	ops, ok := patch.([]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("json-patch must be an array of operations")
+	}
+
+	for i, item := range ops {
+
+		o, ok := item.(map[string]interface{})
+
+		if !ok {
+			return nil, fmt.Errorf("operation %d must be an object", i)
+		}
+
+		op, _ := o["op"].(string)
+		path, ok := o["path"].(string)
+
+		if !ok {
+			return nil, fmt.Errorf("operation %d (%s): missing path", i, op)
+		}
+
+		keys, err := ParseJSONPointer(path)
+
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %s", i, op, path, err.Error())
+		}
+
+		value, hasValue := o["value"]
+
+		switch op {
+		case "add", "replace", "test":
+			if !hasValue {
+				return nil, fmt.Errorf("operation %d (%s %s): missing value", i, op, path)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d: unsupported op %q", i, op)
+		}
+
+		if op == "test" {
+
+			v, err := jsonPatchGet(doc, keys)
+
+			if err != nil {
+				return nil, fmt.Errorf("operation %d (test %s): %s", i, path, err.Error())
+			}
+
+			if !jsonPatchEqual(v, value) {
+				return nil, fmt.Errorf("operation %d (test %s): value does not match", i, path)
+			}
+
+			continue
+		}
+
+		doc, err = jsonPatchSet(doc, keys, op, value)
+
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %s", i, op, path, err.Error())
+		}
+	}
+
+	return doc, nil
+}
+
+/**
+ * 按 mode 写入配置, 补丁模式仅用于 json 类型, replace 整体替换
+ * options 为字符串时按 JSON 解码
+ */
+func (U *UserOptions) ApplyOptions(mode string, options interface{}) error {
+
+	if mode == "" || mode == UserOptionsModeMerge {
+		U.SetOptions(options)
+		return nil
+	}
+
+	if mode == UserOptionsModeReplace && U.Type != UserOptionsTypeJson {
+		U.Options = ""
+		U.SetOptions(options)
+		return nil
+	}
+
+	if mode != UserOptionsModeMergePatch && mode != UserOptionsModeJSONPatch && mode != UserOptionsModeReplace {
+		return fmt.Errorf("unsupported mode %q", mode)
+	}
+
+	if U.Type != UserOptionsTypeJson {
+		return fmt.Errorf("mode %s requires type %s", mode, UserOptionsTypeJson)
+	}
+
+	if s, ok := options.(string); ok && s != "" {
+
+		var object interface{} = nil
+
+		err := json.Decode([]byte(s), &object)
+
+		if err != nil {
+			return fmt.Errorf("invalid patch: %s", err.Error())
+		}
+
+		options = object
+	}
+
+	var object = U.GetOptions()
+	var err error = nil
+
+	if mode == UserOptionsModeReplace {
+		object = options
+	} else if mode == UserOptionsModeMergePatch {
+		object = MergePatch(object, options)
+	} else {
+		object, err = JSONPatch(object, options)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Encode(object)
+
+	if err != nil {
+		return err
+	}
+
+	U.Options = string(b)
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package user
+
+import (
+	"github.com/kkserver/kk-lib/kk/json"
+	"testing"
+)
+
+func decodePatchTestValue(t *testing.T, s string) interface{} {
+
+	var object interface{} = nil
+
+	err := json.Decode([]byte(s), &object)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return object
+}
+
+func TestMergePatch(t *testing.T) {
+
+	var cases = [][3]string{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, c := range cases {
+
+		var v = MergePatch(decodePatchTestValue(t, c[0]), decodePatchTestValue(t, c[1]))
+
+		if !jsonPatchEqual(v, decodePatchTestValue(t, c[2])) {
+			b, _ := json.Encode(v)
+			t.Errorf("MergePatch(%s, %s) = %s, want %s", c[0], c[1], string(b), c[2])
+		}
+	}
+}
+
+func TestParseJSONPointer(t *testing.T) {
+
+	keys, err := ParseJSONPointer("/a~1b/m~0n/0")
+
+	if err != nil || len(keys) != 3 || keys[0] != "a/b" || keys[1] != "m~n" || keys[2] != "0" {
+		t.Fatalf("keys %v %v", keys, err)
+	}
+
+	keys, err = ParseJSONPointer("")
+
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("root %v %v", keys, err)
+	}
+
+	if _, err = ParseJSONPointer("a"); err == nil {
+		t.Fatal("pointer without / accepted")
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+
+	var cases = [][3]string{
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`},
+		{`{"a":1}`, `[{"op":"replace","path":"/a","value":[1]}]`, `{"a":[1]}`},
+		{`{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`},
+		{`{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`},
+		{`{"a":[1,2]}`, `[{"op":"add","path":"/a/-","value":3}]`, `{"a":[1,2,3]}`},
+		{`{"a":[1,2,3]}`, `[{"op":"remove","path":"/a/0"}]`, `{"a":[2,3]}`},
+		{`{"a":{"b":{"c":1}}}`, `[{"op":"replace","path":"/a/b/c","value":2}]`, `{"a":{"b":{"c":2}}}`},
+		{`{"a/b":1}`, `[{"op":"replace","path":"/a~1b","value":2}]`, `{"a/b":2}`},
+		{`{"a":1}`, `[{"op":"test","path":"/a","value":1},{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":{"b":2}}]`, `{"b":2}`},
+	}
+
+	for _, c := range cases {
+
+		v, err := JSONPatch(decodePatchTestValue(t, c[0]), decodePatchTestValue(t, c[1]))
+
+		if err != nil {
+			t.Errorf("JSONPatch(%s, %s): %s", c[0], c[1], err.Error())
+			continue
+		}
+
+		if !jsonPatchEqual(v, decodePatchTestValue(t, c[2])) {
+			b, _ := json.Encode(v)
+			t.Errorf("JSONPatch(%s, %s) = %s, want %s", c[0], c[1], string(b), c[2])
+		}
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+
+	var cases = [][2]string{
+		{`{"a":1}`, `{"op":"add","path":"/b","value":2}`},
+		{`{"a":1}`, `[{"op":"move","path":"/a","from":"/b"}]`},
+		{`{"a":1}`, `[{"op":"add","path":"/b"}]`},
+		{`{"a":1}`, `[{"op":"add","value":1}]`},
+		{`{"a":1}`, `[{"op":"replace","path":"/b","value":2}]`},
+		{`{"a":1}`, `[{"op":"remove","path":"/b"}]`},
+		{`{"a":1}`, `[{"op":"add","path":"/b/c","value":2}]`},
+		{`{"a":1}`, `[{"op":"test","path":"/a","value":2}]`},
+		{`{"a":[1]}`, `[{"op":"replace","path":"/a/1","value":2}]`},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/01","value":2}]`},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/3","value":2}]`},
+		{`{"a":[1]}`, `[{"op":"remove","path":"/a/-"}]`},
+	}
+
+	for _, c := range cases {
+		if _, err := JSONPatch(decodePatchTestValue(t, c[0]), decodePatchTestValue(t, c[1])); err == nil {
+			t.Errorf("JSONPatch(%s, %s) accepted", c[0], c[1])
+		}
+	}
+}
+
+func TestApplyOptions(t *testing.T) {
+
+	var v = UserOptions{Type: UserOptionsTypeJson, Options: `{"a":1,"b":{"c":2}}`}
+
+	if err := v.ApplyOptions(UserOptionsModeMergePatch, `{"b":{"c":null,"d":3}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if !jsonPatchEqual(v.GetOptions(), decodePatchTestValue(t, `{"a":1,"b":{"d":3}}`)) {
+		t.Fatalf("merge-patch %s", v.Options)
+	}
+
+	var before = v.Options
+
+	if err := v.ApplyOptions(UserOptionsModeJSONPatch, `[{"op":"add","path":"/e","value":1},{"op":"test","path":"/a","value":0}]`); err == nil {
+		t.Fatal("failed json-patch applied")
+	}
+
+	if v.Options != before {
+		t.Fatalf("failed json-patch changed options to %s", v.Options)
+	}
+
+	if err := v.ApplyOptions(UserOptionsModeReplace, map[string]interface{}{"x": "y"}); err != nil || !jsonPatchEqual(v.GetOptions(), decodePatchTestValue(t, `{"x":"y"}`)) {
+		t.Fatalf("replace %s %v", v.Options, err)
+	}
+
+	if err := v.ApplyOptions("put", nil); err == nil {
+		t.Fatal("unsupported mode accepted")
+	}
+
+	var text = UserOptions{Type: "text", Options: "a"}
+
+	if err := text.ApplyOptions(UserOptionsModeMergePatch, `{}`); err == nil {
+		t.Fatal("merge-patch on text accepted")
+	}
+
+	if err := text.ApplyOptions(UserOptionsModeReplace, "b"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,311 @@
+package user
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/json"
+	"strings"
+)
+
+/**
+ * 分页计数, 用于 User.Query 和分组成员等列表查询
+ */
+func NewUserQueryCounter(db *sql.DB, table *kk.DBTable, prefix string, pageIndex int, pageSize int, sql string, args ...interface{}) (*UserQueryCounter, error) {
+
+	var err error = nil
+	var counter = UserQueryCounter{}
+
+	counter.PageIndex = pageIndex
+	counter.PageSize = pageSize
+	counter.RowCount, err = kk.DBQueryCount(db, table, prefix, sql, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if counter.RowCount%pageSize == 0 {
+		counter.PageCount = counter.RowCount / pageSize
+	} else {
+		counter.PageCount = counter.RowCount/pageSize + 1
+	}
+
+	return &counter, nil
+}
+
+/**
+ * User.Query 可排序的字段, 值为数据表的列
+ * 非 id 排序时以 id 作为第二排序键, 保证顺序稳定
+ */
+var UserQuerySortFields = map[string]string{
+	"id":    "id",
+	"name":  "name",
+	"ctime": "ctime",
+	"mtime": "mtime",
+	"atime": "atime",
+}
+
+/**
+ * User.Query 可返回的字段 (JSON 名), 值为数据表的列
+ */
+var UserQueryFields = map[string]string{
+	"id":            "id",
+	"tid":           "tid",
+	"name":          "name",
+	"ctime":         "ctime",
+	"atime":         "atime",
+	"mtime":         "mtime",
+	"status":        "status",
+	"reason":        "reason",
+	"stime":         "stime",
+	"email":         "email",
+	"emailVerified": "emailverified",
+	"phone":         "phone",
+	"phoneVerified": "phoneverified",
+}
+
+/**
+ * 转义 LIKE 中的通配符
+ */
+func EscapeLike(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(s)
+}
+
+/**
+ * 时间范围 [start, end), 0 表示不限
+ */
+func writeUserQueryRange(sql *bytes.Buffer, args []interface{}, column string, start int64, end int64) []interface{} {
+
+	if start != 0 {
+		sql.WriteString(fmt.Sprintf(" AND %s>=?", column))
+		args = append(args, start)
+	}
+
+	if end != 0 {
+		sql.WriteString(fmt.Sprintf(" AND %s<?", column))
+		args = append(args, end)
+	}
+
+	return args
+}
+
+/**
+ * 返回排序的列和方向, sortBy 不在 UserQuerySortFields 中时返回错误
+ */
+func ParseUserQuerySort(sortBy string, orderBy string) (string, bool, error) {
+
+	if sortBy == "" {
+		sortBy = "id"
+	}
+
+	column, ok := UserQuerySortFields[sortBy]
+
+	if !ok {
+		return "", false, fmt.Errorf("Unsupported sortBy %q", sortBy)
+	}
+
+	return column, orderBy == "asc", nil
+}
+
+func writeUserQueryOrder(sql *bytes.Buffer, column string, asc bool) {
+
+	var dir = "DESC"
+
+	if asc {
+		dir = "ASC"
+	}
+
+	if column == "id" {
+		sql.WriteString(fmt.Sprintf(" ORDER BY id %s", dir))
+	} else {
+		sql.WriteString(fmt.Sprintf(" ORDER BY %s %s, id %s", column, dir, dir))
+	}
+}
+
+/**
+ * 解析逗号分隔的字段, 字段不在 UserQueryFields 中时返回错误
+ */
+func ParseUserQueryFields(fields string) ([]string, error) {
+
+	var vs = []string{}
+
+	for _, field := range strings.Split(fields, ",") {
+
+		field = strings.TrimSpace(field)
+
+		if field == "" {
+			continue
+		}
+
+		if _, ok := UserQueryFields[field]; !ok {
+			return nil, fmt.Errorf("Unsupported field %q", field)
+		}
+
+		vs = append(vs, field)
+	}
+
+	return vs, nil
+}
+
+/**
+ * fields 对应的列, 加上游标需要的 id 和排序列
+ */
+func UserQueryColumns(fields []string, sortColumn string) string {
+
+	var columns = []string{"id"}
+	var set = map[string]bool{"id": true}
+
+	for _, column := range append([]string{sortColumn}, fields...) {
+
+		if c, ok := UserQueryFields[column]; ok {
+			column = c
+		}
+
+		if !set[column] {
+			set[column] = true
+			columns = append(columns, column)
+		}
+	}
+
+	return strings.Join(columns, ",")
+}
+
+/**
+ * 查询用户, fields 不为空时只查询需要的列
+ */
+func QueryUserRows(a *UserApp, db *sql.DB, fields []string, sortColumn string, where string, args ...interface{}) (*sql.Rows, error) {
+
+	if len(fields) == 0 {
+		return kk.DBQuery(db, &a.UserTable, a.DB.Prefix, where, args...)
+	}
+
+	return db.Query(fmt.Sprintf("SELECT %s FROM %s%s%s", UserQueryColumns(fields, sortColumn), a.DB.Prefix, a.UserTable.Name, where), args...)
+}
+
+/**
+ * 只保留 fields 中的字段, 按字段取值, 零值和空字符串也返回
+ */
+func ProjectUser(v *User, fields []string) map[string]interface{} {
+
+	var item = map[string]interface{}{}
+
+	for _, field := range fields {
+		switch field {
+		case "id":
+			item[field] = v.Id
+		case "tid":
+			item[field] = v.Tid
+		case "name":
+			item[field] = v.Name
+		case "ctime":
+			item[field] = v.Ctime
+		case "atime":
+			item[field] = v.Atime
+		case "mtime":
+			item[field] = v.Mtime
+		case "status":
+			item[field] = v.Status
+		case "reason":
+			item[field] = v.Reason
+		case "stime":
+			item[field] = v.Stime
+		case "email":
+			item[field] = string(v.Email)
+		case "emailVerified":
+			item[field] = v.EmailVerified
+		case "phone":
+			item[field] = string(v.Phone)
+		case "phoneVerified":
+			item[field] = v.PhoneVerified
+		}
+	}
+
+	return item
+}
+
+/**
+ * 游标, 记录上一页最后一行的排序值和 id (keyset 分页)
+ * 编码为 base64 的 JSON, 调用方不应解析
+ */
+type UserQueryCursor struct {
+	SortBy string `json:"s"`
+	Asc    bool   `json:"a,omitempty"`
+	Number int64  `json:"n,omitempty"` // 时间排序的值
+	Text   string `json:"t,omitempty"` // name 排序的值
+	Id     int64  `json:"i"`
+}
+
+func NewUserQueryCursor(v *User, column string, asc bool) *UserQueryCursor {
+
+	var c = UserQueryCursor{SortBy: column, Asc: asc, Id: v.Id}
+
+	switch column {
+	case "name":
+		c.Text = v.Name
+	case "ctime":
+		c.Number = v.Ctime
+	case "mtime":
+		c.Number = v.Mtime
+	case "atime":
+		c.Number = v.Atime
+	}
+
+	return &c
+}
+
+func EncodeUserQueryCursor(c *UserQueryCursor) string {
+	b, _ := json.Encode(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeUserQueryCursor(s string) (*UserQueryCursor, error) {
+
+	var c = UserQueryCursor{}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err == nil {
+		err = json.Decode(b, &c)
+	}
+
+	if err == nil {
+		if _, ok := UserQuerySortFields[c.SortBy]; !ok {
+			err = fmt.Errorf("unsupported sort %q", c.SortBy)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+
+	return &c, nil
+}
+
+/**
+ * 游标之后的行, 与 writeUserQueryOrder 的排序一致
+ */
+func writeUserQueryCursor(sql *bytes.Buffer, args []interface{}, c *UserQueryCursor) []interface{} {
+
+	var op = "<"
+
+	if c.Asc {
+		op = ">"
+	}
+
+	if c.SortBy == "id" {
+		sql.WriteString(fmt.Sprintf(" AND id%s?", op))
+		return append(args, c.Id)
+	}
+
+	var value interface{} = c.Number
+
+	if c.SortBy == "name" {
+		value = c.Text
+	}
+
+	sql.WriteString(fmt.Sprintf(" AND (%s%s? OR (%s=? AND id%s?))", c.SortBy, op, c.SortBy, op))
+
+	return append(args, value, value, c.Id)
+}
@@ -0,0 +1,109 @@
+package user
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestProjectUser(t *testing.T) {
+
+	var v = User{Id: 1, Tid: 2, Name: "u", Password: "p", Status: 0}
+
+	var item = ProjectUser(&v, []string{"id", "email", "reason", "stime", "status", "phoneVerified"})
+
+	if len(item) != 6 || item["id"] != int64(1) || item["email"] != "" || item["reason"] != "" || item["stime"] != int64(0) || item["status"] != 0 || item["phoneVerified"] != 0 {
+		t.Fatalf("item %v", item)
+	}
+
+	if _, ok := item["password"]; ok {
+		t.Fatal("password projected")
+	}
+
+	for field := range UserQueryFields {
+		if _, ok := ProjectUser(&v, []string{field})[field]; !ok {
+			t.Errorf("field %s not projected", field)
+		}
+	}
+}
+
+func TestParseUserQueryFields(t *testing.T) {
+
+	fields, err := ParseUserQueryFields(" id, emailVerified,,name ")
+
+	if err != nil || len(fields) != 3 || fields[1] != "emailVerified" {
+		t.Fatalf("fields %v %v", fields, err)
+	}
+
+	if _, err = ParseUserQueryFields("id,password"); err == nil {
+		t.Fatal("password accepted")
+	}
+
+	if columns := UserQueryColumns(fields, "ctime"); columns != "id,ctime,emailverified,name" {
+		t.Fatalf("columns %s", columns)
+	}
+
+	if _, _, err = ParseUserQuerySort("password", ""); err == nil {
+		t.Fatal("sortBy password accepted")
+	}
+
+	column, asc, err := ParseUserQuerySort("", "asc")
+
+	if err != nil || column != "id" || !asc {
+		t.Fatalf("sort %s %v %v", column, asc, err)
+	}
+}
+
+func TestUserQueryCursor(t *testing.T) {
+
+	var v = User{Id: 7, Name: "n", Ctime: 100, Mtime: 200, Atime: 300}
+
+	for column, want := range map[string]UserQueryCursor{
+		"id":    {SortBy: "id", Id: 7},
+		"name":  {SortBy: "name", Text: "n", Id: 7},
+		"ctime": {SortBy: "ctime", Number: 100, Id: 7},
+		"mtime": {SortBy: "mtime", Number: 200, Asc: true, Id: 7},
+		"atime": {SortBy: "atime", Number: 300, Id: 7},
+	} {
+
+		c, err := DecodeUserQueryCursor(EncodeUserQueryCursor(NewUserQueryCursor(&v, column, want.Asc)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if *c != want {
+			t.Errorf("%s: cursor %v, want %v", column, *c, want)
+		}
+	}
+
+	for _, s := range []string{"", "!!", base64.RawURLEncoding.EncodeToString([]byte(`[]`)), base64.RawURLEncoding.EncodeToString([]byte(`{"s":"password","i":1}`))} {
+		if _, err := DecodeUserQueryCursor(s); err == nil {
+			t.Errorf("cursor %q accepted", s)
+		}
+	}
+}
+
+func TestWriteUserQueryCursor(t *testing.T) {
+
+	var sql = bytes.NewBuffer(nil)
+	var args = writeUserQueryCursor(sql, []interface{}{}, &UserQueryCursor{SortBy: "id", Id: 7})
+
+	if sql.String() != " AND id<?" || len(args) != 1 || args[0] != int64(7) {
+		t.Fatalf("%s %v", sql.String(), args)
+	}
+
+	sql = bytes.NewBuffer(nil)
+	args = writeUserQueryCursor(sql, []interface{}{}, &UserQueryCursor{SortBy: "name", Asc: true, Text: "n", Id: 7})
+
+	if sql.String() != " AND (name>? OR (name=? AND id>?))" || len(args) != 3 || args[0] != "n" || args[1] != "n" || args[2] != int64(7) {
+		t.Fatalf("%s %v", sql.String(), args)
+	}
+
+	sql = bytes.NewBuffer(nil)
+	writeUserQueryOrder(sql, "ctime", false)
+
+	if sql.String() != " ORDER BY ctime DESC, id DESC" {
+		t.Fatal(sql.String())
+	}
+}
@@ -0,0 +1,266 @@
+package user
+
+import (
+	"database/sql"
+	"github.com/kkserver/kk-lib/kk"
+	"log"
+	"time"
+)
+
+/**
+ * 生成重置密码 token 并交给通知渠道, 用户不存在时同样返回成功
+ */
+func (S *UserService) HandleUserPasswordRequestResetTask(a *UserApp, task *UserPasswordRequestResetTask) error {
+
+	if task.Uid == 0 && task.Name == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+		task.Result.Errmsg = "Not found name"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var v = User{}
+	var scanner = kk.NewDBScaner(&v)
+	var rows *sql.Rows = nil
+
+	if task.Uid != 0 {
+		rows, err = kk.DBQuery(db, &a.UserTable, a.DB.Prefix, " WHERE id=? AND tid=?", task.Uid, task.Tid)
+	} else {
+		rows, err = kk.DBQuery(db, &a.UserTable, a.DB.Prefix, " WHERE tid=? AND name=?", task.Tid, task.Name)
+	}
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil
+	}
+
+	err = scanner.Scan(rows)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v.Status != UserStatusActive {
+		return nil
+	}
+
+	var expires = task.Expires
+
+	if expires <= 0 {
+		expires = a.ResetExpires
+	}
+
+	if expires <= 0 {
+		expires = 3600
+	}
+
+	err = RemoveUserChallenges(a, db, v.Id, UserChallengeTypeReset)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	token, err := NewUserChallenge(a, db, v.Id, UserChallengeTypeReset, nil, expires)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var n = Notification{}
+	n.Type = NotificationTypePasswordReset
+	n.Uid = v.Id
+	n.Name = v.Name
+	n.Token = token
+	n.Expires = expires
+
+	err = Notify(a, &n)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	return nil
+}
+
+func (S *UserService) HandleUserPasswordResetTask(a *UserApp, task *UserPasswordResetTask) error {
+
+	if task.Token == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_TOKEN
+		task.Result.Errmsg = "Not found token"
+		return nil
+	}
+
+	if task.Password == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_PASSWORD
+		task.Result.Errmsg = "Not found password"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	challenge, err := GetUserChallenge(a, db, UserChallengeTypeReset, task.Token)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if challenge == nil {
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = "The token is invalid or has expired"
+		return nil
+	}
+
+	u, err := getTenantUser(a, db, task.Tid, challenge.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if u == nil {
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = "The token is invalid or has expired"
+		return nil
+	}
+
+	if !CheckUserStatus(u, &task.Result.Result) {
+		return nil
+	}
+
+	password, err := EncodePassword(a, task.Password)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	ok, err := UseUserChallenge(a, db, challenge)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if !ok {
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = "The token is invalid or has expired"
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+	var v = User{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserTable, prefix, " WHERE id=? AND tid=?", challenge.Uid, task.Tid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if !CheckUserStatus(&v, &task.Result.Result) {
+			return nil
+		}
+
+		v.Password = password
+		v.Mtime = time.Now().Unix()
+
+		tx, err := db.Begin()
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		_, err = kk.DBUpdateWithKeys(tx, &a.UserTable, prefix, &v, map[string]bool{"password": true, "mtime": true})
+
+		if err == nil {
+			err = WriteUserEvent(a, tx, v.Tid, v.Id, UserEventPasswordChanged, &v)
+		}
+
+		if err == nil {
+			err = tx.Commit()
+		}
+
+		if err != nil {
+			tx.Rollback()
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		RemoveUserCache(a, v.Tid, v.Id, "")
+
+		if !task.KeepSessions {
+
+			_, err = RevokeUserSessions(a, db, v.Tid, "", v.Id, 0)
+
+			if err != nil {
+				log.Println("[UserService][HandleUserPasswordResetTask]" + err.Error())
+			}
+		}
+
+		err = a.Lockout.Clear(a, db, LockoutUidKey(v.Id))
+
+		if err != nil {
+			log.Println("[UserService][HandleUserPasswordResetTask]" + err.Error())
+		}
+
+		WriteUserAudit(a, db, v.Tid, v.Id, v.Name, UserAuditActionPasswordReset, UserAuditDiff{}.Redact("password"), task.Addr)
+
+		task.Result.User = &v
+
+	} else {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/app"
+	"log"
+	"time"
+)
+
+/**
+ * 配置历史版本, 每次写入后保存完整的配置
+ */
+type UserOptionsRevision struct {
+	Id      int64  `json:"id"`
+	Oid     int64  `json:"oid"` // 配置 id
+	Tid     int64  `json:"tid"`
+	Uid     int64  `json:"uid"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Options string `json:"options"`
+	Version int64  `json:"version"`
+	Actor   string `json:"actor,omitempty"`
+	Ctime   int64  `json:"ctime"`
+}
+
+func WriteUserOptionsRevision(a *UserApp, db kk.Database, v *UserOptions, actor string) error {
+
+	var r = UserOptionsRevision{}
+
+	r.Oid = v.Id
+	r.Tid = v.Tid
+	r.Uid = v.Uid
+	r.Name = v.Name
+	r.Type = v.Type
+	r.Options = v.Options
+	r.Version = v.Version
+	r.Actor = actor
+	r.Ctime = v.Mtime
+
+	_, err := kk.DBInsert(db, &a.UserOptionsRevisionTable, a.DB.Prefix, &r)
+
+	return err
+}
+
+/**
+ * 按 OptionsRevisions 和 OptionsRevisionExpires 清理历史版本, 失败只记录日志
+ */
+func PruneUserOptionsRevisions(a *UserApp, db *sql.DB, v *UserOptions) {
+
+	var prefix = a.DB.Prefix
+
+	if a.OptionsRevisions > 0 && v.Version > a.OptionsRevisions {
+
+		_, err := db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE oid=? AND version<=?", prefix, a.UserOptionsRevisionTable.Name), v.Id, v.Version-a.OptionsRevisions)
+
+		if err != nil {
+			log.Println("[PruneUserOptionsRevisions]" + err.Error())
+		}
+	}
+
+	if a.OptionsRevisionExpires > 0 {
+
+		_, err := db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE oid=? AND ctime<? AND version<?", prefix, a.UserOptionsRevisionTable.Name), v.Id, time.Now().Unix()-a.OptionsRevisionExpires, v.Version)
+
+		if err != nil {
+			log.Println("[PruneUserOptionsRevisions]" + err.Error())
+		}
+	}
+}
+
+/**
+ * Version > 0 时取该版本, 否则取 Time 时刻 (含) 之前的最新版本
+ */
+func GetUserOptionsRevision(a *UserApp, db *sql.DB, tid int64, uid int64, name string, version int64, t int64) (*UserOptionsRevision, error) {
+
+	var v = UserOptionsRevision{}
+	var scanner = kk.NewDBScaner(&v)
+	var rows *sql.Rows = nil
+	var err error = nil
+
+	if version > 0 {
+		rows, err = kk.DBQuery(db, &a.UserOptionsRevisionTable, a.DB.Prefix, " WHERE tid=? AND uid=? AND name=? AND version=?", tid, uid, name, version)
+	} else {
+		rows, err = kk.DBQuery(db, &a.UserOptionsRevisionTable, a.DB.Prefix, " WHERE tid=? AND uid=? AND name=? AND ctime<=? ORDER BY version DESC LIMIT 1", tid, uid, name, t)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &v, nil
+	}
+
+	return nil, nil
+}
+
+func (S *UserService) HandleUserOptionsRevisionsTask(a *UserApp, task *UserOptionsRevisionsTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+	var revisions = []UserOptionsRevision{}
+	var sql = " WHERE tid=? AND uid=? AND name=? ORDER BY version DESC"
+
+	var pageIndex = task.PageIndex
+	var pageSize = task.PageSize
+
+	if pageIndex < 1 {
+		pageIndex = 1
+	}
+
+	if pageSize < 1 {
+		pageSize = 10
+	}
+
+	if task.Counter {
+		task.Result.Counter, err = NewUserQueryCounter(db, &a.UserOptionsRevisionTable, prefix, pageIndex, pageSize, sql, task.Tid, task.Uid, task.Name)
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+	}
+
+	var v = UserOptionsRevision{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserOptionsRevisionTable, prefix, sql+fmt.Sprintf(" LIMIT %d,%d", (pageIndex-1)*pageSize, pageSize), task.Tid, task.Uid, task.Name)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if !task.Options {
+			v.Options = ""
+		}
+
+		revisions = append(revisions, v)
+	}
+
+	task.Result.Revisions = revisions
+
+	return nil
+}
+
+func (S *UserService) HandleUserOptionsAtTask(a *UserApp, task *UserOptionsAtTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	if task.Version == 0 && task.Time == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_REVISION
+		task.Result.Errmsg = "Not found version or time"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	r, err := GetUserOptionsRevision(a, db, task.Tid, task.Uid, task.Name, task.Version, task.Time)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if r == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_REVISION
+		task.Result.Errmsg = "Not found revision"
+		return nil
+	}
+
+	var v = UserOptions{Type: r.Type, Options: r.Options}
+
+	task.Result.Options = v.GetOptions()
+	task.Result.Version = r.Version
+	task.Result.Ctime = r.Ctime
+
+	return nil
+}
+
+/**
+ * 回滚到历史版本, 作为一次新的写入 (版本号递增, 记录历史, 清除缓存)
+ */
+func (S *UserService) HandleUserOptionsRollbackTask(a *UserApp, task *UserOptionsRollbackTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	if task.Version == 0 && task.Time == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_REVISION
+		task.Result.Errmsg = "Not found version or time"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	r, err := GetUserOptionsRevision(a, db, task.Tid, task.Uid, task.Name, task.Version, task.Time)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if r == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_REVISION
+		task.Result.Errmsg = "Not found revision"
+		return nil
+	}
+
+	var set = UserSetOptionsTask{}
+
+	set.Tid = r.Tid
+	set.Uid = r.Uid
+	set.Name = r.Name
+	set.Type = r.Type
+	set.Options = r.Options
+	set.Mode = UserOptionsModeReplace
+	set.IfVersion = task.IfVersion
+	set.Actor = task.Actor
+	set.Source = task.Source
+
+	app.Handle(a, &set)
+
+	task.Result.Result = set.Result.Result
+	task.Result.Version = set.Result.Version
+
+	return nil
+}
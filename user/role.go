@@ -0,0 +1,736 @@
+package user
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-cache/cache"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/app"
+	"github.com/kkserver/kk-lib/kk/dynamic"
+	"github.com/kkserver/kk-lib/kk/json"
+	"log"
+	"strings"
+	"time"
+)
+
+/**
+ * tid 为 0 的角色 (含 Roles 初始化的角色) 由全部租户共享, 其余角色只属于所在租户
+ * 同一租户内角色名唯一, 租户内查找角色时租户自己的角色优先
+ */
+type UserRole struct {
+	Id          int64    `json:"id"`
+	Tid         int64    `json:"tid"`
+	Name        string   `json:"name"`
+	Title       string   `json:"title,omitempty"`
+	Ctime       int64    `json:"ctime"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+type UserRolePermission struct {
+	Id         int64  `json:"id"`
+	Rid        int64  `json:"rid"`
+	Permission string `json:"permission"`
+}
+
+type UserRoleGrant struct {
+	Id    int64 `json:"id"`
+	Uid   int64 `json:"uid"`
+	Rid   int64 `json:"rid"`
+	Ctime int64 `json:"ctime"`
+}
+
+/**
+ * granted 以 .* 结尾时匹配其下所有权限, * 匹配全部
+ */
+func MatchPermission(granted string, permission string) bool {
+
+	if granted == "*" || granted == permission {
+		return true
+	}
+
+	if strings.HasSuffix(granted, ".*") {
+		return strings.HasPrefix(permission, granted[0:len(granted)-1])
+	}
+
+	return false
+}
+
+func SplitPermissions(permissions string) []string {
+
+	var vs = []string{}
+
+	for _, v := range strings.Split(permissions, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			vs = append(vs, v)
+		}
+	}
+
+	return vs
+}
+
+func RoleCacheKey(a *UserApp, uid int64) string {
+	return fmt.Sprintf("%s.%d", a.RoleCacheKey, uid)
+}
+
+func removeRoleCache(a *UserApp, uid int64) {
+	var cache = cache.CacheRemoveTask{}
+	cache.Key = RoleCacheKey(a, uid)
+	app.Handle(a, &cache)
+}
+
+/**
+ * 租户可见的角色: 租户自己的角色或共享角色
+ */
+func GetUserRole(a *UserApp, db *sql.DB, tid int64, name string) (*UserRole, error) {
+
+	var v = UserRole{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserRoleTable, a.DB.Prefix, " WHERE name=? AND tid IN (0,?) ORDER BY tid DESC LIMIT 1", name, tid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &v, nil
+	}
+
+	return nil, nil
+}
+
+func getRolePermissions(a *UserApp, db *sql.DB, sql string, args ...interface{}) ([]UserRolePermission, error) {
+
+	var vs = []UserRolePermission{}
+	var v = UserRolePermission{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserRolePermissionTable, a.DB.Prefix, sql, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		vs = append(vs, v)
+	}
+
+	return vs, nil
+}
+
+func setRolePermissions(a *UserApp, db *sql.DB, v *UserRole, permissions []string) error {
+
+	var prefix = a.DB.Prefix
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE rid=?", prefix, a.UserRolePermissionTable.Name), v.Id)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, permission := range permissions {
+
+		var p = UserRolePermission{}
+		p.Rid = v.Id
+		p.Permission = permission
+
+		_, err = kk.DBInsert(tx, &a.UserRolePermissionTable, prefix, &p)
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	v.Permissions = permissions
+
+	return nil
+}
+
+func CreateUserRole(a *UserApp, db *sql.DB, tid int64, name string, title string, permissions []string) (*UserRole, error) {
+
+	var v = UserRole{}
+
+	v.Tid = tid
+	v.Name = name
+	v.Title = title
+	v.Ctime = time.Now().Unix()
+
+	r, err := kk.DBInsert(db, &a.UserRoleTable, a.DB.Prefix, &v)
+
+	if err == nil {
+		v.Id, err = r.LastInsertId()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setRolePermissions(a, db, &v, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func AssignUserRole(a *UserApp, db *sql.DB, uid int64, role *UserRole) error {
+
+	count, err := kk.DBQueryCount(db, &a.UserRoleGrantTable, a.DB.Prefix, " WHERE uid=? AND rid=?", uid, role.Id)
+
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+
+		var v = UserRoleGrant{}
+		v.Uid = uid
+		v.Rid = role.Id
+		v.Ctime = time.Now().Unix()
+
+		_, err = kk.DBInsert(db, &a.UserRoleGrantTable, a.DB.Prefix, &v)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	removeRoleCache(a, uid)
+
+	return nil
+}
+
+/**
+ * 用户的全部权限, 只包含租户可见的角色, 经 ClientCache 缓存
+ */
+func GetUserPermissions(a *UserApp, db *sql.DB, tid int64, uid int64) ([]string, error) {
+
+	var key = RoleCacheKey(a, uid)
+
+	{
+		var cache = cache.CacheTask{}
+		cache.Key = key
+		var err = app.Handle(a, &cache)
+		if err == nil && cache.Result.Errno == 0 && cache.Result.Value != "" {
+			var vs = []string{}
+			err = json.Decode([]byte(cache.Result.Value), &vs)
+			if err == nil {
+				return vs, nil
+			}
+		}
+	}
+
+	ps, err := getRolePermissions(a, db, fmt.Sprintf(" WHERE rid IN (SELECT rid FROM %s%s WHERE uid=?) AND rid IN (SELECT id FROM %s%s WHERE tid IN (0,?))",
+		a.DB.Prefix, a.UserRoleGrantTable.Name, a.DB.Prefix, a.UserRoleTable.Name), uid, tid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var vs = []string{}
+
+	for _, p := range ps {
+		vs = append(vs, p.Permission)
+	}
+
+	{
+		var cache = cache.CacheSetTask{}
+		cache.Key = key
+		cache.Expires = a.Expires
+		b, _ := json.Encode(vs)
+		cache.Value = string(b)
+		app.Handle(a, &cache)
+	}
+
+	return vs, nil
+}
+
+func (S *UserService) HandleUserRoleCreateTask(a *UserApp, task *UserRoleCreateTask) error {
+
+	if task.Name == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+		task.Result.Errmsg = "Not found name"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	v, err := GetUserRole(a, db, task.Tid, task.Name)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v != nil {
+		task.Result.Errno = ERROR_USER_ROLE_EXISTS
+		task.Result.Errmsg = "The role already exists"
+		return nil
+	}
+
+	v, err = CreateUserRole(a, db, task.Tid, task.Name, task.Title, SplitPermissions(task.Permissions))
+
+	if IsDuplicateKeyError(err) {
+		task.Result.Errno = ERROR_USER_ROLE_EXISTS
+		task.Result.Errmsg = "The role already exists"
+		return nil
+	}
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Role = v
+
+	return nil
+}
+
+func (S *UserService) HandleUserRoleSetTask(a *UserApp, task *UserRoleSetTask) error {
+
+	if task.Name == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+		task.Result.Errmsg = "Not found name"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	v, err := GetUserRole(a, db, task.Tid, task.Name)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil || v.Tid != task.Tid {
+		task.Result.Errno = ERROR_USER_ROLE
+		task.Result.Errmsg = "Not found role"
+		return nil
+	}
+
+	if task.Title != "" && task.Title != v.Title {
+
+		v.Title = task.Title
+
+		_, err = kk.DBUpdateWithKeys(db, &a.UserRoleTable, a.DB.Prefix, v, map[string]bool{"title": true})
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+	}
+
+	err = setRolePermissions(a, db, v, SplitPermissions(task.Permissions))
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	{
+		var g = UserRoleGrant{}
+		var scanner = kk.NewDBScaner(&g)
+
+		rows, err := kk.DBQuery(db, &a.UserRoleGrantTable, a.DB.Prefix, " WHERE rid=?", v.Id)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+
+			err = scanner.Scan(rows)
+
+			if err != nil {
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+				return nil
+			}
+
+			removeRoleCache(a, g.Uid)
+		}
+	}
+
+	task.Result.Role = v
+
+	return nil
+}
+
+func (S *UserService) HandleUserRoleAssignTask(a *UserApp, task *UserRoleAssignTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	u, err := getTenantUser(a, db, task.Tid, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if u == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
+
+	v, err := GetUserRole(a, db, task.Tid, task.Role)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil {
+		task.Result.Errno = ERROR_USER_ROLE
+		task.Result.Errmsg = "Not found role"
+		return nil
+	}
+
+	err = AssignUserRole(a, db, task.Uid, v)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	return nil
+}
+
+func (S *UserService) HandleUserRoleRevokeTask(a *UserApp, task *UserRoleRevokeTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	u, err := getTenantUser(a, db, task.Tid, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if u == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
+
+	v, err := GetUserRole(a, db, task.Tid, task.Role)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil {
+		task.Result.Errno = ERROR_USER_ROLE
+		task.Result.Errmsg = "Not found role"
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE uid=? AND rid=?", a.DB.Prefix, a.UserRoleGrantTable.Name), task.Uid, v.Id)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	removeRoleCache(a, task.Uid)
+
+	return nil
+}
+
+func (S *UserService) HandleUserRoleQueryTask(a *UserApp, task *UserRoleQueryTask) error {
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+	var roles = []UserRole{}
+	var v = UserRole{}
+	var scanner = kk.NewDBScaner(&v)
+	var rows *sql.Rows = nil
+
+	if task.Uid != 0 {
+
+		var u *User = nil
+
+		u, err = getTenantUser(a, db, task.Tid, task.Uid)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if u == nil {
+			task.Result.Errno = ERROR_USER_NOT_FOUND
+			task.Result.Errmsg = "Not found user"
+			return nil
+		}
+
+		rows, err = kk.DBQuery(db, &a.UserRoleTable, prefix, fmt.Sprintf(" WHERE id IN (SELECT rid FROM %s%s WHERE uid=?) AND tid IN (0,?) ORDER BY id ASC", prefix, a.UserRoleGrantTable.Name), task.Uid, task.Tid)
+	} else {
+		rows, err = kk.DBQuery(db, &a.UserRoleTable, prefix, " WHERE tid IN (0,?) ORDER BY id ASC", task.Tid)
+	}
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	var index = map[int64]int{}
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		v.Permissions = []string{}
+		index[v.Id] = len(roles)
+		roles = append(roles, v)
+	}
+
+	if len(roles) > 0 {
+
+		var sql = bytes.NewBufferString(" WHERE rid IN (")
+		var args = []interface{}{}
+
+		for i, role := range roles {
+			if i != 0 {
+				sql.WriteString(",")
+			}
+			sql.WriteString("?")
+			args = append(args, role.Id)
+		}
+
+		sql.WriteString(") ORDER BY id ASC")
+
+		ps, err := getRolePermissions(a, db, sql.String(), args...)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		for _, p := range ps {
+			if i, ok := index[p.Rid]; ok {
+				roles[i].Permissions = append(roles[i].Permissions, p.Permission)
+			}
+		}
+	}
+
+	task.Result.Roles = roles
+
+	return nil
+}
+
+func (S *UserService) HandleUserCanTask(a *UserApp, task *UserCanTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	if task.Permission == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_PERMISSION
+		task.Result.Errmsg = "Not found permission"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	u, err := LoadUser(a, db, task.Tid, task.Uid, "")
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if u == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
+
+	if !CheckUserStatus(u, &task.Result.Result) {
+		return nil
+	}
+
+	permissions, err := GetUserPermissions(a, db, task.Tid, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	for _, p := range permissions {
+		if MatchPermission(p, task.Permission) {
+			task.Result.Allow = true
+			break
+		}
+	}
+
+	return nil
+}
+
+/**
+ * 初始化角色 (Roles) 和初始化用户的角色 (UserRoles)
+ */
+func (S *UserService) initRoles(a *UserApp, db *sql.DB) {
+
+	for name, permissions := range S.Roles {
+
+		v, err := GetUserRole(a, db, 0, name)
+
+		if err == nil && v == nil {
+			_, err = CreateUserRole(a, db, 0, name, name, SplitPermissions(dynamic.StringValue(permissions, "")))
+			if err == nil {
+				log.Println("Create Role " + name)
+			}
+		}
+
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (S *UserService) initUserRoles(a *UserApp, db *sql.DB, v *User) {
+
+	if S.UserRoles == nil {
+		return
+	}
+
+	names, ok := S.UserRoles[v.Name]
+
+	if !ok {
+		return
+	}
+
+	for _, name := range SplitPermissions(dynamic.StringValue(names, "")) {
+
+		role, err := GetUserRole(a, db, v.Tid, name)
+
+		if err == nil && role == nil {
+			err = fmt.Errorf("Not found role %s", name)
+		}
+
+		if err == nil {
+			err = AssignUserRole(a, db, v.Id, role)
+		}
+
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
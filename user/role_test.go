@@ -0,0 +1,38 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchPermission(t *testing.T) {
+
+	var cases = []struct {
+		granted    string
+		permission string
+		want       bool
+	}{
+		{"*", "user.create", true},
+		{"user.create", "user.create", true},
+		{"user.*", "user.create", true},
+		{"user.*", "user.group.add", true},
+		{"user.*", "user", false},
+		{"user.*", "users.create", false},
+		{"user.create", "user.remove", false},
+	}
+
+	for _, c := range cases {
+		if MatchPermission(c.granted, c.permission) != c.want {
+			t.Errorf("MatchPermission(%q, %q) != %v", c.granted, c.permission, c.want)
+		}
+	}
+}
+
+func TestSplitPermissions(t *testing.T) {
+
+	vs := SplitPermissions(" user.create, ,user.* ")
+
+	if !reflect.DeepEqual(vs, []string{"user.create", "user.*"}) {
+		t.Fatalf("SplitPermissions %v", vs)
+	}
+}
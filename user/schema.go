@@ -0,0 +1,684 @@
+package user
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/dynamic"
+	"github.com/kkserver/kk-lib/kk/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/**
+ * 配置的 JSON Schema, 按配置名注册
+ * 数据库中的优先, 其次为 app.ini 中 OptionsSchemas (name=schema 文件路径)
+ * 支持 type, enum, const, properties, required, additionalProperties, items,
+ * minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf,
+ * minLength, maxLength, pattern, minItems, maxItems, uniqueItems,
+ * minProperties, maxProperties, allOf, anyOf, oneOf, not, default
+ */
+type UserOptionsSchema struct {
+	Id     int64  `json:"id"`
+	Name   string `json:"name"`
+	Schema string `json:"schema"`
+	Ctime  int64  `json:"ctime"`
+	Mtime  int64  `json:"mtime"`
+}
+
+type UserOptionsSchemaError struct {
+	Path    string `json:"path"` // JSON Pointer
+	Message string `json:"message"`
+}
+
+type userOptionsSchemaCacheItem struct {
+	schema  interface{}
+	expires int64
+}
+
+/**
+ * 进程内 Schema 缓存, 不存在的配置名也会缓存, 最多 userOptionsSchemaCacheSize 个
+ */
+const userOptionsSchemaCacheSize = 1024
+
+var userOptionsSchemaCache = map[string]userOptionsSchemaCacheItem{}
+var userOptionsSchemaLock = sync.Mutex{}
+
+/**
+ * 写入缓存, 已满时先删除过期项, 仍满时随机删除一项
+ */
+func setUserOptionsSchemaCache(name string, item userOptionsSchemaCacheItem, now int64) {
+
+	userOptionsSchemaLock.Lock()
+	defer userOptionsSchemaLock.Unlock()
+
+	if _, ok := userOptionsSchemaCache[name]; !ok && len(userOptionsSchemaCache) >= userOptionsSchemaCacheSize {
+
+		for key, v := range userOptionsSchemaCache {
+			if v.expires <= now {
+				delete(userOptionsSchemaCache, key)
+			}
+		}
+
+		for key := range userOptionsSchemaCache {
+			if len(userOptionsSchemaCache) < userOptionsSchemaCacheSize {
+				break
+			}
+			delete(userOptionsSchemaCache, key)
+		}
+	}
+
+	userOptionsSchemaCache[name] = item
+}
+
+func ParseUserOptionsSchema(text string) (map[string]interface{}, error) {
+
+	var object interface{} = nil
+
+	err := json.Decode([]byte(text), &object)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err.Error())
+	}
+
+	schema, ok := object.(map[string]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("invalid schema: must be an object")
+	}
+
+	return schema, nil
+}
+
+/**
+ * 取配置名的 Schema, 没有时返回 nil
+ * 进程内缓存 SchemaExpires 秒 (默认 60), Schema 变更后其他实例最多延迟该时间生效
+ */
+func GetUserOptionsSchema(a *UserApp, db *sql.DB, name string) (map[string]interface{}, error) {
+
+	var now = time.Now().Unix()
+
+	userOptionsSchemaLock.Lock()
+	item, ok := userOptionsSchemaCache[name]
+	userOptionsSchemaLock.Unlock()
+
+	if ok && item.expires > now {
+		if item.schema == nil {
+			return nil, nil
+		}
+		return item.schema.(map[string]interface{}), nil
+	}
+
+	var text = ""
+	var v = UserOptionsSchema{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserOptionsSchemaTable, a.DB.Prefix, " WHERE name=?", name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.Next() {
+		err = scanner.Scan(rows)
+		text = v.Schema
+	}
+
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if text == "" && a.OptionsSchemas != nil {
+
+		var path = dynamic.StringValue(a.OptionsSchemas[name], "")
+
+		if path != "" {
+
+			b, err := ioutil.ReadFile(path)
+
+			if err != nil {
+				return nil, err
+			}
+
+			text = string(b)
+		}
+	}
+
+	var schema map[string]interface{} = nil
+
+	if text != "" {
+
+		schema, err = ParseUserOptionsSchema(text)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var expires = a.SchemaExpires
+
+	if expires <= 0 {
+		expires = 60
+	}
+
+	if schema == nil {
+		setUserOptionsSchemaCache(name, userOptionsSchemaCacheItem{nil, now + expires}, now)
+	} else {
+		setUserOptionsSchemaCache(name, userOptionsSchemaCacheItem{schema, now + expires}, now)
+	}
+
+	return schema, nil
+}
+
+func removeUserOptionsSchemaCache(name string) {
+	userOptionsSchemaLock.Lock()
+	delete(userOptionsSchemaCache, name)
+	userOptionsSchemaLock.Unlock()
+}
+
+func jsonPointerEscape(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+func jsonSchemaType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func jsonSchemaTypeMatch(value interface{}, stype string) bool {
+	var t = jsonSchemaType(value)
+	return t == stype || (stype == "number" && t == "integer")
+}
+
+func jsonSchemaNumber(schema map[string]interface{}, key string) (float64, bool) {
+	v, ok := schema[key].(float64)
+	return v, ok
+}
+
+/**
+ * 校验 value, 返回全部错误
+ */
+func ValidateJSONSchema(schema map[string]interface{}, value interface{}, path string) []UserOptionsSchemaError {
+
+	var errors = []UserOptionsSchemaError{}
+
+	var fail = func(format string, args ...interface{}) {
+		var p = path
+		if p == "" {
+			p = "/"
+		}
+		errors = append(errors, UserOptionsSchemaError{p, fmt.Sprintf(format, args...)})
+	}
+
+	if t, ok := schema["type"]; ok {
+
+		var types = []string{}
+
+		switch tv := t.(type) {
+		case string:
+			types = append(types, tv)
+		case []interface{}:
+			for _, item := range tv {
+				if s, ok := item.(string); ok {
+					types = append(types, s)
+				}
+			}
+		}
+
+		var matched = false
+
+		for _, stype := range types {
+			if jsonSchemaTypeMatch(value, stype) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			fail("must be %s", strings.Join(types, " or "))
+			return errors
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+
+		var matched = false
+
+		for _, item := range enum {
+			if jsonPatchEqual(item, value) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			b, _ := json.Encode(enum)
+			fail("must be one of %s", string(b))
+		}
+	}
+
+	if c, ok := schema["const"]; ok && !jsonPatchEqual(c, value) {
+		b, _ := json.Encode(c)
+		fail("must be %s", string(b))
+	}
+
+	switch v := value.(type) {
+	case float64:
+
+		if n, ok := jsonSchemaNumber(schema, "minimum"); ok && v < n {
+			fail("must be >= %s", strconv.FormatFloat(n, 'f', -1, 64))
+		}
+
+		if n, ok := jsonSchemaNumber(schema, "maximum"); ok && v > n {
+			fail("must be <= %s", strconv.FormatFloat(n, 'f', -1, 64))
+		}
+
+		if n, ok := jsonSchemaNumber(schema, "exclusiveMinimum"); ok && v <= n {
+			fail("must be > %s", strconv.FormatFloat(n, 'f', -1, 64))
+		}
+
+		if n, ok := jsonSchemaNumber(schema, "exclusiveMaximum"); ok && v >= n {
+			fail("must be < %s", strconv.FormatFloat(n, 'f', -1, 64))
+		}
+
+		if n, ok := jsonSchemaNumber(schema, "multipleOf"); ok && n > 0 {
+			q := v / n
+			if math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("must be a multiple of %s", strconv.FormatFloat(n, 'f', -1, 64))
+			}
+		}
+
+	case string:
+
+		var length = float64(utf8.RuneCountInString(v))
+
+		if n, ok := jsonSchemaNumber(schema, "minLength"); ok && length < n {
+			fail("must be at least %d characters", int(n))
+		}
+
+		if n, ok := jsonSchemaNumber(schema, "maxLength"); ok && length > n {
+			fail("must be at most %d characters", int(n))
+		}
+
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				fail("invalid pattern %q in schema", pattern)
+			} else if !re.MatchString(v) {
+				fail("must match pattern %q", pattern)
+			}
+		}
+
+	case []interface{}:
+
+		var length = float64(len(v))
+
+		if n, ok := jsonSchemaNumber(schema, "minItems"); ok && length < n {
+			fail("must have at least %d items", int(n))
+		}
+
+		if n, ok := jsonSchemaNumber(schema, "maxItems"); ok && length > n {
+			fail("must have at most %d items", int(n))
+		}
+
+		if unique, ok := schema["uniqueItems"].(bool); ok && unique {
+			for i := 0; i < len(v); i++ {
+				for j := i + 1; j < len(v); j++ {
+					if jsonPatchEqual(v[i], v[j]) {
+						fail("items %d and %d must be unique", i, j)
+					}
+				}
+			}
+		}
+
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				errors = append(errors, ValidateJSONSchema(items, item, path+"/"+strconv.Itoa(i))...)
+			}
+		}
+
+	case map[string]interface{}:
+
+		var length = float64(len(v))
+
+		if n, ok := jsonSchemaNumber(schema, "minProperties"); ok && length < n {
+			fail("must have at least %d properties", int(n))
+		}
+
+		if n, ok := jsonSchemaNumber(schema, "maxProperties"); ok && length > n {
+			fail("must have at most %d properties", int(n))
+		}
+
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, item := range required {
+				if key, ok := item.(string); ok {
+					if _, ok := v[key]; !ok {
+						errors = append(errors, UserOptionsSchemaError{path + "/" + jsonPointerEscape(key), "is required"})
+					}
+				}
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+
+		var keys = []string{}
+
+		for key, _ := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+
+			var p = path + "/" + jsonPointerEscape(key)
+
+			if s, ok := properties[key].(map[string]interface{}); ok {
+				errors = append(errors, ValidateJSONSchema(s, v[key], p)...)
+				continue
+			}
+
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					errors = append(errors, UserOptionsSchemaError{p, "is not allowed"})
+				}
+			case map[string]interface{}:
+				errors = append(errors, ValidateJSONSchema(additional, v[key], p)...)
+			}
+		}
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, item := range all {
+			if s, ok := item.(map[string]interface{}); ok {
+				errors = append(errors, ValidateJSONSchema(s, value, path)...)
+			}
+		}
+	}
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+
+		var matched = false
+
+		for _, item := range anyOf {
+			if s, ok := item.(map[string]interface{}); ok && len(ValidateJSONSchema(s, value, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			fail("must match at least one schema in anyOf")
+		}
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+
+		var count = 0
+
+		for _, item := range oneOf {
+			if s, ok := item.(map[string]interface{}); ok && len(ValidateJSONSchema(s, value, path)) == 0 {
+				count = count + 1
+			}
+		}
+
+		if count != 1 {
+			fail("must match exactly one schema in oneOf")
+		}
+	}
+
+	if not, ok := schema["not"].(map[string]interface{}); ok && len(ValidateJSONSchema(not, value, path)) == 0 {
+		fail("must not match the schema in not")
+	}
+
+	return errors
+}
+
+/**
+ * 用 Schema 中的 default 填充缺失的值
+ */
+func ApplyJSONSchemaDefaults(schema map[string]interface{}, value interface{}) interface{} {
+
+	if value == nil {
+
+		d, ok := schema["default"]
+
+		if ok {
+			b, _ := json.Encode(d)
+			var v interface{} = nil
+			json.Decode(b, &v)
+			return v
+		}
+
+		if _, ok := schema["properties"]; !ok || (schema["type"] != nil && schema["type"] != "object") {
+			return nil
+		}
+
+		value = map[string]interface{}{}
+	}
+
+	object, ok := value.(map[string]interface{})
+
+	if !ok {
+		return value
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	for key, item := range properties {
+
+		s, ok := item.(map[string]interface{})
+
+		if !ok {
+			continue
+		}
+
+		if vv, ok := object[key]; ok {
+			object[key] = ApplyJSONSchemaDefaults(s, vv)
+		} else if vv := ApplyJSONSchemaDefaults(s, nil); vv != nil {
+			object[key] = vv
+		}
+	}
+
+	return object
+}
+
+/**
+ * 用配置名的 Schema 填充默认值, 读取 Schema 失败时原样返回
+ */
+func ApplyUserOptionsDefaults(a *UserApp, db *sql.DB, name string, options interface{}) interface{} {
+
+	schema, err := GetUserOptionsSchema(a, db, name)
+
+	if err != nil {
+		log.Println("[ApplyUserOptionsDefaults]" + err.Error())
+		return options
+	}
+
+	if schema == nil {
+		return options
+	}
+
+	return ApplyJSONSchemaDefaults(schema, options)
+}
+
+func formatUserOptionsSchemaErrors(errors []UserOptionsSchemaError) string {
+
+	var b = bytes.NewBuffer(nil)
+
+	for i, e := range errors {
+		if i != 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(e.Path)
+		b.WriteString(" ")
+		b.WriteString(e.Message)
+	}
+
+	return b.String()
+}
+
+func (S *UserService) HandleUserOptionsSchemaSetTask(a *UserApp, task *UserOptionsSchemaSetTask) error {
+
+	if task.Name == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+		task.Result.Errmsg = "Not found name"
+		return nil
+	}
+
+	_, err := ParseUserOptionsSchema(task.Schema)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER_OPTIONS_INVALID
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var v = UserOptionsSchema{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserOptionsSchemaTable, a.DB.Prefix, " WHERE name=?", task.Name)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var exists = rows.Next()
+
+	if exists {
+		err = scanner.Scan(rows)
+	}
+
+	rows.Close()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	v.Name = task.Name
+	v.Schema = task.Schema
+	v.Mtime = time.Now().Unix()
+
+	if exists {
+		_, err = kk.DBUpdateWithKeys(db, &a.UserOptionsSchemaTable, a.DB.Prefix, &v, map[string]bool{"schema": true, "mtime": true})
+	} else {
+		v.Ctime = v.Mtime
+		var r sql.Result = nil
+		r, err = kk.DBInsert(db, &a.UserOptionsSchemaTable, a.DB.Prefix, &v)
+		if err == nil {
+			v.Id, err = r.LastInsertId()
+		}
+	}
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	removeUserOptionsSchemaCache(task.Name)
+
+	task.Result.Schema = &v
+
+	return nil
+}
+
+func (S *UserService) HandleUserOptionsSchemaGetTask(a *UserApp, task *UserOptionsSchemaGetTask) error {
+
+	if task.Name == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+		task.Result.Errmsg = "Not found name"
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	removeUserOptionsSchemaCache(task.Name)
+
+	schema, err := GetUserOptionsSchema(a, db, task.Name)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Schema = schema
+
+	return nil
+}
+
+func (S *UserService) HandleUserOptionsSchemaRemoveTask(a *UserApp, task *UserOptionsSchemaRemoveTask) error {
+
+	if task.Name == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+		task.Result.Errmsg = "Not found name"
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE name=?", a.DB.Prefix, a.UserOptionsSchemaTable.Name), task.Name)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	removeUserOptionsSchemaCache(task.Name)
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package user
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestValidateJSONSchema(t *testing.T) {
+
+	schema, err := ParseUserOptionsSchema(`{
+		"type": "object",
+		"required": ["theme"],
+		"additionalProperties": false,
+		"properties": {
+			"theme": {"type": "string", "enum": ["light", "dark"]},
+			"size": {"type": "integer", "minimum": 8, "maximum": 32, "multipleOf": 2},
+			"ratio": {"type": "number", "exclusiveMinimum": 0, "exclusiveMaximum": 1},
+			"name": {"type": "string", "minLength": 2, "maxLength": 4, "pattern": "^[a-z]+$"},
+			"tags": {"type": "array", "minItems": 1, "maxItems": 3, "uniqueItems": true, "items": {"type": "string"}},
+			"a/b": {"const": 1},
+			"id": {"oneOf": [{"type": "string"}, {"type": "integer"}]},
+			"color": {"anyOf": [{"type": "string"}, {"type": "null"}], "not": {"const": "red"}}
+		}
+	}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		value string
+		paths []string
+	}{
+		{`{"theme":"dark","size":16,"ratio":0.5,"name":"ab","tags":["x"],"a/b":1,"id":"x","color":null}`, []string{}},
+		{`{}`, []string{"/theme"}},
+		{`[]`, []string{"/"}},
+		{`{"theme":"blue"}`, []string{"/theme"}},
+		{`{"theme":"dark","size":7}`, []string{"/size"}},
+		{`{"theme":"dark","size":34}`, []string{"/size"}},
+		{`{"theme":"dark","size":9}`, []string{"/size"}},
+		{`{"theme":"dark","size":8.5}`, []string{"/size"}},
+		{`{"theme":"dark","ratio":1}`, []string{"/ratio"}},
+		{`{"theme":"dark","name":"a"}`, []string{"/name"}},
+		{`{"theme":"dark","name":"abcde"}`, []string{"/name"}},
+		{`{"theme":"dark","name":"AB"}`, []string{"/name"}},
+		{`{"theme":"dark","tags":[]}`, []string{"/tags"}},
+		{`{"theme":"dark","tags":["x","x"]}`, []string{"/tags"}},
+		{`{"theme":"dark","tags":["x",1]}`, []string{"/tags/1"}},
+		{`{"theme":"dark","a/b":2}`, []string{"/a~1b"}},
+		{`{"theme":"dark","id":true}`, []string{"/id"}},
+		{`{"theme":"dark","color":1}`, []string{"/color"}},
+		{`{"theme":"dark","color":"red"}`, []string{"/color"}},
+		{`{"theme":"dark","other":1}`, []string{"/other"}},
+		{`{"size":"x","other":1}`, []string{"/theme", "/other", "/size"}},
+	}
+
+	for _, c := range cases {
+
+		var errors = ValidateJSONSchema(schema, decodePatchTestValue(t, c.value), "")
+
+		var paths = map[string]bool{}
+
+		for _, e := range errors {
+			paths[e.Path] = true
+		}
+
+		if len(paths) != len(c.paths) {
+			t.Errorf("%s: errors %v, want paths %v", c.value, errors, c.paths)
+			continue
+		}
+
+		for _, p := range c.paths {
+			if !paths[p] {
+				t.Errorf("%s: errors %v, want path %s", c.value, errors, p)
+			}
+		}
+	}
+}
+
+func TestApplyJSONSchemaDefaults(t *testing.T) {
+
+	schema, err := ParseUserOptionsSchema(`{
+		"type": "object",
+		"properties": {
+			"theme": {"type": "string", "default": "light"},
+			"editor": {"type": "object", "properties": {"tab": {"default": 4}, "wrap": {"type": "boolean"}}},
+			"tags": {"type": "array", "default": ["a"]}
+		}
+	}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v = ApplyJSONSchemaDefaults(schema, decodePatchTestValue(t, `{"theme":"dark"}`))
+
+	if !jsonPatchEqual(v, decodePatchTestValue(t, `{"theme":"dark","editor":{"tab":4},"tags":["a"]}`)) {
+		t.Fatalf("defaults %v", v)
+	}
+
+	v = ApplyJSONSchemaDefaults(schema, nil)
+
+	if !jsonPatchEqual(v, decodePatchTestValue(t, `{"theme":"light","editor":{"tab":4},"tags":["a"]}`)) {
+		t.Fatalf("defaults %v", v)
+	}
+
+	v.(map[string]interface{})["tags"].([]interface{})[0] = "b"
+
+	if !jsonPatchEqual(schema["properties"].(map[string]interface{})["tags"].(map[string]interface{})["default"], []interface{}{"a"}) {
+		t.Fatal("default shared with schema")
+	}
+}
+
+func TestParseUserOptionsSchema(t *testing.T) {
+
+	if _, err := ParseUserOptionsSchema(`[]`); err == nil {
+		t.Fatal("array schema accepted")
+	}
+
+	if _, err := ParseUserOptionsSchema(`{`); err == nil {
+		t.Fatal("invalid json accepted")
+	}
+}
+
+func TestUserOptionsSchemaCacheSize(t *testing.T) {
+
+	defer func() {
+		userOptionsSchemaLock.Lock()
+		userOptionsSchemaCache = map[string]userOptionsSchemaCacheItem{}
+		userOptionsSchemaLock.Unlock()
+	}()
+
+	for i := 0; i < userOptionsSchemaCacheSize*2; i++ {
+		setUserOptionsSchemaCache(fmt.Sprintf("name%d", i), userOptionsSchemaCacheItem{nil, 100}, 0)
+	}
+
+	if n := len(userOptionsSchemaCache); n != userOptionsSchemaCacheSize {
+		t.Fatalf("cache size %d", n)
+	}
+
+	setUserOptionsSchemaCache("last", userOptionsSchemaCacheItem{nil, 300}, 200)
+
+	if n := len(userOptionsSchemaCache); n != 1 {
+		t.Fatalf("expired items kept, cache size %d", n)
+	}
+}
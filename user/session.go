@@ -0,0 +1,407 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/kkserver/kk-cache/cache"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/app"
+	"github.com/kkserver/kk-lib/kk/json"
+	"time"
+)
+
+type UserSession struct {
+	Id     int64  `json:"id"`
+	Tid    int64  `json:"tid"` // 租户
+	Uid    int64  `json:"uid"`
+	Token  string `json:"-"` // sha256(token)
+	Device string `json:"device,omitempty"`
+	Addr   string `json:"addr,omitempty"`
+	Ctime  int64  `json:"ctime"`
+	Atime  int64  `json:"atime"`
+	Etime  int64  `json:"etime"`
+}
+
+func NewSessionToken() (string, error) {
+
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func EncodeSessionToken(token string) string {
+	v := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(v[:])
+}
+
+func SessionCacheKey(a *UserApp, hash string) string {
+	return fmt.Sprintf("%s.%s", a.SessionCacheKey, hash)
+}
+
+/**
+ * 创建会话, 返回的 token 只在此处出现, 数据库中仅保存其哈希
+ */
+func NewUserSession(a *UserApp, db *sql.DB, tid int64, uid int64, device string, addr string, expires int64) (*UserSession, string, error) {
+
+	token, err := NewSessionToken()
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if expires <= 0 {
+		expires = a.SessionExpires
+	}
+
+	var v = UserSession{}
+
+	v.Tid = tid
+	v.Uid = uid
+	v.Token = EncodeSessionToken(token)
+	v.Device = device
+	v.Addr = addr
+	v.Ctime = time.Now().Unix()
+	v.Atime = v.Ctime
+	v.Etime = v.Ctime + expires
+
+	_, err = kk.DBInsert(db, &a.UserSessionTable, a.DB.Prefix, &v)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &v, token, nil
+}
+
+func setSessionCache(a *UserApp, v *UserSession) {
+
+	var expires = v.Etime - time.Now().Unix()
+
+	if expires > a.Expires {
+		expires = a.Expires
+	}
+
+	if expires <= 0 {
+		return
+	}
+
+	var cache = cache.CacheSetTask{}
+	cache.Key = SessionCacheKey(a, v.Token)
+	cache.Expires = expires
+	b, _ := json.Encode(v)
+	cache.Value = string(b)
+	app.Handle(a, &cache)
+}
+
+func removeSessionCache(a *UserApp, hash string) {
+	var cache = cache.CacheRemoveTask{}
+	cache.Key = SessionCacheKey(a, hash)
+	app.Handle(a, &cache)
+}
+
+func (S *UserService) HandleUserSessionValidateTask(a *UserApp, task *UserSessionValidateTask) error {
+
+	if task.Token == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_TOKEN
+		task.Result.Errmsg = "Not found token"
+		return nil
+	}
+
+	var hash = EncodeSessionToken(task.Token)
+	var now = time.Now().Unix()
+
+	{
+		var cache = cache.CacheTask{}
+		cache.Key = SessionCacheKey(a, hash)
+		var err = app.Handle(a, &cache)
+		if err == nil && cache.Result.Errno == 0 && cache.Result.Value != "" {
+			var vv = UserSession{}
+			err = json.Decode([]byte(cache.Result.Value), &vv)
+			if err == nil && vv.Etime > now && vv.Tid == task.Tid {
+				task.Result.Session = &vv
+				return nil
+			}
+		}
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+	var v = UserSession{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserSessionTable, prefix, " WHERE token=? AND tid=?", hash, task.Tid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if v.Etime <= now {
+			task.Result.Errno = ERROR_USER_SESSION
+			task.Result.Errmsg = "The session has expired"
+			return nil
+		}
+
+		v.Atime = now
+
+		_, err = kk.DBUpdateWithKeys(db, &a.UserSessionTable, prefix, &v, map[string]bool{"atime": true})
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		setSessionCache(a, &v)
+
+		task.Result.Session = &v
+
+	} else {
+		task.Result.Errno = ERROR_USER_SESSION
+		task.Result.Errmsg = "Not found session"
+	}
+
+	return nil
+}
+
+func (S *UserService) HandleUserSessionRefreshTask(a *UserApp, task *UserSessionRefreshTask) error {
+
+	if task.Token == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_TOKEN
+		task.Result.Errmsg = "Not found token"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+	var hash = EncodeSessionToken(task.Token)
+	var now = time.Now().Unix()
+	var v = UserSession{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserSessionTable, prefix, " WHERE token=? AND tid=?", hash, task.Tid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if v.Etime <= now {
+			task.Result.Errno = ERROR_USER_SESSION
+			task.Result.Errmsg = "The session has expired"
+			return nil
+		}
+
+		var expires = task.Expires
+
+		if expires <= 0 {
+			expires = a.SessionExpires
+		}
+
+		v.Atime = now
+		v.Etime = now + expires
+
+		_, err = kk.DBUpdateWithKeys(db, &a.UserSessionTable, prefix, &v, map[string]bool{"atime": true, "etime": true})
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		removeSessionCache(a, hash)
+
+		task.Result.Session = &v
+
+	} else {
+		task.Result.Errno = ERROR_USER_SESSION
+		task.Result.Errmsg = "Not found session"
+	}
+
+	return nil
+}
+
+/**
+ * 按 token, uid+id 或 uid (全部) 注销租户下的会话
+ */
+func (S *UserService) HandleUserSessionRevokeTask(a *UserApp, task *UserSessionRevokeTask) error {
+
+	if task.Token == "" && task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_TOKEN
+		task.Result.Errmsg = "Not found token"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Count, err = RevokeUserSessions(a, db, task.Tid, task.Token, task.Uid, task.Id)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	return nil
+}
+
+func RevokeUserSessions(a *UserApp, db *sql.DB, tid int64, token string, uid int64, id int64) (int64, error) {
+
+	var prefix = a.DB.Prefix
+	var sql = " WHERE tid=?"
+	var args = []interface{}{tid}
+
+	if token != "" {
+		sql = sql + " AND token=?"
+		args = append(args, EncodeSessionToken(token))
+	}
+
+	if uid != 0 {
+		sql = sql + " AND uid=?"
+		args = append(args, uid)
+	}
+
+	if id != 0 {
+		sql = sql + " AND id=?"
+		args = append(args, id)
+	}
+
+	var hashs = []string{}
+	var v = UserSession{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserSessionTable, prefix, sql, args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		hashs = append(hashs, v.Token)
+	}
+
+	rows.Close()
+
+	r, err := db.Exec(fmt.Sprintf("DELETE FROM %s%s", prefix, a.UserSessionTable.Name)+sql, args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, hash := range hashs {
+		removeSessionCache(a, hash)
+	}
+
+	return r.RowsAffected()
+}
+
+func (S *UserService) HandleUserSessionListTask(a *UserApp, task *UserSessionListTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var sessions = []UserSession{}
+	var v = UserSession{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserSessionTable, a.DB.Prefix, " WHERE tid=? AND uid=? AND etime>? ORDER BY atime DESC", task.Tid, task.Uid, time.Now().Unix())
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		sessions = append(sessions, v)
+	}
+
+	task.Result.Sessions = sessions
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package user
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/app"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const UserStatusActive = 0
+const UserStatusDisabled = 1
+const UserStatusLocked = 2
+const UserStatusDeleted = 3
+
+var userStatusNames = map[int]string{
+	UserStatusActive:   "active",
+	UserStatusDisabled: "disabled",
+	UserStatusLocked:   "locked",
+	UserStatusDeleted:  "deleted",
+}
+
+func IsUserStatus(status int) bool {
+	_, ok := userStatusNames[status]
+	return ok
+}
+
+func UserStatusName(status int) string {
+	return userStatusNames[status]
+}
+
+/**
+ * 非 active 状态时设置错误并返回 false
+ */
+func CheckUserStatus(v *User, result *app.Result) bool {
+
+	if v.Status == UserStatusActive {
+		return true
+	}
+
+	if v.Status == UserStatusDeleted {
+		result.Errno = ERROR_USER_NOT_FOUND
+		result.Errmsg = "Not found user"
+		return false
+	}
+
+	result.Errno = ERROR_USER_STATUS
+	result.Errmsg = fmt.Sprintf("The user is %s", UserStatusName(v.Status))
+
+	return false
+}
+
+/**
+ * "0,1" 形式的状态列表, 写入 status IN (...) / NOT IN (...) 条件
+ */
+func WriteUserStatusFilter(sql *bytes.Buffer, args []interface{}, column string, include string, exclude string) ([]interface{}, error) {
+
+	var in = func(s string, not bool) error {
+
+		if s == "" {
+			return nil
+		}
+
+		if not {
+			sql.WriteString(fmt.Sprintf(" AND %s NOT IN (", column))
+		} else {
+			sql.WriteString(fmt.Sprintf(" AND %s IN (", column))
+		}
+
+		for i, v := range strings.Split(s, ",") {
+
+			status, err := strconv.Atoi(strings.TrimSpace(v))
+
+			if err != nil || !IsUserStatus(status) {
+				return fmt.Errorf("Invalid status %s", v)
+			}
+
+			if i != 0 {
+				sql.WriteString(",")
+			}
+
+			sql.WriteString("?")
+			args = append(args, status)
+		}
+
+		sql.WriteString(")")
+
+		return nil
+	}
+
+	if include == "" && exclude == "" {
+		exclude = strconv.Itoa(UserStatusDeleted)
+	}
+
+	err := in(include, false)
+
+	if err != nil {
+		return args, err
+	}
+
+	err = in(exclude, true)
+
+	return args, err
+}
+
+func (S *UserService) HandleUserSetStatusTask(a *UserApp, task *UserSetStatusTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	if !IsUserStatus(task.Status) {
+		task.Result.Errno = ERROR_USER_STATUS
+		task.Result.Errmsg = fmt.Sprintf("Invalid status %d", task.Status)
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+	var v = User{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserTable, prefix, " WHERE id=? AND tid=?", task.Uid, task.Tid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		var diff = UserAuditDiff{}.Set("status", v.Status, task.Status)
+
+		if v.Reason != task.Reason {
+			diff.Set("reason", v.Reason, task.Reason)
+		}
+
+		v.Status = task.Status
+		v.Reason = task.Reason
+		v.Stime = time.Now().Unix()
+		v.Mtime = v.Stime
+
+		var event = UserEventUpdated
+
+		if v.Status == UserStatusDeleted {
+			event = UserEventDeleted
+		}
+
+		tx, err := db.Begin()
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		_, err = kk.DBUpdateWithKeys(tx, &a.UserTable, prefix, &v, map[string]bool{"status": true, "reason": true, "stime": true, "mtime": true})
+
+		if err == nil {
+			err = WriteUserEvent(a, tx, v.Tid, v.Id, event, &v)
+		}
+
+		if err == nil {
+			err = tx.Commit()
+		}
+
+		if err != nil {
+			tx.Rollback()
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		RemoveUserCache(a, v.Tid, v.Id, "")
+		removeRoleCache(a, v.Id)
+
+		if v.Status != UserStatusActive {
+
+			_, err = RevokeUserSessions(a, db, v.Tid, "", v.Id, 0)
+
+			if err != nil {
+				log.Println("[UserService][HandleUserSetStatusTask]" + err.Error())
+			}
+		}
+
+		WriteUserAudit(a, db, v.Tid, v.Id, task.Actor, UserAuditActionSetStatus, diff, task.Source)
+
+		task.Result.User = &v
+
+	} else {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+	}
+
+	return nil
+}
+
+func (S *UserService) HandleUserRestoreTask(a *UserApp, task *UserRestoreTask) error {
+
+	var status = UserSetStatusTask{}
+	status.Tid = task.Tid
+	status.Uid = task.Uid
+	status.Status = UserStatusActive
+	status.Actor = task.Actor
+	status.Source = task.Source
+
+	app.Handle(a, &status)
+
+	task.Result.Result = status.Result.Result
+	task.Result.User = status.Result.User
+
+	return nil
+}
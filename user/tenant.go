@@ -0,0 +1,414 @@
+package user
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"time"
+)
+
+/**
+ * 租户, tid=0 为默认租户 (单租户部署)
+ */
+type UserTenant struct {
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+	Title string `json:"title,omitempty"`
+	Ctime int64  `json:"ctime"`
+	Mtime int64  `json:"mtime"`
+}
+
+func GetUserTenant(a *UserApp, db *sql.DB, id int64) (*UserTenant, error) {
+
+	var v = UserTenant{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserTenantTable, a.DB.Prefix, " WHERE id=?", id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &v, nil
+	}
+
+	return nil, nil
+}
+
+func (S *UserService) HandleUserTenantCreateTask(a *UserApp, task *UserTenantCreateTask) error {
+
+	if task.Name == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_NAME
+		task.Result.Errmsg = "Not found name"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	count, err := kk.DBQueryCount(db, &a.UserTenantTable, a.DB.Prefix, " WHERE name=?", task.Name)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if count > 0 {
+		task.Result.Errno = ERROR_USER_TENANT
+		task.Result.Errmsg = "The tenant name already exists"
+		return nil
+	}
+
+	var v = UserTenant{}
+
+	v.Name = task.Name
+	v.Title = task.Title
+	v.Ctime = time.Now().Unix()
+	v.Mtime = v.Ctime
+
+	r, err := kk.DBInsert(db, &a.UserTenantTable, a.DB.Prefix, &v)
+
+	if err == nil {
+		v.Id, err = r.LastInsertId()
+	}
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Tenant = &v
+
+	return nil
+}
+
+func (S *UserService) HandleUserTenantGetTask(a *UserApp, task *UserTenantGetTask) error {
+
+	if task.Id == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_TENANT
+		task.Result.Errmsg = "Not found tenant id"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	v, err := GetUserTenant(a, db, task.Id)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_TENANT
+		task.Result.Errmsg = "Not found tenant"
+		return nil
+	}
+
+	task.Result.Tenant = v
+
+	return nil
+}
+
+func (S *UserService) HandleUserTenantQueryTask(a *UserApp, task *UserTenantQueryTask) error {
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var tenants = []UserTenant{}
+	var prefix = a.DB.Prefix
+
+	sql := bytes.NewBuffer(nil)
+
+	args := []interface{}{}
+
+	sql.WriteString(" WHERE 1")
+
+	if task.Name != "" {
+		sql.WriteString(" AND name=?")
+		args = append(args, task.Name)
+	}
+
+	if task.OrderBy == "asc" {
+		sql.WriteString(" ORDER BY id ASC")
+	} else {
+		sql.WriteString(" ORDER BY id DESC")
+	}
+
+	var pageIndex = task.PageIndex
+	var pageSize = task.PageSize
+
+	if pageIndex < 1 {
+		pageIndex = 1
+	}
+
+	if pageSize < 1 {
+		pageSize = 10
+	}
+
+	if task.Counter {
+		task.Result.Counter, err = NewUserQueryCounter(db, &a.UserTenantTable, prefix, pageIndex, pageSize, sql.String(), args...)
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+	}
+
+	sql.WriteString(fmt.Sprintf(" LIMIT %d,%d", (pageIndex-1)*pageSize, pageSize))
+
+	var v = UserTenant{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserTenantTable, prefix, sql.String(), args...)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		tenants = append(tenants, v)
+	}
+
+	task.Result.Tenants = tenants
+
+	return nil
+}
+
+/**
+ * 将 From 租户 (默认 0, 即单租户数据) 的全部数据迁移到 To 租户
+ * 包括用户, 配置及其历史, 分组, 会话, 角色, 审计日志, 事件和 Webhook (投递记录随 Webhook 迁移)
+ * From 为 0 时角色是共享角色, 不迁移
+ * 用户名或角色名在目标租户中已存在时拒绝迁移
+ * 旧的配置缓存按原租户键存放, 到期后自然失效
+ */
+func (S *UserService) HandleUserTenantMigrateTask(a *UserApp, task *UserTenantMigrateTask) error {
+
+	if task.To == 0 || task.To == task.From {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_TENANT
+		task.Result.Errmsg = "Not found target tenant id"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+
+	for _, tid := range []int64{task.From, task.To} {
+
+		if tid == 0 {
+			continue
+		}
+
+		t, err := GetUserTenant(a, db, tid)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if t == nil {
+			task.Result.Errno = ERROR_USER_NOT_FOUND_TENANT
+			task.Result.Errmsg = fmt.Sprintf("Not found tenant %d", tid)
+			return nil
+		}
+	}
+
+	var users = []User{} // 迁移的用户, 提交后删除缓存
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	func() {
+
+		count, err := kk.DBQueryCount(tx, &a.UserTable, prefix,
+			fmt.Sprintf(" WHERE tid=? AND name IN (SELECT name FROM (SELECT name FROM %s%s WHERE tid=?) AS t)", prefix, a.UserTable.Name),
+			task.To, task.From)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+		if count > 0 {
+			task.Result.Errno = ERROR_USER_TENANT
+			task.Result.Errmsg = fmt.Sprintf("%d user names already exist in the target tenant", count)
+			return
+		}
+
+		if UserCacheEnabled(a) {
+
+			var v = User{}
+			var scanner = kk.NewDBScaner(&v)
+
+			rows, err := kk.DBQuery(tx, &a.UserTable, prefix, " WHERE tid=?", task.From)
+
+			if err != nil {
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+				return
+			}
+
+			for rows.Next() {
+
+				err = scanner.Scan(rows)
+
+				if err != nil {
+					break
+				}
+
+				users = append(users, v)
+			}
+
+			rows.Close()
+
+			if err != nil {
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+				return
+			}
+		}
+
+		r, err := tx.Exec(fmt.Sprintf("UPDATE %s%s SET tid=? WHERE tid=?", prefix, a.UserTable.Name), task.To, task.From)
+
+		if err == nil {
+			task.Result.Users, err = r.RowsAffected()
+		}
+
+		if IsDuplicateKeyError(err) {
+			task.Result.Errno = ERROR_USER_TENANT
+			task.Result.Errmsg = "User names or identifiers already exist in the target tenant"
+			return
+		}
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+		r, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET tid=? WHERE tid=?", prefix, a.UserOptionsTable.Name), task.To, task.From)
+
+		if err == nil {
+			task.Result.Options, err = r.RowsAffected()
+		}
+
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET tid=? WHERE tid=?", prefix, a.UserOptionsRevisionTable.Name), task.To, task.From)
+		}
+
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET tid=? WHERE tid=?", prefix, a.UserGroupTable.Name), task.To, task.From)
+		}
+
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET tid=? WHERE tid=?", prefix, a.UserSessionTable.Name), task.To, task.From)
+		}
+
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET tid=? WHERE tid=?", prefix, a.UserAuditTable.Name), task.To, task.From)
+		}
+
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET tid=? WHERE tid=?", prefix, a.UserEventTable.Name), task.To, task.From)
+		}
+
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET tid=? WHERE tid=?", prefix, a.UserWebhookTable.Name), task.To, task.From)
+		}
+
+		if err == nil && task.From != 0 {
+
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET tid=? WHERE tid=?", prefix, a.UserRoleTable.Name), task.To, task.From)
+
+			if IsDuplicateKeyError(err) {
+				task.Result.Errno = ERROR_USER_TENANT
+				task.Result.Errmsg = "Role names already exist in the target tenant"
+				return
+			}
+		}
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+	}()
+
+	if task.Result.Errno != 0 {
+		tx.Rollback()
+		return nil
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		tx.Rollback()
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	for _, v := range users {
+		RemoveUserCache(a, task.From, v.Id, v.Name)
+	}
+
+	return nil
+}
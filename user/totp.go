@@ -0,0 +1,684 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/json"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const UserTOTPStatusPending = 0
+const UserTOTPStatusEnabled = 1
+
+const TOTPPeriod = 30
+const TOTPDigits = 6
+const TOTPSkew = 1
+
+const UserRecoveryCodeCount = 10
+
+type UserTOTP struct {
+	Id      int64  `json:"id"`
+	Uid     int64  `json:"uid"`
+	Secret  string `json:"-"` // base32
+	Status  int    `json:"status"`
+	Counter int64  `json:"-"` // 最后一次使用的时间步, 防止重放
+	Ctime   int64  `json:"ctime"`
+	Mtime   int64  `json:"mtime"`
+}
+
+type UserRecoveryCode struct {
+	Id    int64  `json:"id"`
+	Uid   int64  `json:"uid"`
+	Code  string `json:"-"` // sha256(code)
+	Utime int64  `json:"utime"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/**
+ * RFC 6238, HMAC-SHA1
+ */
+func TOTPCode(secret string, counter int64) (string, error) {
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+
+	if err != nil {
+		return "", err
+	}
+
+	var b = make([]byte, 8)
+
+	binary.BigEndian.PutUint64(b, uint64(counter))
+
+	m := hmac.New(sha1.New, key)
+	m.Write(b)
+	h := m.Sum(nil)
+
+	offset := h[len(h)-1] & 0x0f
+	v := binary.BigEndian.Uint32(h[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", TOTPDigits, v%1000000), nil
+}
+
+/**
+ * 返回匹配的时间步, 不匹配返回 0
+ */
+func VerifyTOTPCode(secret string, code string, last int64) int64 {
+
+	var counter = time.Now().Unix() / TOTPPeriod
+
+	for i := int64(-TOTPSkew); i <= TOTPSkew; i++ {
+
+		var c = counter + i
+
+		if c <= last {
+			continue
+		}
+
+		v, err := TOTPCode(secret, c)
+
+		if err == nil && subtle.ConstantTimeCompare([]byte(v), []byte(code)) == 1 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+func NewTOTPSecret() (string, error) {
+
+	b := make([]byte, 20)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func TOTPUri(issuer string, name string, secret string) string {
+
+	var label = url.PathEscape(name)
+	var query = url.Values{}
+
+	query.Set("secret", secret)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%d", TOTPDigits))
+	query.Set("period", fmt.Sprintf("%d", TOTPPeriod))
+
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+		query.Set("issuer", issuer)
+	}
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func NewRecoveryCode() (string, error) {
+
+	b := make([]byte, 10)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	v := strings.ToLower(totpEncoding.EncodeToString(b))
+
+	return v[0:8] + "-" + v[8:16], nil
+}
+
+func EncodeRecoveryCode(code string) string {
+	return EncodeSessionToken(strings.ToLower(strings.Replace(strings.TrimSpace(code), " ", "", -1)))
+}
+
+func GetUserTOTP(a *UserApp, db *sql.DB, uid int64) (*UserTOTP, error) {
+
+	var v = UserTOTP{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserTOTPTable, a.DB.Prefix, " WHERE uid=?", uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &v, nil
+	}
+
+	return nil, nil
+}
+
+func IsUserTOTPEnabled(a *UserApp, db *sql.DB, uid int64) (bool, error) {
+
+	v, err := GetUserTOTP(a, db, uid)
+
+	if err != nil {
+		return false, err
+	}
+
+	return v != nil && v.Status == UserTOTPStatusEnabled, nil
+}
+
+/**
+ * 校验 TOTP 或恢复码, 成功后该码不可再次使用
+ */
+func VerifyUserSecondFactor(a *UserApp, db *sql.DB, v *UserTOTP, code string) (bool, error) {
+
+	code = strings.TrimSpace(code)
+
+	if len(code) == TOTPDigits {
+
+		var counter = VerifyTOTPCode(v.Secret, code, v.Counter)
+
+		if counter == 0 {
+			return false, nil
+		}
+
+		r, err := db.Exec(fmt.Sprintf("UPDATE %s%s SET counter=? WHERE id=? AND counter<?", a.DB.Prefix, a.UserTOTPTable.Name), counter, v.Id, counter)
+
+		if err != nil {
+			return false, err
+		}
+
+		n, err := r.RowsAffected()
+
+		if err != nil {
+			return false, err
+		}
+
+		v.Counter = counter
+
+		return n == 1, nil
+	}
+
+	r, err := db.Exec(fmt.Sprintf("UPDATE %s%s SET utime=? WHERE uid=? AND code=? AND utime=0", a.DB.Prefix, a.UserRecoveryCodeTable.Name),
+		time.Now().Unix(), v.Uid, EncodeRecoveryCode(code))
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := r.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (S *UserService) HandleUserTOTPEnrollTask(a *UserApp, task *UserTOTPEnrollTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+	var u = User{}
+	var scanner = kk.NewDBScaner(&u)
+
+	rows, err := kk.DBQuery(db, &a.UserTable, prefix, " WHERE id=? AND tid=?", task.Uid, task.Tid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	if !rows.Next() {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
+
+	err = scanner.Scan(rows)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	v, err := GetUserTOTP(a, db, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v != nil && v.Status == UserTOTPStatusEnabled {
+		task.Result.Errno = ERROR_USER_TOTP
+		task.Result.Errmsg = "The two-factor authentication is already enabled"
+		return nil
+	}
+
+	secret, err := NewTOTPSecret()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil {
+		v = &UserTOTP{}
+		v.Uid = task.Uid
+		v.Secret = secret
+		v.Status = UserTOTPStatusPending
+		v.Ctime = time.Now().Unix()
+		v.Mtime = v.Ctime
+		_, err = kk.DBInsert(db, &a.UserTOTPTable, prefix, v)
+	} else {
+		v.Secret = secret
+		v.Counter = 0
+		v.Mtime = time.Now().Unix()
+		_, err = kk.DBUpdateWithKeys(db, &a.UserTOTPTable, prefix, v, map[string]bool{"secret": true, "counter": true, "mtime": true})
+	}
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Secret = secret
+	task.Result.Uri = TOTPUri(a.TOTPIssuer, u.Name, secret)
+
+	return nil
+}
+
+func (S *UserService) HandleUserTOTPConfirmTask(a *UserApp, task *UserTOTPConfirmTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	if task.Code == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_CODE
+		task.Result.Errmsg = "Not found code"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+
+	u, err := getTenantUser(a, db, task.Tid, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if u == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
+
+	v, err := GetUserTOTP(a, db, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil || v.Status != UserTOTPStatusPending {
+		task.Result.Errno = ERROR_USER_TOTP
+		task.Result.Errmsg = "Not found pending two-factor enrollment"
+		return nil
+	}
+
+	var counter = VerifyTOTPCode(v.Secret, strings.TrimSpace(task.Code), v.Counter)
+
+	if counter == 0 {
+		task.Result.Errno = ERROR_USER_CODE
+		task.Result.Errmsg = "The code is invalid"
+		return nil
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var codes = []string{}
+
+	func() {
+
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE uid=?", prefix, a.UserRecoveryCodeTable.Name), task.Uid)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+		for i := 0; i < UserRecoveryCodeCount; i++ {
+
+			code, err := NewRecoveryCode()
+
+			if err != nil {
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+				return
+			}
+
+			var c = UserRecoveryCode{}
+			c.Uid = task.Uid
+			c.Code = EncodeRecoveryCode(code)
+
+			_, err = kk.DBInsert(tx, &a.UserRecoveryCodeTable, prefix, &c)
+
+			if err != nil {
+				task.Result.Errno = ERROR_USER
+				task.Result.Errmsg = err.Error()
+				return
+			}
+
+			codes = append(codes, code)
+		}
+
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET status=?, counter=?, mtime=? WHERE id=?", prefix, a.UserTOTPTable.Name),
+			UserTOTPStatusEnabled, counter, time.Now().Unix(), v.Id)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return
+		}
+
+	}()
+
+	if task.Result.Errno != 0 {
+		tx.Rollback()
+		return nil
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		tx.Rollback()
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.RecoveryCodes = codes
+
+	return nil
+}
+
+func (S *UserService) HandleUserTOTPDisableTask(a *UserApp, task *UserTOTPDisableTask) error {
+
+	if task.Uid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_UID
+		task.Result.Errmsg = "Not found uid"
+		return nil
+	}
+
+	if task.Code == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_CODE
+		task.Result.Errmsg = "Not found code"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+
+	u, err := getTenantUser(a, db, task.Tid, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if u == nil {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+		return nil
+	}
+
+	v, err := GetUserTOTP(a, db, task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil || v.Status != UserTOTPStatusEnabled {
+		task.Result.Errno = ERROR_USER_TOTP
+		task.Result.Errmsg = "The two-factor authentication is not enabled"
+		return nil
+	}
+
+	ok, err := VerifyUserSecondFactor(a, db, v, task.Code)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if !ok {
+		task.Result.Errno = ERROR_USER_CODE
+		task.Result.Errmsg = "The code is invalid"
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE uid=?", prefix, a.UserRecoveryCodeTable.Name), task.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE id=?", prefix, a.UserTOTPTable.Name), v.Id)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	return nil
+}
+
+func (S *UserService) HandleUserTOTPVerifyTask(a *UserApp, task *UserTOTPVerifyTask) error {
+
+	if task.Challenge == "" {
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = "Not found challenge"
+		return nil
+	}
+
+	if task.Code == "" {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_CODE
+		task.Result.Errmsg = "Not found code"
+		return nil
+	}
+
+	var db, err = a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	challenge, err := GetUserChallenge(a, db, UserChallengeTypeLogin, task.Challenge)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if challenge == nil {
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = "The challenge is invalid or has expired"
+		return nil
+	}
+
+	owner, err := getTenantUser(a, db, task.Tid, challenge.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if owner == nil {
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = "The challenge is invalid or has expired"
+		return nil
+	}
+
+	v, err := GetUserTOTP(a, db, challenge.Uid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil || v.Status != UserTOTPStatusEnabled {
+		task.Result.Errno = ERROR_USER_TOTP
+		task.Result.Errmsg = "The two-factor authentication is not enabled"
+		return nil
+	}
+
+	ok, err := VerifyUserSecondFactor(a, db, v, task.Code)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if !ok {
+		FailUserChallenge(a, db, challenge)
+		task.Result.Errno = ERROR_USER_CODE
+		task.Result.Errmsg = "The code is invalid"
+		return nil
+	}
+
+	ok, err = UseUserChallenge(a, db, challenge)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if !ok {
+		task.Result.Errno = ERROR_USER_CHALLENGE
+		task.Result.Errmsg = "The challenge is invalid or has expired"
+		return nil
+	}
+
+	var options = UserLoginOptions{}
+
+	if challenge.Data != "" {
+		json.Decode([]byte(challenge.Data), &options)
+	}
+
+	var u = User{}
+	var scanner = kk.NewDBScaner(&u)
+
+	rows, err := kk.DBQuery(db, &a.UserTable, a.DB.Prefix, " WHERE id=? AND tid=?", challenge.Uid, task.Tid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		if !CheckUserStatus(&u, &task.Result.Result) {
+			return nil
+		}
+
+		CompleteUserLogin(a, db, &u, &options, &task.Result)
+
+		if task.Result.Errno == 0 {
+			WriteUserAudit(a, db, u.Tid, u.Id, u.Name, UserAuditActionLogin, nil, options.Addr)
+		}
+
+	} else {
+		task.Result.Errno = ERROR_USER_NOT_FOUND
+		task.Result.Errmsg = "Not found user"
+	}
+
+	return nil
+}
@@ -1,9 +1,7 @@
 package user
 
 import (
-	"crypto/md5"
 	"database/sql"
-	"encoding/hex"
 	"fmt"
 	"github.com/kkserver/kk-lib/kk"
 	"github.com/kkserver/kk-lib/kk/app"
@@ -11,9 +9,7 @@ import (
 	"github.com/kkserver/kk-lib/kk/app/remote"
 	"github.com/kkserver/kk-lib/kk/json"
 	Value "github.com/kkserver/kk-lib/kk/value"
-	"math/rand"
 	"reflect"
-	"time"
 )
 
 const UserOptionsTypeText = "text"
@@ -21,19 +17,31 @@ const UserOptionsTypeJson = "json"
 
 type User struct {
 	Id       int64  `json:"id"`
+	Tid      int64  `json:"tid"`
 	Name     string `json:"name"`
 	Password string `json:"-"`
 	Ctime    int64  `json:"ctime"`
 	Atime    int64  `json:"atime"`
 	Mtime    int64  `json:"mtime"`
+	Status   int    `json:"status"`
+	Reason   string `json:"reason,omitempty"` // 状态变更原因
+	Stime    int64  `json:"stime,omitempty"`  // 状态变更时间
+
+	Email         UserIdentifierValue `json:"email,omitempty"`
+	EmailVerified int                 `json:"emailVerified"`
+	Phone         UserIdentifierValue `json:"phone,omitempty"`
+	PhoneVerified int                 `json:"phoneVerified"`
 }
 
 type UserOptions struct {
 	Id      int64  `json:"id"`
+	Tid     int64  `json:"tid"`
 	Uid     int64  `json:"uid"`
 	Name    string `json:"name"`
 	Type    string `json:"type"`
 	Options string `json:"options"`
+	Version int64  `json:"version"` // 每次写入加 1
+	Mtime   int64  `json:"mtime"`
 }
 
 type UserApp struct {
@@ -47,25 +55,77 @@ type UserApp struct {
 	Token    string
 	Expires  int64
 	CacheKey string
+	Password *PasswordConfig
+
+	NegativeExpires int64 // 否定缓存时间 (秒), 0 不缓存不存在的配置
+	ExpiresJitter   int64 // 缓存时间的随机增量上限 (秒), 不超过缓存时间
+	EarlyRefresh    int64 // 提前刷新的窗口 (秒), 越接近到期越可能提前重新加载, 0 不提前刷新
+
+	SessionExpires  int64
+	SessionCacheKey string
+
+	JWT *JWTConfig
+
+	TOTPIssuer       string
+	ChallengeExpires int64
+
+	Lockout *LockoutConfig
+
+	ResetExpires  int64
+	VerifyExpires int64
+
+	RoleCacheKey string
+	Notifier     *NotifierConfig
+
+	UserCache    bool // 缓存 User.Get, 缓存服务不可用时关闭
+	UserCacheKey string
+
+	LocalCache *LocalCacheConfig // 进程内缓存, 为空不启用
+
+	AuditRedact string // 审计日志中需要脱敏的配置键, 逗号分隔
+
+	Outbox  *OutboxConfig
+	Webhook *WebhookConfig
+
+	OptionsRevisions       int64 // 每个配置保留的历史版本数, 0 不限
+	OptionsRevisionExpires int64 // 历史版本保留时间 (秒), 0 不限
+
+	OptionsSchemas map[string]interface{} // 配置的 JSON Schema, name=schema 文件路径
+	SchemaExpires  int64                  // Schema 进程内缓存时间 (秒), 默认 60
 
 	UserTable        kk.DBTable
 	UserOptionsTable kk.DBTable
+
+	UserOptionsRevisionTable kk.DBTable
+	UserOptionsSchemaTable   kk.DBTable
+	UserSessionTable         kk.DBTable
+	UserChallengeTable       kk.DBTable
+	UserTOTPTable            kk.DBTable
+	UserRecoveryCodeTable    kk.DBTable
+	UserLockoutTable         kk.DBTable
+
+	UserRoleTable           kk.DBTable
+	UserRolePermissionTable kk.DBTable
+	UserRoleGrantTable      kk.DBTable
+
+	UserGroupTable       kk.DBTable
+	UserGroupMemberTable kk.DBTable
+
+	UserTenantTable kk.DBTable
+	UserAuditTable  kk.DBTable
+	UserEventTable  kk.DBTable
+
+	UserWebhookTable           kk.DBTable
+	UserWebhookDeliveryTable   kk.DBTable
+	UserWebhookDeadLetterTable kk.DBTable
 }
 
 func (C *UserApp) GetDB() (*sql.DB, error) {
 	return C.DB.Get(C)
 }
 
-func EncodePassword(a *UserApp, password string) string {
-	m := md5.New()
-	m.Write([]byte(password))
-	m.Write([]byte(a.Token))
-	v := m.Sum(nil)
-	return hex.EncodeToString(v)
-}
-
-func NewPassword(a *UserApp) string {
-	return EncodePassword(a, fmt.Sprintf("%d %d", time.Now().UnixNano(), rand.Intn(100000)))
+func OptionsCacheKey(a *UserApp, tid int64, uid int64, name string) string {
+	return fmt.Sprintf("%s.%d.%d.%s", a.CacheKey, tid, uid, name)
 }
 
 func (U *UserOptions) GetOptions() interface{} {
@@ -0,0 +1,163 @@
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/json"
+	"strconv"
+)
+
+/**
+ * 用户缓存, UserCache 开启且配置 UserCacheKey 时生效
+ * 按 uid 缓存用户 (不含密码), 按 tid+name 缓存 uid
+ * 缓存服务不可用时关闭 UserCache, 直接读数据库
+ */
+func UserCacheEnabled(a *UserApp) bool {
+	return a.UserCache && a.UserCacheKey != ""
+}
+
+func UserCacheKey(a *UserApp, uid int64) string {
+	return fmt.Sprintf("%s.%d", a.UserCacheKey, uid)
+}
+
+func UserNameCacheKey(a *UserApp, tid int64, name string) string {
+	return fmt.Sprintf("%s.%d.name.%s", a.UserCacheKey, tid, name)
+}
+
+/**
+ * 按 uid 或 tid+name 读缓存, 未命中返回 nil, refresh 为 true 时应提前刷新
+ */
+func GetUserCache(a *UserApp, tid int64, uid int64, name string) (*User, bool) {
+
+	if !UserCacheEnabled(a) {
+		return nil, false
+	}
+
+	if uid == 0 {
+
+		id, err := strconv.ParseInt(GetCacheValue(a, UserNameCacheKey(a, tid, name)), 10, 64)
+
+		if err != nil || id == 0 {
+			return nil, false
+		}
+
+		uid = id
+	}
+
+	s, refresh := GetCacheValueWithRefresh(a, UserCacheKey(a, uid))
+
+	if s == "" {
+		return nil, false
+	}
+
+	var v = User{}
+
+	err := json.Decode([]byte(s), &v)
+
+	if err != nil || v.Id != uid || v.Tid != tid || (name != "" && v.Name != name) {
+		return nil, false
+	}
+
+	return &v, refresh
+}
+
+/**
+ * 先读缓存, 未命中时读数据库并写入缓存, 同一用户的并发读取只查询一次, 不存在返回 nil
+ * 读取期间有缓存失效时不写入缓存, 写入后才发生的失效删除刚写入的缓存
+ */
+func LoadUser(a *UserApp, db *sql.DB, tid int64, uid int64, name string) (*User, error) {
+
+	if v, refresh := GetUserCache(a, tid, uid, name); v != nil && !refresh {
+		return v, nil
+	}
+
+	r, err := cacheLoadGroup.Do(fmt.Sprintf("user.%d.%d.%s", tid, uid, name), func() (interface{}, error) {
+
+		var v = User{}
+		var scanner = kk.NewDBScaner(&v)
+		var rows *sql.Rows = nil
+		var err error = nil
+		var invalidations = CacheInvalidations()
+
+		if uid != 0 {
+			rows, err = kk.DBQuery(db, &a.UserTable, a.DB.Prefix, " WHERE id=? AND tid=?", uid, tid)
+		} else {
+			rows, err = kk.DBQuery(db, &a.UserTable, a.DB.Prefix, " WHERE tid=? AND name=?", tid, name)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rows.Close()
+
+		if !rows.Next() {
+			return nil, nil
+		}
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if CacheInvalidations() == invalidations {
+
+			SetUserCache(a, &v)
+
+			if CacheInvalidations() != invalidations {
+				RemoveUserCache(a, v.Tid, v.Id, v.Name)
+			}
+		}
+
+		return &v, nil
+	})
+
+	if err != nil || r == nil {
+		return nil, err
+	}
+
+	var v = *(r.(*User))
+
+	return &v, nil
+}
+
+/**
+ * 写入缓存, 密码不写入 (User.Password 不参与 JSON 编码)
+ */
+func SetUserCache(a *UserApp, v *User) {
+
+	if !UserCacheEnabled(a) {
+		return
+	}
+
+	var u = *v
+
+	u.Password = ""
+
+	b, err := json.Encode(&u)
+
+	if err != nil {
+		return
+	}
+
+	SetCacheValue(a, UserCacheKey(a, u.Id), string(b), a.Expires)
+	SetCacheValue(a, UserNameCacheKey(a, u.Tid, u.Name), strconv.FormatInt(u.Id, 10), a.Expires)
+}
+
+/**
+ * 用户变更后删除缓存, name 为空时只删除 uid 的缓存
+ */
+func RemoveUserCache(a *UserApp, tid int64, uid int64, name string) {
+
+	if !UserCacheEnabled(a) {
+		return
+	}
+
+	if name == "" {
+		RemoveCacheValues(a, UserCacheKey(a, uid))
+	} else {
+		RemoveCacheValues(a, UserCacheKey(a, uid), UserNameCacheKey(a, tid, name))
+	}
+}
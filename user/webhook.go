@@ -0,0 +1,954 @@
+package user
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/kkserver/kk-lib/kk"
+	"github.com/kkserver/kk-lib/kk/app"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const UserWebhookStatusEnabled = 0
+const UserWebhookStatusDisabled = 1
+
+const UserWebhookSignatureHeader = "X-KK-Signature"
+const UserWebhookEventHeader = "X-KK-Event"
+const UserWebhookDeliveryHeader = "X-KK-Delivery"
+
+/**
+ * Webhook 投递配置
+ */
+type WebhookConfig struct {
+	Limit    int   // 每次投递数, 默认 100
+	MaxCount int   // 最大投递次数, 超过后转入死信, 默认 8
+	Retry    int64 // 重试退避基数 (秒), 默认 5, 按 Retry * 2^(Count-1) 递增
+	MaxRetry int64 // 最大退避 (秒), 默认 3600
+	Timeout  int64 // 超时 (秒), 默认 5
+}
+
+/**
+ * Webhook 订阅
+ * Events 为逗号分隔的事件名, * 为全部
+ */
+type UserWebhook struct {
+	Id     int64  `json:"id"`
+	Tid    int64  `json:"tid"`
+	Url    string `json:"url"`
+	Secret string `json:"-"`
+	Events string `json:"events"`
+	Status int    `json:"status"`
+	Ctime  int64  `json:"ctime"`
+	Mtime  int64  `json:"mtime"`
+}
+
+/**
+ * 待投递
+ */
+type UserWebhookDelivery struct {
+	Id      int64  `json:"id"`
+	Wid     int64  `json:"wid"`
+	Eid     int64  `json:"eid"` // 事件 id
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Count   int    `json:"count"`
+	Ntime   int64  `json:"ntime"` // 下次投递时间, 认领后为租期到期时间
+	Owner   string `json:"-"`     // 认领的分发器
+	Errmsg  string `json:"errmsg,omitempty"`
+	Ctime   int64  `json:"ctime"`
+}
+
+/**
+ * 死信, 超过最大投递次数的投递
+ */
+type UserWebhookDeadLetter struct {
+	Id      int64  `json:"id"`
+	Wid     int64  `json:"wid"`
+	Eid     int64  `json:"eid"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Count   int    `json:"count"`
+	Errmsg  string `json:"errmsg,omitempty"`
+	Ctime   int64  `json:"ctime"` // 投递创建时间
+	Dtime   int64  `json:"dtime"` // 转入死信时间
+}
+
+func (W *UserWebhook) Accept(name string) bool {
+
+	for _, v := range strings.Split(W.Events, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || v == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * 签名 hex(HMAC-SHA256(secret, "<timestamp>.<body>"))
+ * 请求头 X-KK-Signature: t=<timestamp>,v1=<signature>
+ * 接收方应校验签名并拒绝时间偏差过大的请求
+ */
+func SignUserWebhook(secret string, timestamp int64, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	m.Write([]byte("."))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+/**
+ * 校验签名, tolerance 为允许的时间偏差 (秒)
+ */
+func VerifyUserWebhook(secret string, header string, body []byte, tolerance int64) bool {
+
+	var timestamp int64 = 0
+	var signature = ""
+
+	for _, item := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if kv[0] == "t" {
+			timestamp, _ = strconv.ParseInt(kv[1], 10, 64)
+		} else if kv[0] == "v1" {
+			signature = kv[1]
+		}
+	}
+
+	if timestamp == 0 || signature == "" {
+		return false
+	}
+
+	var d = time.Now().Unix() - timestamp
+
+	if tolerance > 0 && (d > tolerance || d < -tolerance) {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(SignUserWebhook(secret, timestamp, body)))
+}
+
+/**
+ * Webhook 由事件分发器投递, 未配置 Outbox 时拒绝 Webhook 任务
+ */
+func CheckUserWebhookEnabled(a *UserApp, result *app.Result) bool {
+
+	if a.Outbox != nil {
+		return true
+	}
+
+	result.Errno = ERROR_USER_WEBHOOK
+	result.Errmsg = "Webhooks require the Outbox to be configured"
+
+	return false
+}
+
+func (C *WebhookConfig) limit() int {
+	if C != nil && C.Limit > 0 {
+		return C.Limit
+	}
+	return 100
+}
+
+func (C *WebhookConfig) maxCount() int {
+	if C != nil && C.MaxCount > 0 {
+		return C.MaxCount
+	}
+	return 8
+}
+
+func (C *WebhookConfig) backoff(count int) int64 {
+
+	var retry int64 = 5
+	var maxRetry int64 = 3600
+
+	if C != nil && C.Retry > 0 {
+		retry = C.Retry
+	}
+
+	if C != nil && C.MaxRetry > 0 {
+		maxRetry = C.MaxRetry
+	}
+
+	var v = retry
+
+	for i := 1; i < count && v < maxRetry; i++ {
+		v = v * 2
+	}
+
+	if v > maxRetry {
+		v = maxRetry
+	}
+
+	return v
+}
+
+func (C *WebhookConfig) timeout() time.Duration {
+	if C != nil && C.Timeout > 0 {
+		return time.Duration(C.Timeout) * time.Second
+	}
+	return 5 * time.Second
+}
+
+func GetUserWebhook(a *UserApp, db *sql.DB, id int64) (*UserWebhook, error) {
+
+	var v = UserWebhook{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserWebhookTable, a.DB.Prefix, " WHERE id=?", id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &v, nil
+	}
+
+	return nil, nil
+}
+
+/**
+ * 为订阅了该事件的 Webhook 创建待投递记录, 由事件分发器调用
+ * 与 UserEventSinkWebhooks 标记在同一事务中写入, 事件重试时不会重复创建
+ */
+func EnqueueUserWebhookDeliveries(a *UserApp, db *sql.DB, e *UserEvent, body []byte) error {
+
+	var webhooks = []UserWebhook{}
+	var w = UserWebhook{}
+	var scanner = kk.NewDBScaner(&w)
+
+	rows, err := kk.DBQuery(db, &a.UserWebhookTable, a.DB.Prefix, " WHERE tid=? AND status=?", e.Tid, UserWebhookStatusEnabled)
+
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		if w.Accept(e.Name) {
+			webhooks = append(webhooks, w)
+		}
+	}
+
+	rows.Close()
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	var now = time.Now().Unix()
+
+	for _, w := range webhooks {
+
+		var v = UserWebhookDelivery{}
+
+		v.Wid = w.Id
+		v.Eid = e.Id
+		v.Name = e.Name
+		v.Content = string(body)
+		v.Ntime = now
+		v.Ctime = now
+
+		_, err = kk.DBInsert(tx, &a.UserWebhookDeliveryTable, a.DB.Prefix, &v)
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("UPDATE %s%s SET sinks=sinks|? WHERE id=?", a.DB.Prefix, a.UserEventTable.Name), UserEventSinkWebhooks, e.Id)
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	e.Sinks = e.Sinks | UserEventSinkWebhooks
+
+	return nil
+}
+
+func (C *WebhookConfig) Post(w *UserWebhook, v *UserWebhookDelivery) error {
+
+	var client = http.Client{Timeout: C.timeout()}
+	var body = []byte(v.Content)
+	var timestamp = time.Now().Unix()
+
+	req, err := http.NewRequest("POST", w.Url, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(UserWebhookEventHeader, v.Name)
+	req.Header.Set(UserWebhookDeliveryHeader, strconv.FormatInt(v.Id, 10))
+	req.Header.Set(UserWebhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, SignUserWebhook(w.Secret, timestamp, body)))
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+/**
+ * 转入死信
+ */
+func deadUserWebhookDelivery(a *UserApp, db *sql.DB, v *UserWebhookDelivery) error {
+
+	var d = UserWebhookDeadLetter{}
+
+	d.Wid = v.Wid
+	d.Eid = v.Eid
+	d.Name = v.Name
+	d.Content = v.Content
+	d.Count = v.Count
+	d.Errmsg = v.Errmsg
+	d.Ctime = v.Ctime
+	d.Dtime = time.Now().Unix()
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = kk.DBInsert(tx, &a.UserWebhookDeadLetterTable, a.DB.Prefix, &d)
+
+	if err == nil {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE id=?", a.DB.Prefix, a.UserWebhookDeliveryTable.Name), v.Id)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		tx.Rollback()
+	}
+
+	return err
+}
+
+/**
+ * 认领并投递一批到期的 Webhook, 返回处理的投递数, 租期同 Outbox.Lease
+ * 成功后删除, 失败按指数退避重试, 超过 MaxCount 次转入死信
+ */
+func DispatchUserWebhooks(a *UserApp, db *sql.DB) (int, error) {
+
+	var C = a.Webhook
+	var prefix = a.DB.Prefix
+	var deliveries = []UserWebhookDelivery{}
+
+	var v = UserWebhookDelivery{}
+	var scanner = kk.NewDBScaner(&v)
+
+	owner, err := claimDispatchRows(db, prefix+a.UserWebhookDeliveryTable.Name, "", a.Outbox.lease(), C.limit())
+
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := kk.DBQuery(db, &a.UserWebhookDeliveryTable, prefix, " WHERE owner=? ORDER BY id ASC", owner)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		deliveries = append(deliveries, v)
+	}
+
+	rows.Close()
+
+	var webhooks = map[int64]*UserWebhook{}
+
+	for i := range deliveries {
+
+		var d = &deliveries[i]
+
+		w, ok := webhooks[d.Wid]
+
+		if !ok {
+
+			w, err = GetUserWebhook(a, db, d.Wid)
+
+			if err != nil {
+				return i, err
+			}
+
+			webhooks[d.Wid] = w
+		}
+
+		if w == nil || w.Status != UserWebhookStatusEnabled {
+			err = fmt.Errorf("The webhook %d is removed or disabled", d.Wid)
+		} else {
+			err = C.Post(w, d)
+		}
+
+		d.Count = d.Count + 1
+
+		if err == nil {
+			_, err = db.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE id=?", prefix, a.UserWebhookDeliveryTable.Name), d.Id)
+		} else {
+
+			d.Errmsg = err.Error()
+
+			if len(d.Errmsg) > 255 {
+				d.Errmsg = d.Errmsg[0:255]
+			}
+
+			log.Println(fmt.Sprintf("[DispatchUserWebhooks] %d %d %s %s", d.Id, d.Wid, d.Name, d.Errmsg))
+
+			if w == nil || d.Count >= C.maxCount() {
+				err = deadUserWebhookDelivery(a, db, d)
+			} else {
+				d.Ntime = time.Now().Unix() + C.backoff(d.Count)
+				d.Owner = ""
+				_, err = kk.DBUpdateWithKeys(db, &a.UserWebhookDeliveryTable, prefix, d, map[string]bool{"count": true, "ntime": true, "owner": true, "errmsg": true})
+			}
+		}
+
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(deliveries), nil
+}
+
+func (S *UserService) HandleUserWebhookCreateTask(a *UserApp, task *UserWebhookCreateTask) error {
+
+	if !CheckUserWebhookEnabled(a, &task.Result.Result) {
+		return nil
+	}
+
+	u, err := url.Parse(task.Url)
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		task.Result.Errno = ERROR_USER_WEBHOOK
+		task.Result.Errmsg = "Invalid webhook url"
+		return nil
+	}
+
+	if task.Events == "" {
+		task.Result.Errno = ERROR_USER_WEBHOOK
+		task.Result.Errmsg = "Not found events"
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var v = UserWebhook{}
+
+	v.Tid = task.Tid
+	v.Url = task.Url
+	v.Events = task.Events
+	v.Secret = task.Secret
+	v.Status = UserWebhookStatusEnabled
+	v.Ctime = time.Now().Unix()
+	v.Mtime = v.Ctime
+
+	if v.Secret == "" {
+
+		v.Secret, err = NewSessionToken()
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+	}
+
+	r, err := kk.DBInsert(db, &a.UserWebhookTable, a.DB.Prefix, &v)
+
+	if err == nil {
+		v.Id, err = r.LastInsertId()
+	}
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Webhook = &v
+	task.Result.Secret = v.Secret
+
+	return nil
+}
+
+func (S *UserService) HandleUserWebhookSetTask(a *UserApp, task *UserWebhookSetTask) error {
+
+	if !CheckUserWebhookEnabled(a, &task.Result.Result) {
+		return nil
+	}
+
+	if task.Id == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_WEBHOOK
+		task.Result.Errmsg = "Not found webhook id"
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	v, err := GetUserWebhook(a, db, task.Id)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	if v == nil || v.Tid != task.Tid {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_WEBHOOK
+		task.Result.Errmsg = "Not found webhook"
+		return nil
+	}
+
+	var keys = map[string]bool{"mtime": true}
+
+	if task.Url != "" {
+
+		u, err := url.Parse(task.Url)
+
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			task.Result.Errno = ERROR_USER_WEBHOOK
+			task.Result.Errmsg = "Invalid webhook url"
+			return nil
+		}
+
+		v.Url = task.Url
+		keys["url"] = true
+	}
+
+	if task.Events != "" {
+		v.Events = task.Events
+		keys["events"] = true
+	}
+
+	if task.Secret != "" {
+		v.Secret = task.Secret
+		keys["secret"] = true
+	}
+
+	if task.Status != "" {
+
+		status, err := strconv.Atoi(task.Status)
+
+		if err != nil || (status != UserWebhookStatusEnabled && status != UserWebhookStatusDisabled) {
+			task.Result.Errno = ERROR_USER_WEBHOOK
+			task.Result.Errmsg = "Invalid webhook status"
+			return nil
+		}
+
+		v.Status = status
+		keys["status"] = true
+	}
+
+	v.Mtime = time.Now().Unix()
+
+	_, err = kk.DBUpdateWithKeys(db, &a.UserWebhookTable, a.DB.Prefix, v, keys)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Webhook = v
+
+	return nil
+}
+
+func (S *UserService) HandleUserWebhookRemoveTask(a *UserApp, task *UserWebhookRemoveTask) error {
+
+	if !CheckUserWebhookEnabled(a, &task.Result.Result) {
+		return nil
+	}
+
+	if task.Id == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_WEBHOOK
+		task.Result.Errmsg = "Not found webhook id"
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE wid IN (SELECT id FROM %s%s WHERE id=? AND tid=?)", prefix, a.UserWebhookDeliveryTable.Name, prefix, a.UserWebhookTable.Name), task.Id, task.Tid)
+
+	if err == nil {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE id=? AND tid=?", prefix, a.UserWebhookTable.Name), task.Id, task.Tid)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		tx.Rollback()
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	return nil
+}
+
+func (S *UserService) HandleUserWebhookQueryTask(a *UserApp, task *UserWebhookQueryTask) error {
+
+	if !CheckUserWebhookEnabled(a, &task.Result.Result) {
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var webhooks = []UserWebhook{}
+	var v = UserWebhook{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserWebhookTable, a.DB.Prefix, " WHERE tid=? ORDER BY id ASC", task.Tid)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		webhooks = append(webhooks, v)
+	}
+
+	task.Result.Webhooks = webhooks
+
+	return nil
+}
+
+/**
+ * 死信查询
+ */
+func (S *UserService) HandleUserWebhookFailedTask(a *UserApp, task *UserWebhookFailedTask) error {
+
+	if !CheckUserWebhookEnabled(a, &task.Result.Result) {
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var items = []UserWebhookDeadLetter{}
+	var prefix = a.DB.Prefix
+
+	sql := bytes.NewBuffer(nil)
+
+	args := []interface{}{}
+
+	sql.WriteString(fmt.Sprintf(" WHERE wid IN (SELECT id FROM %s%s WHERE tid=?)", prefix, a.UserWebhookTable.Name))
+
+	args = append(args, task.Tid)
+
+	if task.Wid != 0 {
+		sql.WriteString(" AND wid=?")
+		args = append(args, task.Wid)
+	}
+
+	if task.Name != "" {
+		sql.WriteString(" AND name=?")
+		args = append(args, task.Name)
+	}
+
+	sql.WriteString(" ORDER BY id DESC")
+
+	var pageIndex = task.PageIndex
+	var pageSize = task.PageSize
+
+	if pageIndex < 1 {
+		pageIndex = 1
+	}
+
+	if pageSize < 1 {
+		pageSize = 10
+	}
+
+	if task.Counter {
+		task.Result.Counter, err = NewUserQueryCounter(db, &a.UserWebhookDeadLetterTable, prefix, pageIndex, pageSize, sql.String(), args...)
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+	}
+
+	sql.WriteString(fmt.Sprintf(" LIMIT %d,%d", (pageIndex-1)*pageSize, pageSize))
+
+	var v = UserWebhookDeadLetter{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserWebhookDeadLetterTable, prefix, sql.String(), args...)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		items = append(items, v)
+	}
+
+	task.Result.Deliveries = items
+
+	return nil
+}
+
+/**
+ * 重新投递死信, Ids 为逗号分隔的死信 id, 为空时重新投递 Wid 的全部死信
+ */
+func (S *UserService) HandleUserWebhookReplayTask(a *UserApp, task *UserWebhookReplayTask) error {
+
+	if !CheckUserWebhookEnabled(a, &task.Result.Result) {
+		return nil
+	}
+
+	if task.Ids == "" && task.Wid == 0 {
+		task.Result.Errno = ERROR_USER_NOT_FOUND_WEBHOOK
+		task.Result.Errmsg = "Not found ids or wid"
+		return nil
+	}
+
+	db, err := a.GetDB()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var prefix = a.DB.Prefix
+
+	sql := bytes.NewBuffer(nil)
+
+	args := []interface{}{}
+
+	sql.WriteString(fmt.Sprintf(" WHERE wid IN (SELECT id FROM %s%s WHERE tid=?)", prefix, a.UserWebhookTable.Name))
+
+	args = append(args, task.Tid)
+
+	if task.Wid != 0 {
+		sql.WriteString(" AND wid=?")
+		args = append(args, task.Wid)
+	}
+
+	if task.Ids != "" {
+
+		sql.WriteString(" AND id IN (")
+
+		for i, id := range strings.Split(task.Ids, ",") {
+
+			v, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+
+			if err != nil {
+				task.Result.Errno = ERROR_USER_WEBHOOK
+				task.Result.Errmsg = "Invalid id " + id
+				return nil
+			}
+
+			if i != 0 {
+				sql.WriteString(",")
+			}
+
+			sql.WriteString("?")
+			args = append(args, v)
+		}
+
+		sql.WriteString(")")
+	}
+
+	var items = []UserWebhookDeadLetter{}
+	var v = UserWebhookDeadLetter{}
+	var scanner = kk.NewDBScaner(&v)
+
+	rows, err := kk.DBQuery(db, &a.UserWebhookDeadLetterTable, prefix, sql.String(), args...)
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	for rows.Next() {
+
+		err = scanner.Scan(rows)
+
+		if err != nil {
+			rows.Close()
+			task.Result.Errno = ERROR_USER
+			task.Result.Errmsg = err.Error()
+			return nil
+		}
+
+		items = append(items, v)
+	}
+
+	rows.Close()
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	var now = time.Now().Unix()
+
+	for _, item := range items {
+
+		var d = UserWebhookDelivery{}
+
+		d.Wid = item.Wid
+		d.Eid = item.Eid
+		d.Name = item.Name
+		d.Content = item.Content
+		d.Ntime = now
+		d.Ctime = now
+
+		_, err = kk.DBInsert(tx, &a.UserWebhookDeliveryTable, prefix, &d)
+
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s%s WHERE id=?", prefix, a.UserWebhookDeadLetterTable.Name), item.Id)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		tx.Rollback()
+		task.Result.Errno = ERROR_USER
+		task.Result.Errmsg = err.Error()
+		return nil
+	}
+
+	task.Result.Count = len(items)
+
+	return nil
+}
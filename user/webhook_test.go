@@ -0,0 +1,165 @@
+package user
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSignUserWebhook(t *testing.T) {
+
+	var body = []byte(`{"id":1}`)
+	var now = time.Now().Unix()
+	var header = fmt.Sprintf("t=%d,v1=%s", now, SignUserWebhook("secret", now, body))
+
+	if !VerifyUserWebhook("secret", header, body, 300) {
+		t.Fatal("valid signature rejected")
+	}
+
+	if VerifyUserWebhook("other", header, body, 300) {
+		t.Fatal("wrong secret accepted")
+	}
+
+	if VerifyUserWebhook("secret", header, []byte(`{"id":2}`), 300) {
+		t.Fatal("modified body accepted")
+	}
+
+	var old = now - 600
+
+	if VerifyUserWebhook("secret", fmt.Sprintf("t=%d,v1=%s", old, SignUserWebhook("secret", old, body)), body, 300) {
+		t.Fatal("stale timestamp accepted")
+	}
+
+	if VerifyUserWebhook("secret", "v1=abc", body, 0) {
+		t.Fatal("header without timestamp accepted")
+	}
+}
+
+func TestUserWebhookPost(t *testing.T) {
+
+	var w = UserWebhook{Id: 1, Secret: "secret", Events: "*"}
+	var d = UserWebhookDelivery{Id: 7, Wid: 1, Name: UserEventCreated, Content: `{"id":3,"name":"user.created"}`}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Method != "POST" ||
+			r.Header.Get(UserWebhookEventHeader) != d.Name ||
+			r.Header.Get(UserWebhookDeliveryHeader) != strconv.FormatInt(d.Id, 10) ||
+			string(body) != d.Content ||
+			!VerifyUserWebhook(w.Secret, r.Header.Get(UserWebhookSignatureHeader), body, 300) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	defer server.Close()
+
+	w.Url = server.URL
+
+	var C = WebhookConfig{}
+
+	if err := C.Post(&w, &d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserWebhookPostRetry(t *testing.T) {
+
+	var count int32 = 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	defer server.Close()
+
+	var w = UserWebhook{Id: 1, Url: server.URL, Secret: "secret"}
+	var d = UserWebhookDelivery{Id: 1, Content: "{}"}
+	var C = WebhookConfig{Retry: 5, MaxRetry: 15, MaxCount: 8}
+	var backoffs = []int64{}
+
+	for {
+
+		err := C.Post(&w, &d)
+
+		d.Count = d.Count + 1
+
+		if err == nil {
+			break
+		}
+
+		if d.Count >= C.maxCount() {
+			t.Fatal(err)
+		}
+
+		backoffs = append(backoffs, C.backoff(d.Count))
+	}
+
+	if d.Count != 3 || fmt.Sprint(backoffs) != "[5 10]" {
+		t.Fatalf("count %d backoffs %v", d.Count, backoffs)
+	}
+
+	if C.backoff(10) != 15 {
+		t.Fatalf("backoff(10) = %d", C.backoff(10))
+	}
+}
+
+func TestUserWebhookPostTimeout(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+	}))
+
+	defer server.Close()
+
+	var C = WebhookConfig{Timeout: 1}
+
+	if err := C.Post(&UserWebhook{Url: server.URL}, &UserWebhookDelivery{}); err == nil {
+		t.Fatal("timeout not reported")
+	}
+}
+
+func TestUserWebhookAccept(t *testing.T) {
+
+	var w = UserWebhook{Events: "user.created, user.deleted"}
+
+	if !w.Accept(UserEventCreated) || !w.Accept(UserEventDeleted) || w.Accept(UserEventUpdated) {
+		t.Fatal("Accept")
+	}
+
+	w.Events = "*"
+
+	if !w.Accept(UserEventUpdated) {
+		t.Fatal("Accept *")
+	}
+}
+
+func TestCheckUserWebhookEnabled(t *testing.T) {
+
+	var a = UserApp{}
+	var task = UserWebhookCreateTask{}
+
+	if CheckUserWebhookEnabled(&a, &task.Result.Result) || task.Result.Errno != ERROR_USER_WEBHOOK {
+		t.Fatal("webhook task accepted without Outbox")
+	}
+
+	a.Outbox = &OutboxConfig{}
+	task = UserWebhookCreateTask{}
+
+	if !CheckUserWebhookEnabled(&a, &task.Result.Result) {
+		t.Fatal("webhook task rejected with Outbox")
+	}
+}